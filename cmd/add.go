@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"log"
 	"os"
 	"path/filepath"
 
 	"github.com/absfs/afero"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
 )
 
 var addCommand = &cobra.Command{
@@ -22,30 +25,62 @@ func init() {
 	persistentFlags.BoolVarP(&config.Add.Empty, "empty", "e", false, "add empty files")
 	persistentFlags.BoolVarP(&config.Add.Recursive, "recursive", "r", false, "recurse in to subdirectories")
 	persistentFlags.BoolVarP(&config.Add.Template, "template", "T", false, "add files as templates")
+	persistentFlags.StringVar(&config.Add.TemplateFormat, "template-format", "", "only replace whole values in format (auto, ini, json, toml, or yaml)")
+	persistentFlags.IntVar(&config.Add.TemplateMinLength, "template-min-length", 3, "minimum length of values to replace in templates")
 }
 
 func (c *Config) runAddCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
-	targetState, err := c.getTargetState(fs)
-	if err != nil {
-		return err
+	switch c.Add.TemplateFormat {
+	case "", chezmoi.AutoTemplateFormatAuto, chezmoi.AutoTemplateFormatINI, chezmoi.AutoTemplateFormatJSON, chezmoi.AutoTemplateFormatTOML, chezmoi.AutoTemplateFormatYAML:
+	default:
+		return errors.Errorf("%s: unknown template format", c.Add.TemplateFormat)
+	}
+	addOptions := chezmoi.AddOptions{
+		Empty:    c.Add.Empty,
+		Template: c.Add.Template,
+		AutoTemplate: chezmoi.AutoTemplateOptions{
+			MinValueLength: c.Add.TemplateMinLength,
+			Format:         c.Add.TemplateFormat,
+		},
+	}
+	if c.DryRun {
+		addOptions.Substitutions = func(targetPath string, substitutions []chezmoi.Substitution) {
+			for _, substitution := range substitutions {
+				log.Printf("%s:%d: %q -> {{ .%s }}", targetPath, substitution.Line, substitution.Value, substitution.Variable)
+			}
+		}
 	}
 	actuator := c.getDefaultActuator(fs)
+	targetStates := make(map[string]*chezmoi.RootState)
 	for _, arg := range args {
 		path, err := filepath.Abs(arg)
 		if err != nil {
 			return err
 		}
+		root, err := c.findTargetRoot(path)
+		if err != nil {
+			return err
+		}
+		// Targets are added to a single layer.
+		root, err = c.getLayerRoot(root)
+		if err != nil {
+			return err
+		}
+		targetState, err := c.getCachedRootTargetState(fs, targetStates, root)
+		if err != nil {
+			return err
+		}
 		if c.Add.Recursive {
 			if err := afero.Walk(fs, path, func(path string, info os.FileInfo, err error) error {
 				if err != nil {
 					return err
 				}
-				return targetState.Add(fs, path, info, c.Add.Empty, c.Add.Template, actuator)
+				return targetState.Add(fs, addOptions, path, info, actuator)
 			}); err != nil {
 				return err
 			}
 		} else {
-			if err := targetState.Add(fs, path, nil, c.Add.Empty, c.Add.Template, actuator); err != nil {
+			if err := targetState.Add(fs, addOptions, path, nil, actuator); err != nil {
 				return err
 			}
 		}
@@ -12,6 +12,7 @@ func TestAddCommand(t *testing.T) {
 		name             string
 		args             []string
 		addCommandConfig AddCommandConfig
+		roots            map[string]RootConfig
 		mapFs            map[string]string
 		wantMapFs        map[string]string
 	}{
@@ -31,6 +32,23 @@ func TestAddCommand(t *testing.T) {
 				"/home/jenkins/.gitconfig":                  "[user]\n\tname = John Smith\n\temail = john.smith@company.com\n",
 			},
 		},
+		{
+			name: "add_template_format",
+			args: []string{"/home/jenkins/.config/app.json"},
+			addCommandConfig: AddCommandConfig{
+				Template:       true,
+				TemplateFormat: "auto",
+			},
+			mapFs: map[string]string{
+				"/home/jenkins/.chezmoi/.keep":   "",
+				"/home/jenkins/.config/app.json": "{\"author\": \"John Smith\", \"John Smith\": \"John Smith <john.smith@company.com>\"}",
+			},
+			wantMapFs: map[string]string{
+				"/home/jenkins/.chezmoi/.keep":                    "",
+				"/home/jenkins/.chezmoi/dot_config/app.json.tmpl": "{\"author\": \"{{ .name }}\", \"John Smith\": \"John Smith <john.smith@company.com>\"}",
+				"/home/jenkins/.config/app.json":                  "{\"author\": \"John Smith\", \"John Smith\": \"John Smith <john.smith@company.com>\"}",
+			},
+		},
 		{
 			name: "add_recursive",
 			args: []string{"/home/jenkins/.config"},
@@ -76,6 +94,24 @@ func TestAddCommand(t *testing.T) {
 				"/home/jenkins/empty":                "",
 			},
 		},
+		{
+			name: "add_root",
+			args: []string{"/etc/hosts"},
+			roots: map[string]RootConfig{
+				"etc": {
+					TargetDir: "/etc",
+				},
+			},
+			mapFs: map[string]string{
+				"/home/jenkins/.chezmoi/.keep": "",
+				"/etc/hosts":                   "127.0.0.1 localhost\n",
+			},
+			wantMapFs: map[string]string{
+				"/home/jenkins/.chezmoi/.keep":                   "",
+				"/home/jenkins/.chezmoi/.chezmoiroots/etc/hosts": "127.0.0.1 localhost\n",
+				"/etc/hosts": "127.0.0.1 localhost\n",
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			c := &Config{
@@ -89,7 +125,8 @@ func TestAddCommand(t *testing.T) {
 					"name":  "John Smith",
 					"email": "john.smith@company.com",
 				},
-				Add: tc.addCommandConfig,
+				Roots: tc.roots,
+				Add:   tc.addCommandConfig,
 			}
 			fs, err := absfstesting.MakeMemMapFs(tc.mapFs)
 			if err != nil {
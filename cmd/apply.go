@@ -1,8 +1,19 @@
 package cmd
 
 import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
 	"github.com/absfs/afero"
+	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
 )
 
 var applyCommand = &cobra.Command{
@@ -14,13 +25,151 @@ var applyCommand = &cobra.Command{
 
 func init() {
 	rootCommand.AddCommand(applyCommand)
+
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	persistentFlags := applyCommand.PersistentFlags()
+	persistentFlags.BoolVarP(&config.KeepGoing, "keep-going", "k", false, "keep going as far as possible after an error")
+	persistentFlags.BoolVar(&config.Apply.Transactional, "transactional", false, "roll back all changes if any fail")
+	persistentFlags.BoolVar(&config.Backup.Enabled, "backup", false, "back up targets before changing them")
+	viper.BindPFlag("backup.enabled", persistentFlags.Lookup("backup"))
+	persistentFlags.StringVar(&config.Apply.JournalDir, "journal", filepath.Join(homeDir, ".chezmoi.journal"), "journal directory for transactional applies")
 }
 
 func (c *Config) runApplyCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
-	targetState, err := c.getTargetState(fs)
+	c.fetchExternals = true
+	roots, err := c.getTargetRoots()
+	if err != nil {
+		return err
+	}
+	return c.applyRoots(fs, roots, nil, true)
+}
+
+// applyRoots applies roots. If targetNames is not nil then only the targets
+// in targetNames[root.name] are applied in each root. If prompt is false,
+// because something else is using the terminal, then targets that should be
+// removed are only removed with --force.
+func (c *Config) applyRoots(fs afero.Fs, roots []*targetRoot, targetNames map[string][]string, prompt bool) error {
+	applyOptions, err := c.getApplyOptions(fs)
 	if err != nil {
 		return err
 	}
-	actuator := c.getDefaultActuator(fs)
-	return targetState.Apply(fs, actuator)
+	// Verbose output includes diffs, which need the current contents.
+	applyOptions.ReadCurrentContents = c.Verbose
+	if !c.Force && !c.DryRun {
+		applyOptions.ConfirmRemove = func(targetPath string) (bool, error) {
+			if !prompt {
+				return false, nil
+			}
+			return c.confirm(fmt.Sprintf("Remove %s?", targetPath))
+		}
+	}
+
+	backup := c.Backup.Enabled && !c.DryRun
+	var backupDir string
+	if backup {
+		if backupDir, err = chezmoi.NewBackupDir(fs, c.Backup.Dir, time.Now()); err != nil {
+			return err
+		}
+	}
+	actuators := make([]chezmoi.Actuator, len(roots))
+	var transactions []*chezmoi.TransactionActuator
+	for i, root := range roots {
+		actuators[i] = c.getRootActuator(fs, root)
+		if c.DryRun {
+			continue
+		}
+		// Always recover from an earlier transactional apply that did not
+		// finish, even if this apply is not transactional. Rolling back
+		// restores the original targets, so nothing is backed up.
+		transaction := chezmoi.NewTransactionActuator(fs, filepath.Join(c.Apply.JournalDir, root.name), actuators[i])
+		pending, err := transaction.Pending()
+		if err != nil {
+			return err
+		}
+		if pending {
+			log.Printf("%s: rolling back unfinished apply", root.name)
+			if err := transaction.Rollback(); err != nil {
+				return err
+			}
+		}
+		if c.Apply.Transactional {
+			actuators[i] = transaction
+			transactions = append(transactions, transaction)
+		}
+		// Back up targets before the transaction records and changes them,
+		// so that rolling back does not back them up again.
+		if backup {
+			actuators[i] = chezmoi.NewBackupActuator(fs, backupDir, actuators[i])
+		}
+	}
+
+	if len(transactions) != 0 {
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(interrupts)
+		go func() {
+			for range interrupts {
+				for _, transaction := range transactions {
+					transaction.Interrupt()
+				}
+			}
+		}()
+	}
+
+	rollback := func() {
+		for j := len(transactions) - 1; j >= 0; j-- {
+			if err := transactions[j].Rollback(); err != nil {
+				log.Printf("rollback: %v", err)
+			}
+		}
+	}
+	var errs chezmoi.MultiError
+	for i, root := range roots {
+		rootApplyOptions := applyOptions
+		if targetNames != nil {
+			rootApplyOptions.TargetNames = targetNames[root.name]
+		}
+		targetState, err := c.getRootTargetState(fs, root)
+		if err == nil {
+			err = targetState.Apply(fs, rootApplyOptions, actuators[i])
+		}
+		if err != nil {
+			if !c.KeepGoing {
+				rollback()
+				return err
+			}
+			errs = appendErrors(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		rollback()
+		return errs
+	}
+	// An interrupt can arrive after the last change, in which case all
+	// changes are rolled back rather than committed.
+	for _, transaction := range transactions {
+		if transaction.Interrupted() {
+			rollback()
+			return chezmoi.ErrInterrupted
+		}
+	}
+	for _, transaction := range transactions {
+		if err := transaction.Commit(); err != nil {
+			rollback()
+			return err
+		}
+	}
+	if backup && c.Backup.Keep > 0 {
+		if err := chezmoi.PruneBackups(fs, c.Backup.Dir, c.Backup.Keep); err != nil {
+			return err
+		}
+	}
+	if c.DryRun {
+		return nil
+	}
+	return applyOptions.State.Save(fs, c.StateFile)
 }
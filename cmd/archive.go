@@ -1,32 +1,107 @@
 package cmd
 
 import (
-	"archive/tar"
 	"os"
+	"os/user"
+	"strconv"
+	"time"
 
 	"github.com/absfs/afero"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
 )
 
 var archiveCommand = &cobra.Command{
 	Use:   "archive",
 	Args:  cobra.NoArgs,
-	Short: "Write a tar archive of the target state to stdout",
+	Short: "Write an archive of the target state",
 	RunE:  makeRunE(config.runArchiveCommandE),
 }
 
 func init() {
 	rootCommand.AddCommand(archiveCommand)
+
+	persistentFlags := archiveCommand.PersistentFlags()
+	persistentFlags.StringVar(&config.Archive.Format, "format", "", "format (tar, tar.gz, or zip), default from the output file name")
+	persistentFlags.StringVarP(&config.Archive.Output, "output", "o", "", "output file, default stdout")
+	persistentFlags.StringSliceVar(&config.Archive.Include, "include", nil, "only include entry types (dir or file)")
+	persistentFlags.StringSliceVar(&config.Archive.Exclude, "exclude", nil, "exclude entry types (dir or file)")
+	persistentFlags.StringSliceVar(&config.Archive.IncludePaths, "include-path", nil, "only include targets matching patterns")
+	persistentFlags.StringSliceVar(&config.Archive.ExcludePaths, "exclude-path", nil, "exclude targets matching patterns")
+	persistentFlags.BoolVar(&config.Archive.NumericOwner, "numeric-owner", false, "omit user and group names")
+	persistentFlags.BoolVar(&config.Archive.Reproducible, "reproducible", false, "write a reproducible archive")
 }
 
 func (c *Config) runArchiveCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
+	c.fetchExternals = true
+	archiveOptions, err := c.getArchiveOptions()
+	if err != nil {
+		return err
+	}
 	targetState, err := c.getTargetState(fs)
 	if err != nil {
 		return err
 	}
-	w := tar.NewWriter(os.Stdout)
-	if err := targetState.Archive(w, os.FileMode(c.Umask)); err != nil {
+	umask := os.FileMode(c.Umask)
+	if c.Archive.Output == "" {
+		return targetState.Archive(fs, os.Stdout, umask, archiveOptions)
+	}
+	f, err := fs.OpenFile(c.Archive.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if err := targetState.Archive(fs, f, umask, archiveOptions); err != nil {
+		f.Close()
 		return err
 	}
-	return w.Close()
+	return f.Close()
+}
+
+// getArchiveOptions returns the archive options for c. The modification time
+// is taken from the SOURCE_DATE_EPOCH environment variable, if it is set. If
+// c.Archive.Reproducible is true then the modification time defaults to the
+// Unix epoch and entries are owned by uid and gid 0.
+func (c *Config) getArchiveOptions() (chezmoi.ArchiveOptions, error) {
+	archiveOptions := chezmoi.ArchiveOptions{
+		Format:       c.Archive.Format,
+		IncludeTypes: c.Archive.Include,
+		ExcludeTypes: c.Archive.Exclude,
+		IncludePaths: c.Archive.IncludePaths,
+		ExcludePaths: c.Archive.ExcludePaths,
+	}
+	if archiveOptions.Format == "" {
+		archiveOptions.Format = chezmoi.ArchiveFormatFromName(c.Archive.Output)
+	}
+	if sourceDateEpoch, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
+		seconds, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+		if err != nil {
+			return chezmoi.ArchiveOptions{}, errors.Errorf("SOURCE_DATE_EPOCH: %s: invalid timestamp", sourceDateEpoch)
+		}
+		archiveOptions.ModTime = time.Unix(seconds, 0)
+	} else if !c.Archive.Reproducible {
+		archiveOptions.ModTime = time.Now()
+	}
+	if c.Archive.Reproducible {
+		return archiveOptions, nil
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return chezmoi.ArchiveOptions{}, err
+	}
+	if archiveOptions.UID, err = strconv.Atoi(currentUser.Uid); err != nil {
+		return chezmoi.ArchiveOptions{}, err
+	}
+	if archiveOptions.GID, err = strconv.Atoi(currentUser.Gid); err != nil {
+		return chezmoi.ArchiveOptions{}, err
+	}
+	if !c.Archive.NumericOwner {
+		group, err := user.LookupGroupId(currentUser.Gid)
+		if err != nil {
+			return chezmoi.ArchiveOptions{}, err
+		}
+		archiveOptions.Uname = currentUser.Username
+		archiveOptions.Gname = group.Name
+	}
+	return archiveOptions, nil
 }
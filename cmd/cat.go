@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"os"
+	"path/filepath"
 
 	"github.com/absfs/afero"
 	"github.com/pkg/errors"
@@ -21,6 +22,7 @@ func init() {
 }
 
 func (c *Config) runCatCommand(fs afero.Fs, command *cobra.Command, args []string) error {
+	c.fetchExternals = true
 	targetState, err := c.getTargetState(fs)
 	if err != nil {
 		return err
@@ -34,7 +36,11 @@ func (c *Config) runCatCommand(fs afero.Fs, command *cobra.Command, args []strin
 		if !ok {
 			return errors.Errorf("%s: not a regular file", arg)
 		}
-		if _, err := os.Stdout.Write(fileState.Contents); err != nil {
+		contents, err := fileState.TargetContents(fs, filepath.Join(c.TargetDir, arg))
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stdout.Write(contents); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/absfs/afero"
+	"github.com/spf13/cobra"
+)
+
+var cdCommand = &cobra.Command{
+	Use:   "cd",
+	Args:  cobra.NoArgs,
+	Short: "Launch a shell in the source directory",
+	RunE:  makeRunE(config.runCDCommandE),
+}
+
+func init() {
+	rootCommand.AddCommand(cdCommand)
+}
+
+func (c *Config) runCDCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
+	shell := c.CD.Command
+	if shell == "" {
+		shell = os.Getenv("SHELL")
+	}
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	err := c.run(c.SourceDir, append([]string{shell}, c.CD.Args...))
+	// The shell's exit status is that of the last command the user ran, so
+	// it is not an error.
+	if _, ok := err.(*exec.ExitError); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/d4l3k/messagediff"
+	"github.com/pkg/errors"
+)
+
+func TestCDCommand(t *testing.T) {
+	errRun := errors.New("run")
+	for _, tc := range []struct {
+		name     string
+		shell    string
+		cd       CDCommandConfig
+		runErr   error
+		wantArgs []string
+		wantErr  error
+	}{
+		{
+			name:     "command",
+			shell:    "/bin/zsh",
+			cd:       CDCommandConfig{Command: "bash", Args: []string{"--login"}},
+			wantArgs: []string{"bash", "--login"},
+		},
+		{
+			name:     "shell",
+			shell:    "/bin/zsh",
+			wantArgs: []string{"/bin/zsh"},
+		},
+		{
+			name:     "default",
+			wantArgs: []string{"/bin/sh"},
+		},
+		{
+			name:     "exit_status",
+			runErr:   &exec.ExitError{},
+			wantArgs: []string{"/bin/sh"},
+		},
+		{
+			name:     "error",
+			runErr:   errRun,
+			wantArgs: []string{"/bin/sh"},
+			wantErr:  errRun,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			shell, ok := os.LookupEnv("SHELL")
+			if ok {
+				defer os.Setenv("SHELL", shell)
+			} else {
+				defer os.Unsetenv("SHELL")
+			}
+			os.Setenv("SHELL", tc.shell)
+
+			var gotCmd *exec.Cmd
+			c := &Config{
+				SourceDir: "/home/user/.chezmoi",
+				TargetDir: "/home/user",
+				CD:        tc.cd,
+				runCmd: func(cmd *exec.Cmd) error {
+					gotCmd = cmd
+					return tc.runErr
+				},
+			}
+			if err := c.runCDCommandE(nil, nil, nil); err != tc.wantErr {
+				t.Errorf("c.runCDCommandE(_, _, _) == %v, want %v", err, tc.wantErr)
+			}
+			if gotCmd == nil {
+				t.Fatalf("no command run")
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.wantArgs, gotCmd.Args); !equal {
+				t.Errorf("args diff:\n%s\n", diff)
+			}
+			if gotCmd.Dir != c.SourceDir {
+				t.Errorf("dir == %q, want %q", gotCmd.Dir, c.SourceDir)
+			}
+			env := make(map[string]bool)
+			for _, s := range gotCmd.Env {
+				env[s] = true
+			}
+			for _, s := range []string{
+				"CHEZMOI=1",
+				"CHEZMOI_SOURCE_DIR=/home/user/.chezmoi",
+				"CHEZMOI_TARGET_DIR=/home/user",
+			} {
+				if !env[s] {
+					t.Errorf("env does not contain %q", s)
+				}
+			}
+		})
+	}
+}
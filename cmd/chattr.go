@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"github.com/absfs/afero"
+	"github.com/spf13/cobra"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
+)
+
+var chattrCommand = &cobra.Command{
+	Use:   "chattr attributes targets...",
+	Args:  cobra.MinimumNArgs(2),
+	Short: "Change the attributes of a target",
+	RunE:  makeRunE(config.runChattrCommandE),
+}
+
+func init() {
+	rootCommand.AddCommand(chattrCommand)
+}
+
+func (c *Config) runChattrCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
+	am, err := chezmoi.ParseAttributeModifiers(args[0])
+	if err != nil {
+		return err
+	}
+	actuator := c.getDefaultActuator(fs)
+	targetStates := make(map[string]*chezmoi.RootState)
+	for _, arg := range args[1:] {
+		root, targetName, err := c.getTargetName(arg)
+		if err != nil {
+			return err
+		}
+		targetState, err := c.getCachedRootTargetState(fs, targetStates, root)
+		if err != nil {
+			return err
+		}
+		provider, err := c.getProvider(targetState, targetName, true)
+		if err != nil {
+			return err
+		}
+		if err := getProviderState(targetState, provider).Chattr(targetName, am, actuator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
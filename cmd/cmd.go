@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"bufio"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
@@ -19,21 +21,134 @@ import (
 
 // An AddCommandConfig is a configuration for the add command.
 type AddCommandConfig struct {
-	Empty     bool
-	Recursive bool
-	Template  bool
+	Empty             bool
+	Recursive         bool
+	Template          bool
+	TemplateFormat    string
+	TemplateMinLength int
+}
+
+// An ApplyCommandConfig is a configuration for the apply command.
+type ApplyCommandConfig struct {
+	Transactional bool
+	JournalDir    string
+}
+
+// An ArchiveCommandConfig is a configuration for the archive command.
+type ArchiveCommandConfig struct {
+	Format       string
+	Output       string
+	Include      []string
+	Exclude      []string
+	IncludePaths []string
+	ExcludePaths []string
+	NumericOwner bool
+	Reproducible bool
+}
+
+// A BackupConfig is a configuration for backups of overwritten targets.
+type BackupConfig struct {
+	Enabled bool
+	Dir     string
+	Keep    int
+}
+
+// A CDCommandConfig is a configuration for the cd command.
+type CDCommandConfig struct {
+	Command string
+	Args    []string
+}
+
+// A DumpCommandConfig is a configuration for the dump command.
+type DumpCommandConfig struct {
+	Format       string
+	OmitContents bool
+}
+
+// An EditCommandConfig is a configuration for the edit command.
+type EditCommandConfig struct {
+	Apply bool
+	Watch bool
+}
+
+// An ImportCommandConfig is a configuration for the import command.
+type ImportCommandConfig struct {
+	Format          string
+	StripComponents int
+	Destination     string
+	Exact           bool
+}
+
+// A MvCommandConfig is a configuration for the mv command.
+type MvCommandConfig struct {
+	SourceOnly bool
+}
+
+// A RestoreCommandConfig is a configuration for the restore command.
+type RestoreCommandConfig struct {
+	At   string
+	List bool
+}
+
+// A TemplateConfig is a configuration for templates.
+type TemplateConfig struct {
+	MissingKey string
 }
 
 // A Config represents a configuration.
 type Config struct {
 	SourceDir        string
+	Layers           []string
+	Layer            string
 	TargetDir        string
+	CacheDir         string
 	Umask            int
+	Parallelism      int
+	StateFile        string
+	VerifyContents   bool
+	KeepGoing        bool
 	DryRun           bool
+	Force            bool
 	Verbose          bool
 	SourceVCSCommand string
 	Data             map[string]interface{}
+	Template         TemplateConfig
+	Roots            map[string]RootConfig
+	SelectedRoots    []string
 	Add              AddCommandConfig
+	Apply            ApplyCommandConfig
+	Archive          ArchiveCommandConfig
+	Backup           BackupConfig
+	CD               CDCommandConfig
+	Dump             DumpCommandConfig
+	Edit             EditCommandConfig
+	Import           ImportCommandConfig
+	Mv               MvCommandConfig
+	Restore          RestoreCommandConfig
+	// fetchExternals is set by commands that need the contents of targets,
+	// so that other commands do not download, clone, or pull externals.
+	fetchExternals bool
+	// runCmd, if not nil, is called instead of running commands, for
+	// testing.
+	runCmd func(*exec.Cmd) error
+}
+
+// confirm prompts the user with prompt and returns true if they answer yes.
+func (c *Config) confirm(prompt string) (bool, error) {
+	r := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprintf(os.Stderr, "%s [y/n] ", prompt)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
 }
 
 func (c *Config) exec(argv []string) error {
@@ -50,6 +165,38 @@ func (c *Config) exec(argv []string) error {
 	return syscall.Exec(path, argv, os.Environ())
 }
 
+// run runs argv as a child process in dir, connected to chezmoi's standard
+// input, output, and error, with the CHEZMOI_* environment variables set.
+func (c *Config) run(dir string, argv []string) error {
+	if c.Verbose {
+		log.Printf("cd %s && %s", dir, strings.Join(argv, " "))
+	}
+	if c.DryRun {
+		return nil
+	}
+	cmd := c.command(dir, argv)
+	if c.runCmd != nil {
+		return c.runCmd(cmd)
+	}
+	return cmd.Run()
+}
+
+// command returns a command that runs argv as described in run.
+func (c *Config) command(dir string, argv []string) *exec.Cmd {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"CHEZMOI=1",
+		"CHEZMOI_CONFIG_FILE="+configFile,
+		"CHEZMOI_SOURCE_DIR="+c.SourceDir,
+		"CHEZMOI_TARGET_DIR="+c.TargetDir,
+	)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
 func (c *Config) getDefaultActuator(fs afero.Fs) chezmoi.Actuator {
 	var actuator chezmoi.Actuator
 	if c.DryRun {
@@ -96,31 +243,129 @@ func getDefaultData() (map[string]interface{}, error) {
 	return data, nil
 }
 
-func (c *Config) getSourceNames(targetState *chezmoi.RootState, targets []string) ([]string, error) {
-	sourceNames := []string{}
-	allStates := targetState.AllStates()
+// getTargetName returns the root that manages target and the name of target
+// relative to the root's target directory.
+func (c *Config) getTargetName(target string) (*targetRoot, string, error) {
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return nil, "", err
+	}
+	root, err := c.findTargetRoot(absTarget)
+	if err != nil {
+		return nil, "", err
+	}
+	targetName, err := filepath.Rel(root.targetDir, absTarget)
+	if err != nil {
+		return nil, "", err
+	}
+	return root, targetName, nil
+}
+
+// getCachedRootTargetState returns the target state of root from
+// targetStates, populating it first if it is not already there.
+func (c *Config) getCachedRootTargetState(fs afero.Fs, targetStates map[string]*chezmoi.RootState, root *targetRoot) (*chezmoi.RootState, error) {
+	if targetState, ok := targetStates[root.name]; ok {
+		return targetState, nil
+	}
+	targetState, err := c.getRootTargetState(fs, root)
+	if err != nil {
+		return nil, err
+	}
+	targetStates[root.name] = targetState
+	return targetState, nil
+}
+
+// getProvider returns the provider of targetName in targetState. If
+// targetState is layered then this is the layer selected with --layer if it
+// is set. Otherwise, if modify is true then it is the source directory, the
+// top layer, so that other layers are only modified when they are selected
+// explicitly, and if modify is false then it is the layer whose state is
+// used.
+func (c *Config) getProvider(targetState *chezmoi.RootState, targetName string, modify bool) (chezmoi.Provider, error) {
+	providers := targetState.Providers(targetName)
+	if len(providers) == 0 {
+		return chezmoi.Provider{}, errors.Errorf("%s: not found", targetName)
+	}
+	if len(targetState.Layers) == 0 || (c.Layer == "" && !modify) {
+		return providers[0], nil
+	}
+	layer, err := c.getLayerIndex()
+	if err != nil {
+		return chezmoi.Provider{}, err
+	}
+	for _, provider := range providers {
+		if provider.Layer == layer {
+			return provider, nil
+		}
+	}
+	if c.Layer == "" {
+		return chezmoi.Provider{}, errors.Errorf("%s: not found in %s, select its layer with --layer", targetName, c.SourceDir)
+	}
+	return chezmoi.Provider{}, errors.Errorf("%s: not found in layer %s", targetName, c.Layer)
+}
+
+// getProviderState returns the RootState of provider, which is a provider in
+// targetState.
+func getProviderState(targetState *chezmoi.RootState, provider chezmoi.Provider) *chezmoi.RootState {
+	if len(targetState.Layers) == 0 {
+		return targetState
+	}
+	return targetState.Layers[provider.Layer]
+}
+
+// getSourcePaths returns the absolute paths of the source files or
+// directories of targets, which may be in any root, see getProvider.
+func (c *Config) getSourcePaths(fs afero.Fs, targets []string, modify bool) ([]string, error) {
+	sourcePaths := []string{}
+	targetStates := make(map[string]*chezmoi.RootState)
 	for _, target := range targets {
-		absTarget, err := filepath.Abs(target)
+		root, targetName, err := c.getTargetName(target)
 		if err != nil {
 			return nil, err
 		}
-		targetName, err := filepath.Rel(c.TargetDir, absTarget)
+		targetState, err := c.getCachedRootTargetState(fs, targetStates, root)
 		if err != nil {
 			return nil, err
 		}
-		if filepath.HasPrefix(targetName, "..") {
-			return nil, errors.Errorf("%s: not in target directory", target)
+		provider, err := c.getProvider(targetState, targetName, modify)
+		if err != nil {
+			return nil, err
 		}
-		state, ok := allStates[targetName]
-		if !ok {
-			return nil, errors.Errorf("%s: not found", targetName)
+		if chezmoi.IsExternal(provider.State) {
+			return nil, errors.Errorf("%s: managed by %s", targetName, provider.State.SourceName())
 		}
-		sourceNames = append(sourceNames, state.SourceName())
+		sourcePaths = append(sourcePaths, filepath.Join(provider.SourceDir, provider.State.SourceName()))
 	}
-	return sourceNames, nil
+	return sourcePaths, nil
 }
 
 func (c *Config) getTargetState(fs afero.Fs) (*chezmoi.RootState, error) {
+	return c.getRootTargetState(fs, c.getDefaultTargetRoot())
+}
+
+// getRootTargetState returns the populated target state of root. If root has
+// layers then the target state of each layer is populated and the results are
+// merged.
+func (c *Config) getRootTargetState(fs afero.Fs, root *targetRoot) (*chezmoi.RootState, error) {
+	if len(root.layers) == 0 {
+		return c.populateTargetState(fs, root.targetDir, root.sourceDir)
+	}
+	sourceDirs, err := c.getLayerSourceDirs()
+	if err != nil {
+		return nil, err
+	}
+	var layers []*chezmoi.RootState
+	for _, sourceDir := range sourceDirs {
+		layer, err := c.populateTargetState(fs, root.targetDir, sourceDir)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return chezmoi.MergeLayers(layers), nil
+}
+
+func (c *Config) populateTargetState(fs afero.Fs, targetDir, sourceDir string) (*chezmoi.RootState, error) {
 	defaultData, err := getDefaultData()
 	if err != nil {
 		return nil, err
@@ -131,13 +376,48 @@ func (c *Config) getTargetState(fs afero.Fs) (*chezmoi.RootState, error) {
 	for key, value := range c.Data {
 		data[key] = value
 	}
-	targetState := chezmoi.NewRootState(c.TargetDir, os.FileMode(c.Umask), c.SourceDir, data)
+	targetState := chezmoi.NewRootState(targetDir, os.FileMode(c.Umask), sourceDir, data)
+	targetState.Parallelism = c.Parallelism
+	targetState.CacheDir = c.CacheDir
+	targetState.FetchExternals = c.fetchExternals
+	targetState.KeepGoing = c.KeepGoing
+	if c.Template.MissingKey != "" {
+		if !chezmoi.IsValidMissingKey(c.Template.MissingKey) {
+			return nil, errors.Errorf("%s: invalid template.missingKey", c.Template.MissingKey)
+		}
+		targetState.TemplateOptions = []string{"missingkey=" + c.Template.MissingKey}
+	}
 	if err := targetState.Populate(fs); err != nil {
 		return nil, err
 	}
+	for _, warning := range targetState.Warnings {
+		log.Printf("warning: %s", warning)
+	}
 	return targetState, nil
 }
 
+// getApplyOptions returns the options for applying the target state, using
+// the state store in c.StateFile.
+func (c *Config) getApplyOptions(fs afero.Fs) (chezmoi.ApplyOptions, error) {
+	state, err := chezmoi.LoadStateStore(fs, c.StateFile)
+	if err != nil {
+		return chezmoi.ApplyOptions{}, err
+	}
+	return chezmoi.ApplyOptions{
+		State:          state,
+		VerifyContents: c.VerifyContents,
+	}, nil
+}
+
+// appendErrors appends err, or its errors if it is a chezmoi.MultiError, to
+// errs.
+func appendErrors(errs chezmoi.MultiError, err error) chezmoi.MultiError {
+	if multiErr, ok := err.(chezmoi.MultiError); ok {
+		return append(errs, multiErr...)
+	}
+	return append(errs, err)
+}
+
 func makeRunE(runCommand func(afero.Fs, *cobra.Command, []string) error) func(*cobra.Command, []string) error {
 	return func(cmd *cobra.Command, args []string) error {
 		return runCommand(afero.NewOsFs(), cmd, args)
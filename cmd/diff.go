@@ -15,13 +15,38 @@ var diffCommand = &cobra.Command{
 
 func init() {
 	rootCommand.AddCommand(diffCommand)
+
+	persistentFlags := diffCommand.PersistentFlags()
+	persistentFlags.BoolVarP(&config.KeepGoing, "keep-going", "k", false, "keep going as far as possible after an error")
 }
 
 func (c *Config) runDiffCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
-	targetState, err := c.getTargetState(fs)
+	c.fetchExternals = true
+	roots, err := c.getTargetRoots()
+	if err != nil {
+		return err
+	}
+	applyOptions, err := c.getApplyOptions(fs)
 	if err != nil {
 		return err
 	}
+	applyOptions.ReadCurrentContents = true
 	actuator := chezmoi.NewLoggingActuator(chezmoi.NewNullActuator())
-	return targetState.Apply(fs, actuator)
+	var errs chezmoi.MultiError
+	for _, root := range roots {
+		targetState, err := c.getRootTargetState(fs, root)
+		if err != nil {
+			return err
+		}
+		if err := targetState.Apply(fs, applyOptions, actuator); err != nil {
+			if !c.KeepGoing {
+				return err
+			}
+			errs = appendErrors(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
 }
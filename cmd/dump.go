@@ -1,37 +1,63 @@
 package cmd
 
 import (
+	"encoding/json"
+	"os"
+
 	"github.com/absfs/afero"
-	"github.com/davecgh/go-spew/spew"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var dumpCommand = &cobra.Command{
-	Use:   "dump",
+	Use:   "dump [targets...]",
 	Short: "Dump the target state",
 	RunE:  makeRunE(config.runDumpCommandE),
 }
 
 func init() {
 	rootCommand.AddCommand(dumpCommand)
+
+	persistentFlags := dumpCommand.PersistentFlags()
+	persistentFlags.StringVar(&config.Dump.Format, "format", "json", "format (json or yaml)")
+	persistentFlags.BoolVar(&config.Dump.OmitContents, "omit-contents", false, "omit file contents")
 }
 
 func (c *Config) runDumpCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
+	c.fetchExternals = true
 	targetState, err := c.getTargetState(fs)
 	if err != nil {
 		return err
 	}
-	if len(args) == 0 {
-		spew.Dump(targetState)
-	} else {
-		for _, arg := range args {
-			state := targetState.Get(arg)
-			if state == nil {
-				return errors.Errorf("%s: not found", arg)
-			}
-			spew.Dump(state)
+	for _, arg := range args {
+		if targetState.Get(arg) == nil {
+			return errors.Errorf("%s: not found", arg)
 		}
 	}
-	return nil
+	entries, err := targetState.Dump(args, chezmoi.DumpOptions{
+		OmitContents: c.Dump.OmitContents,
+	})
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		entries = []*chezmoi.DumpEntry{}
+	}
+	var output []byte
+	switch c.Dump.Format {
+	case "json":
+		output, err = json.MarshalIndent(entries, "", "  ")
+		output = append(output, '\n')
+	case "yaml":
+		output, err = yaml.Marshal(entries)
+	default:
+		return errors.Errorf("%s: unknown format", c.Dump.Format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(output)
+	return err
 }
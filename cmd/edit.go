@@ -1,13 +1,21 @@
 package cmd
 
 import (
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/absfs/afero"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
 )
 
+// watchDelay is how long watch waits after the last write to a source file
+// before applying.
+const watchDelay = 100 * time.Millisecond
+
 var editCommand = &cobra.Command{
 	Use:   "edit",
 	Args:  cobra.MinimumNArgs(1),
@@ -17,14 +25,14 @@ var editCommand = &cobra.Command{
 
 func init() {
 	rootCommand.AddCommand(editCommand)
+
+	persistentFlags := editCommand.PersistentFlags()
+	persistentFlags.BoolVarP(&config.Edit.Apply, "apply", "a", false, "apply edited targets when the editor exits")
+	persistentFlags.BoolVarP(&config.Edit.Watch, "watch", "w", false, "apply edited targets whenever they are saved")
 }
 
 func (c *Config) runEditCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
-	targetState, err := c.getTargetState(fs)
-	if err != nil {
-		return err
-	}
-	sourceFileNames, err := c.getSourceNames(targetState, args)
+	sourcePaths, err := c.getSourcePaths(fs, args, true)
 	if err != nil {
 		return err
 	}
@@ -35,9 +43,138 @@ func (c *Config) runEditCommandE(fs afero.Fs, command *cobra.Command, args []str
 	if editor == "" {
 		editor = "vi"
 	}
-	argv := []string{editor}
-	for _, sourceFileName := range sourceFileNames {
-		argv = append(argv, filepath.Join(c.SourceDir, sourceFileName))
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	argv := append([]string{editor}, sourcePaths...)
+	if c.Edit.Watch && !c.DryRun {
+		// The editor is still running, so targets that should be removed
+		// are not removed while watching.
+		if err := c.watch(fs, wd, argv, sourcePaths, func() error {
+			return c.applyTargets(fs, args, false)
+		}); err != nil {
+			return err
+		}
+	} else if err := c.run(wd, argv); err != nil {
+		return err
+	}
+	if !c.Edit.Apply && !c.Edit.Watch {
+		return nil
+	}
+	return c.applyTargets(fs, args, true)
+}
+
+// applyTargets applies targets, each in the root that manages it, see
+// applyRoots.
+func (c *Config) applyTargets(fs afero.Fs, targets []string, prompt bool) error {
+	var roots []*targetRoot
+	targetNames := make(map[string][]string)
+	for _, target := range targets {
+		root, targetName, err := c.getTargetName(target)
+		if err != nil {
+			return err
+		}
+		if _, ok := targetNames[root.name]; !ok {
+			roots = append(roots, root)
+		}
+		targetNames[root.name] = append(targetNames[root.name], targetName)
+	}
+	return c.applyRoots(fs, roots, targetNames, prompt)
+}
+
+// watch runs argv in dir and calls apply shortly after one of sourcePaths is
+// written, until argv exits. Editors often save files by writing a new file
+// and renaming it, so the directories containing sourcePaths are watched
+// rather than sourcePaths themselves. Source directories are watched
+// recursively, including subdirectories created while watching. Editors often
+// write several times when saving, so applying waits until there have been no
+// writes for watchDelay.
+func (c *Config) watch(fs afero.Fs, dir string, argv, sourcePaths []string, apply func() error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	watchedDirs := make(map[string]bool)
+	// watchDir watches dir and, if recursive is true, all of its
+	// subdirectories.
+	watchDir := func(dir string, recursive bool) error {
+		return afero.Walk(fs, dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				return nil
+			}
+			if !watchedDirs[path] {
+				if err := watcher.Add(path); err != nil {
+					return err
+				}
+				watchedDirs[path] = true
+			}
+			if !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
+	for _, sourcePath := range sourcePaths {
+		if fi, err := fs.Stat(sourcePath); err == nil && fi.IsDir() {
+			err = watchDir(sourcePath, true)
+		} else {
+			err = watchDir(filepath.Dir(sourcePath), false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	isSourcePath := func(name string) bool {
+		for _, sourcePath := range sourcePaths {
+			if name == sourcePath || strings.HasPrefix(name, sourcePath+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if c.Verbose {
+		log.Printf("cd %s && %s", dir, strings.Join(argv, " "))
+	}
+	cmd := c.command(dir, argv)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	var applyTimer <-chan time.Time
+	for {
+		select {
+		case event := <-watcher.Events:
+			name := filepath.Clean(event.Name)
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 || !isSourcePath(name) {
+				continue
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if fi, err := fs.Stat(name); err == nil && fi.IsDir() {
+					if err := watchDir(name, true); err != nil {
+						log.Print(err)
+					}
+				}
+			}
+			applyTimer = time.After(watchDelay)
+		case <-applyTimer:
+			applyTimer = nil
+			// The editor is still running, so report errors without stopping.
+			if err := apply(); err != nil {
+				log.Print(err)
+			}
+		case err := <-watcher.Errors:
+			log.Print(err)
+		case err := <-exited:
+			return err
+		}
 	}
-	return c.exec(argv)
 }
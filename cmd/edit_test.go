@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/absfs/afero"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+// newEditTestConfig returns a Config with a default root in /home/user and an
+// additional root in /etc.
+func newEditTestConfig() *Config {
+	return &Config{
+		SourceDir: "/home/user/.chezmoi",
+		TargetDir: "/home/user",
+		Umask:     022,
+		StateFile: "/home/user/.chezmoi.state.json",
+		Roots: map[string]RootConfig{
+			"etc": {TargetDir: "/etc"},
+		},
+		Apply: ApplyCommandConfig{
+			JournalDir: "/home/user/.chezmoi.journal",
+		},
+	}
+}
+
+func TestEditApply(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/dot_bashrc":              "bashrc",
+		"/home/user/.chezmoi/dot_profile":             "profile",
+		"/home/user/.chezmoi/.chezmoiroots/etc/hosts": "hosts",
+		"/home/user/.chezmoi/.chezmoiroots/etc/motd":  "motd",
+		"/etc/motd": "old motd",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	visual, ok := os.LookupEnv("VISUAL")
+	if ok {
+		defer os.Setenv("VISUAL", visual)
+	} else {
+		defer os.Unsetenv("VISUAL")
+	}
+	os.Setenv("VISUAL", "true")
+
+	c := newEditTestConfig()
+	c.Edit.Apply = true
+	if err := c.runEditCommandE(fs, nil, []string{"/home/user/.bashrc", "/etc/hosts"}); err != nil {
+		t.Fatalf("c.runEditCommandE(_, _, _) == %v, want <nil>", err)
+	}
+	// Each edited target is applied in its own root, and nothing else is
+	// applied.
+	for name, want := range map[string]string{
+		"/home/user/.bashrc": "bashrc",
+		"/etc/hosts":         "hosts",
+		"/etc/motd":          "old motd",
+	} {
+		if got, err := afero.ReadFile(fs, name); err != nil || string(got) != want {
+			t.Errorf("afero.ReadFile(_, %q) == %q, %v, want %q, <nil>", name, got, err, want)
+		}
+	}
+	if _, err := fs.Stat("/home/user/.profile"); !os.IsNotExist(err) {
+		t.Errorf("fs.Stat(%q) == _, %v, want _, !<nil>", "/home/user/.profile", err)
+	}
+}
+
+func TestEditApplyRemove(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		force       bool
+		wantRemoved bool
+	}{
+		{name: "watching", wantRemoved: false},
+		{name: "watching_force", force: true, wantRemoved: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(map[string]string{
+				"/home/user/.chezmoi/.chezmoiremove":          ".config/old\n",
+				"/home/user/.chezmoi/dot_config/new":          "new",
+				"/home/user/.config/old":                      "old",
+				"/home/user/.chezmoi/.chezmoiroots/etc/.keep": "",
+			})
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+			}
+			c := newEditTestConfig()
+			c.Force = tc.force
+			// While watching, the editor owns the terminal, so there is no
+			// prompt.
+			if err := c.applyTargets(fs, []string{"/home/user/.config"}, false); err != nil {
+				t.Fatalf("c.applyTargets(_, _, false) == %v, want <nil>", err)
+			}
+			if got, err := afero.ReadFile(fs, "/home/user/.config/new"); err != nil || string(got) != "new" {
+				t.Errorf("afero.ReadFile(_, %q) == %q, %v, want %q, <nil>", "/home/user/.config/new", got, err, "new")
+			}
+			_, err = fs.Stat("/home/user/.config/old")
+			if gotRemoved := os.IsNotExist(err); gotRemoved != tc.wantRemoved {
+				t.Errorf("fs.Stat(%q) == _, %v, want removed %v", "/home/user/.config/old", err, tc.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestEditWatch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "chezmoi")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(_, _) == %v, %v, want !<nil>, <nil>", tempDir, err)
+	}
+	defer os.RemoveAll(tempDir)
+	sourcePath := filepath.Join(tempDir, "dot_config")
+	if err := os.MkdirAll(sourcePath, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// The editor saves a file with several writes, and then creates a file in
+	// a new subdirectory.
+	script := `
+echo 1 > dot_config/file
+echo 2 > dot_config/file
+echo 3 > dot_config/file
+sleep 0.5
+mkdir dot_config/subdir
+sleep 0.05
+echo 4 > dot_config/subdir/file
+sleep 0.5
+`
+	var applied []string
+	apply := func() error {
+		var contents []string
+		for _, name := range []string{"file", filepath.Join("subdir", "file")} {
+			data, _ := ioutil.ReadFile(filepath.Join(sourcePath, name))
+			contents = append(contents, string(data))
+		}
+		applied = append(applied, contents[0]+contents[1])
+		return nil
+	}
+	c := &Config{}
+	if err := c.watch(afero.NewOsFs(), tempDir, []string{"sh", "-c", script}, []string{sourcePath}, apply); err != nil {
+		t.Fatalf("c.watch(_, _, _, _, _) == %v, want <nil>", err)
+	}
+	// Writes are debounced, so there is one apply for the first file and one
+	// for the file in the new subdirectory, which is watched too.
+	want := []string{"3\n", "3\n4\n"}
+	if len(applied) != len(want) || applied[0] != want[0] || applied[1] != want[1] {
+		t.Errorf("applied %q, want %q", applied, want)
+	}
+}
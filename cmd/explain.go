@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
+)
+
+var explainCommand = &cobra.Command{
+	Use:   "explain",
+	Args:  cobra.MinimumNArgs(1),
+	Short: "Explain which source layer provides a target",
+	RunE:  makeRunE(config.runExplainCommandE),
+}
+
+func init() {
+	rootCommand.AddCommand(explainCommand)
+}
+
+func (c *Config) runExplainCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
+	targetStates := make(map[string]*chezmoi.RootState)
+	for _, arg := range args {
+		root, targetName, err := c.getTargetName(arg)
+		if err != nil {
+			return err
+		}
+		targetState, err := c.getCachedRootTargetState(fs, targetStates, root)
+		if err != nil {
+			return err
+		}
+		providers := targetState.Providers(targetName)
+		if len(providers) == 0 {
+			return errors.Errorf("%s: not found", targetName)
+		}
+		for i, provider := range providers {
+			verb := "overrides"
+			if i == 0 {
+				verb = "from"
+				if _, ok := provider.State.(*chezmoi.RemoveState); ok {
+					verb = "removed by"
+				}
+				fmt.Printf("%s\n", targetName)
+			}
+			fmt.Printf("  %s layer %d: %s\n", verb, provider.Layer, filepath.Join(provider.SourceDir, provider.State.SourceName()))
+		}
+	}
+	return nil
+}
@@ -1,8 +1,6 @@
 package cmd
 
 import (
-	"path/filepath"
-
 	"github.com/absfs/afero"
 	"github.com/spf13/cobra"
 )
@@ -19,17 +17,13 @@ func init() {
 }
 
 func (c *Config) runForgetCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
-	targetState, err := c.getTargetState(fs)
-	if err != nil {
-		return err
-	}
-	sourceNames, err := c.getSourceNames(targetState, args)
+	sourcePaths, err := c.getSourcePaths(fs, args, true)
 	if err != nil {
 		return err
 	}
 	actuator := c.getDefaultActuator(fs)
-	for _, sourceName := range sourceNames {
-		if err := actuator.RemoveAll(filepath.Join(c.SourceDir, sourceName)); err != nil {
+	for _, sourcePath := range sourcePaths {
+		if err := actuator.RemoveAll(sourcePath); err != nil {
 			return err
 		}
 	}
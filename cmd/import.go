@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/absfs/afero"
+	"github.com/spf13/cobra"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
+)
+
+var importCommand = &cobra.Command{
+	Use:   "import archive",
+	Args:  cobra.ExactArgs(1),
+	Short: "Import a tar or zip archive into the source directory",
+	RunE:  makeRunE(config.runImportCommandE),
+}
+
+func init() {
+	rootCommand.AddCommand(importCommand)
+
+	persistentFlags := importCommand.PersistentFlags()
+	persistentFlags.StringVar(&config.Import.Format, "format", "", "format (tar, tar.gz, or zip), default from the archive name")
+	persistentFlags.IntVar(&config.Import.StripComponents, "strip-components", 0, "strip leading path components")
+	persistentFlags.StringVarP(&config.Import.Destination, "destination", "d", "", "destination directory, default the target directory")
+	persistentFlags.BoolVarP(&config.Import.Exact, "exact", "x", false, "remove targets in imported directories that are not in the archive")
+}
+
+func (c *Config) runImportCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
+	destination := c.TargetDir
+	if c.Import.Destination != "" {
+		var err error
+		destination, err = filepath.Abs(c.Import.Destination)
+		if err != nil {
+			return err
+		}
+	}
+	root, err := c.findTargetRoot(destination)
+	if err != nil {
+		return err
+	}
+	root, err = c.getLayerRoot(root)
+	if err != nil {
+		return err
+	}
+	targetState, err := c.getRootTargetState(fs, root)
+	if err != nil {
+		return err
+	}
+	importOptions := chezmoi.ImportOptions{
+		Format:          c.Import.Format,
+		StripComponents: c.Import.StripComponents,
+		Destination:     destination,
+		Exact:           c.Import.Exact,
+	}
+	if importOptions.Format == "" {
+		importOptions.Format = chezmoi.ArchiveFormatFromName(args[0])
+	}
+	f, err := fs.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return targetState.Import(fs, f, importOptions, c.getDefaultActuator(fs))
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strconv"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+// getLayerSourceDirs returns the source directories of the default root's
+// layers in increasing order of precedence. The source directory is always
+// the last layer.
+func (c *Config) getLayerSourceDirs() ([]string, error) {
+	var sourceDirs []string
+	for _, layer := range c.Layers {
+		sourceDir, err := homedir.Expand(layer)
+		if err != nil {
+			return nil, err
+		}
+		sourceDir, err = filepath.Abs(sourceDir)
+		if err != nil {
+			return nil, err
+		}
+		sourceDirs = append(sourceDirs, sourceDir)
+	}
+	return append(sourceDirs, c.SourceDir), nil
+}
+
+// getLayerIndex returns the index of the layer selected with --layer, which
+// is either an index or a source directory. If no layer is selected then the
+// source directory is used.
+func (c *Config) getLayerIndex() (int, error) {
+	sourceDirs, err := c.getLayerSourceDirs()
+	if err != nil {
+		return 0, err
+	}
+	if c.Layer == "" {
+		return len(sourceDirs) - 1, nil
+	}
+	if i, err := strconv.Atoi(c.Layer); err == nil {
+		if i < 0 || i >= len(sourceDirs) {
+			return 0, errors.Errorf("%s: layer index out of range", c.Layer)
+		}
+		return i, nil
+	}
+	sourceDir, err := homedir.Expand(c.Layer)
+	if err != nil {
+		return 0, err
+	}
+	sourceDir, err = filepath.Abs(sourceDir)
+	if err != nil {
+		return 0, err
+	}
+	for i, layerSourceDir := range sourceDirs {
+		if filepath.Clean(layerSourceDir) == sourceDir {
+			return i, nil
+		}
+	}
+	return 0, errors.Errorf("%s: unknown layer", c.Layer)
+}
+
+// getLayerRoot returns a root for the layer of root selected with --layer, so
+// that changes are made to that layer only. If root has no layers then it is
+// returned unchanged.
+func (c *Config) getLayerRoot(root *targetRoot) (*targetRoot, error) {
+	if len(root.layers) == 0 {
+		return root, nil
+	}
+	sourceDirs, err := c.getLayerSourceDirs()
+	if err != nil {
+		return nil, err
+	}
+	i, err := c.getLayerIndex()
+	if err != nil {
+		return nil, err
+	}
+	return &targetRoot{
+		name:      root.name,
+		sourceDir: sourceDirs[i],
+		targetDir: root.targetDir,
+		helper:    root.helper,
+	}, nil
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestGetProvider(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/dot_bashrc": "# personal\n",
+		"/home/user/team/dot_bashrc":     "# team\n",
+		"/home/user/team/dot_profile":    "# team\n",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	for _, tc := range []struct {
+		name       string
+		layer      string
+		targetName string
+		modify     bool
+		wantLayer  int
+		wantErr    bool
+	}{
+		{name: "read_top", targetName: ".bashrc", wantLayer: 1},
+		{name: "read_lower", targetName: ".profile", wantLayer: 0},
+		{name: "modify_top", targetName: ".bashrc", modify: true, wantLayer: 1},
+		{name: "modify_lower", targetName: ".profile", modify: true, wantErr: true},
+		{name: "modify_selected", layer: "0", targetName: ".profile", modify: true, wantLayer: 0},
+		{name: "modify_selected_missing", layer: "1", targetName: ".profile", modify: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Config{
+				SourceDir: "/home/user/.chezmoi",
+				Layers:    []string{"/home/user/team"},
+				Layer:     tc.layer,
+				TargetDir: "/home/user",
+				Umask:     022,
+			}
+			targetState, err := c.getTargetState(fs)
+			if err != nil {
+				t.Fatalf("c.getTargetState(_) == _, %v, want _, <nil>", err)
+			}
+			provider, err := c.getProvider(targetState, tc.targetName, tc.modify)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("c.getProvider(_, %q, %v) == %+v, <nil>, want _, !<nil>", tc.targetName, tc.modify, provider)
+				}
+				return
+			}
+			if err != nil || provider.Layer != tc.wantLayer {
+				t.Errorf("c.getProvider(_, %q, %v) == %+v, %v, want layer %d, <nil>", tc.targetName, tc.modify, provider, err, tc.wantLayer)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
+)
+
+var mvCommand = &cobra.Command{
+	Use:   "mv old-target new-target",
+	Args:  cobra.ExactArgs(2),
+	Short: "Move a target and its source",
+	RunE:  makeRunE(config.runMvCommandE),
+}
+
+func init() {
+	rootCommand.AddCommand(mvCommand)
+
+	persistentFlags := mvCommand.PersistentFlags()
+	persistentFlags.BoolVar(&config.Mv.SourceOnly, "source-only", false, "only move the source, not the target")
+}
+
+func (c *Config) runMvCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
+	root, oldTargetName, err := c.getTargetName(args[0])
+	if err != nil {
+		return err
+	}
+	newRoot, newTargetName, err := c.getTargetName(args[1])
+	if err != nil {
+		return err
+	}
+	if newRoot.name != root.name {
+		return errors.Errorf("%s: not in the same root as %s", args[1], args[0])
+	}
+	oldTargetPath := filepath.Join(root.targetDir, oldTargetName)
+	newTargetPath := filepath.Join(root.targetDir, newTargetName)
+
+	targetState, err := c.getRootTargetState(fs, root)
+	if err != nil {
+		return err
+	}
+	provider, err := c.getProvider(targetState, oldTargetName, true)
+	if err != nil {
+		return err
+	}
+
+	// Check that the target can be moved before changing anything.
+	moveTarget := false
+	if !c.Mv.SourceOnly {
+		if _, err := fs.Stat(newTargetPath); err == nil {
+			return errors.Errorf("%s: already exists", newTargetPath)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if _, err := fs.Stat(oldTargetPath); err == nil {
+			moveTarget = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	actuator := c.getDefaultActuator(fs)
+	if err := getProviderState(targetState, provider).Move(fs, oldTargetName, newTargetName, actuator); err != nil {
+		return err
+	}
+	if moveTarget {
+		if err := c.mkdirAll(fs, filepath.Dir(newTargetPath), actuator); err != nil {
+			return err
+		}
+		if err := actuator.Rename(oldTargetPath, newTargetPath); err != nil {
+			return err
+		}
+	}
+
+	state, err := chezmoi.LoadStateStore(fs, c.StateFile)
+	if err != nil {
+		return err
+	}
+	newStatePath := ""
+	if moveTarget {
+		newStatePath = newTargetPath
+	}
+	if !state.Rename(oldTargetPath, newStatePath) {
+		return nil
+	}
+	return state.SaveWithActuator(fs, c.StateFile, actuator)
+}
+
+// mkdirAll makes dir, and any of its parents that do not exist, with actuator.
+func (c *Config) mkdirAll(fs afero.Fs, dir string, actuator chezmoi.Actuator) error {
+	if _, err := fs.Stat(dir); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := c.mkdirAll(fs, filepath.Dir(dir), actuator); err != nil {
+		return err
+	}
+	return actuator.Mkdir(dir, 0777&^os.FileMode(c.Umask))
+}
@@ -21,20 +21,20 @@ func init() {
 }
 
 func runRemoveCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
-	targetState, err := config.getTargetState(fs)
-	if err != nil {
-		return err
-	}
-	sourceNames, err := config.getSourceNames(targetState, args)
+	sourcePaths, err := config.getSourcePaths(fs, args, true)
 	if err != nil {
 		return err
 	}
 	actuator := config.getDefaultActuator(fs)
-	for i, targetFileName := range args {
-		if err := actuator.RemoveAll(filepath.Join(config.TargetDir, targetFileName)); err != nil && !os.IsNotExist(err) {
+	for i, arg := range args {
+		root, targetName, err := config.getTargetName(arg)
+		if err != nil {
+			return err
+		}
+		if err := actuator.RemoveAll(filepath.Join(root.targetDir, targetName)); err != nil && !os.IsNotExist(err) {
 			return err
 		}
-		if err := actuator.RemoveAll(filepath.Join(config.SourceDir, sourceNames[i])); err != nil && !os.IsNotExist(err) {
+		if err := actuator.RemoveAll(sourcePaths[i]); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
+)
+
+var restoreCommand = &cobra.Command{
+	Use:   "restore [targets...]",
+	Short: "Restore targets from a backup",
+	RunE:  makeRunE(config.runRestoreCommandE),
+}
+
+func init() {
+	rootCommand.AddCommand(restoreCommand)
+
+	persistentFlags := restoreCommand.PersistentFlags()
+	persistentFlags.StringVar(&config.Restore.At, "at", "", "restore the most recent backup at or before timestamp")
+	persistentFlags.BoolVarP(&config.Restore.List, "list", "l", false, "list backups")
+}
+
+func (c *Config) runRestoreCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
+	if c.Restore.List {
+		names, err := chezmoi.Backups(fs, c.Backup.Dir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	at := time.Now()
+	if c.Restore.At != "" {
+		var err error
+		at, err = parseBackupTime(c.Restore.At)
+		if err != nil {
+			return err
+		}
+	}
+	name, err := chezmoi.FindBackup(fs, c.Backup.Dir, at)
+	if err != nil {
+		return err
+	}
+	backupDir := filepath.Join(c.Backup.Dir, name)
+	if len(args) == 0 {
+		roots, err := c.getTargetRoots()
+		if err != nil {
+			return err
+		}
+		for _, root := range roots {
+			if err := chezmoi.RestoreBackup(fs, backupDir, root.targetDir, c.getRootActuator(fs, root)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, arg := range args {
+		target, err := filepath.Abs(arg)
+		if err != nil {
+			return err
+		}
+		root, err := c.findTargetRoot(target)
+		if err != nil {
+			return err
+		}
+		if err := chezmoi.RestoreBackup(fs, backupDir, target, c.getRootActuator(fs, root)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBackupTime parses s as either the name of a backup or an RFC 3339
+// timestamp.
+func parseBackupTime(s string) (time.Time, error) {
+	if t, err := chezmoi.ParseBackupName(s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.Errorf("%s: invalid timestamp", s)
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"syscall"
 
 	"github.com/absfs/afero"
@@ -34,15 +35,38 @@ func init() {
 
 	persistentFlags.StringVarP(&configFile, "config", "c", filepath.Join(homeDir, ".chezmoi.yaml"), "config file")
 
+	persistentFlags.StringVar(&config.Backup.Dir, "backup-dir", filepath.Join(homeDir, ".chezmoi.backups"), "backup directory")
+	viper.BindPFlag("backup.dir", persistentFlags.Lookup("backup-dir"))
+
+	persistentFlags.IntVar(&config.Backup.Keep, "backup-keep", 10, "number of backups to keep, 0 for all")
+	viper.BindPFlag("backup.keep", persistentFlags.Lookup("backup-keep"))
+
+	persistentFlags.StringVar(&config.CacheDir, "cache-dir", filepath.Join(homeDir, ".chezmoi.cache"), "cache directory")
+	viper.BindPFlag("cache-dir", persistentFlags.Lookup("cache-dir"))
+
 	persistentFlags.BoolVarP(&config.DryRun, "dry-run", "n", false, "dry run")
 	viper.BindPFlag("dry-run", persistentFlags.Lookup("dry-run"))
 
+	persistentFlags.BoolVarP(&config.Force, "force", "f", false, "make all changes without prompting")
+	viper.BindPFlag("force", persistentFlags.Lookup("force"))
+
+	persistentFlags.StringVar(&config.Layer, "layer", "", "source directory layer to modify, as a path or an index")
+	viper.BindPFlag("layer", persistentFlags.Lookup("layer"))
+
+	persistentFlags.IntVar(&config.Parallelism, "parallelism", runtime.NumCPU(), "maximum number of files to read concurrently")
+	viper.BindPFlag("parallelism", persistentFlags.Lookup("parallelism"))
+
+	persistentFlags.StringSliceVar(&config.SelectedRoots, "root", nil, "only operate on roots")
+
 	persistentFlags.StringVarP(&config.SourceDir, "source", "s", filepath.Join(homeDir, ".chezmoi"), "source directory")
 	viper.BindPFlag("source", persistentFlags.Lookup("source"))
 
 	persistentFlags.StringVar(&config.SourceVCSCommand, "source-vcs", "git", "source version control system command")
 	viper.BindPFlag("source-vcs", persistentFlags.Lookup("source-vcs"))
 
+	persistentFlags.StringVar(&config.StateFile, "state-file", filepath.Join(homeDir, ".chezmoi.state.json"), "state file")
+	viper.BindPFlag("state-file", persistentFlags.Lookup("state-file"))
+
 	persistentFlags.StringVarP(&config.TargetDir, "target", "t", homeDir, "target directory")
 	viper.BindPFlag("target", persistentFlags.Lookup("target"))
 
@@ -50,6 +74,9 @@ func init() {
 	persistentFlags.IntVarP(&config.Umask, "umask", "u", getUmask(), "umask")
 	viper.BindPFlag("umask", persistentFlags.Lookup("umask"))
 
+	persistentFlags.BoolVar(&config.VerifyContents, "verify-contents", false, "compare the contents of all targets")
+	viper.BindPFlag("verify-contents", persistentFlags.Lookup("verify-contents"))
+
 	persistentFlags.BoolVarP(&config.Verbose, "verbose", "v", false, "verbose")
 	viper.BindPFlag("verbose", persistentFlags.Lookup("verbose"))
 
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
+)
+
+// defaultRootName is the name of the root formed by the top-level source and
+// target directories.
+const defaultRootName = "default"
+
+// rootsSourceDirName is the subdirectory of the source directory that
+// contains the source directories of additional roots by default. It begins
+// with a "." so that it is ignored by the default root.
+const rootsSourceDirName = ".chezmoiroots"
+
+// wOK is the mode for syscall.Access that checks for write permission.
+const wOK = 2
+
+// A RootConfig is a configuration for an additional target root.
+type RootConfig struct {
+	TargetDir string
+	SourceDir string
+	Helper    []string
+}
+
+// A targetRoot is a source directory and the target directory that it
+// manages. The default root may also have layers, additional source
+// directories with lower precedence than sourceDir.
+type targetRoot struct {
+	name      string
+	sourceDir string
+	targetDir string
+	helper    []string
+	layers    []string
+}
+
+// getDefaultTargetRoot returns the default root.
+func (c *Config) getDefaultTargetRoot() *targetRoot {
+	return &targetRoot{
+		name:      defaultRootName,
+		sourceDir: c.SourceDir,
+		targetDir: c.TargetDir,
+		layers:    c.Layers,
+	}
+}
+
+// getTargetRoots returns the selected target roots, with the default root
+// first and the remaining roots sorted by name.
+func (c *Config) getTargetRoots() ([]*targetRoot, error) {
+	selected := make(map[string]bool)
+	for _, name := range c.SelectedRoots {
+		if _, ok := c.Roots[name]; !ok && name != defaultRootName {
+			return nil, errors.Errorf("%s: unknown root", name)
+		}
+		selected[name] = true
+	}
+	var roots []*targetRoot
+	if len(selected) == 0 || selected[defaultRootName] {
+		roots = append(roots, c.getDefaultTargetRoot())
+	}
+	var names []string
+	for name := range c.Roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(selected) != 0 && !selected[name] {
+			continue
+		}
+		root, err := c.getTargetRoot(name)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// getTargetRoot returns the additional target root called name.
+func (c *Config) getTargetRoot(name string) (*targetRoot, error) {
+	if name == defaultRootName {
+		return nil, errors.Errorf("%s: reserved root name", name)
+	}
+	rootConfig := c.Roots[name]
+	if rootConfig.TargetDir == "" {
+		return nil, errors.Errorf("%s: root has no targetDir", name)
+	}
+	targetDir, err := filepath.Abs(rootConfig.TargetDir)
+	if err != nil {
+		return nil, err
+	}
+	sourceDir := rootConfig.SourceDir
+	if sourceDir == "" {
+		sourceDir = filepath.Join(rootsSourceDirName, name)
+	}
+	if !filepath.IsAbs(sourceDir) {
+		sourceDir = filepath.Join(c.SourceDir, sourceDir)
+	}
+	// A root's source directory inside the default root's source directory
+	// must be hidden, otherwise the default root would manage it too.
+	if relPath, err := filepath.Rel(c.SourceDir, sourceDir); err == nil && !strings.HasPrefix(relPath, "..") {
+		if relPath == "." || !strings.HasPrefix(relPath, ".") {
+			return nil, errors.Errorf("%s: root sourceDir %s is not hidden in %s", name, sourceDir, c.SourceDir)
+		}
+	}
+	return &targetRoot{
+		name:      name,
+		sourceDir: sourceDir,
+		targetDir: targetDir,
+		helper:    rootConfig.Helper,
+	}, nil
+}
+
+// findTargetRoot returns the selected target root with the longest target
+// directory that contains targetPath.
+func (c *Config) findTargetRoot(targetPath string) (*targetRoot, error) {
+	roots, err := c.getTargetRoots()
+	if err != nil {
+		return nil, err
+	}
+	var found *targetRoot
+	for _, root := range roots {
+		relPath, err := filepath.Rel(root.targetDir, targetPath)
+		if err != nil || strings.HasPrefix(relPath, "..") {
+			continue
+		}
+		if found == nil || len(root.targetDir) > len(found.targetDir) {
+			found = root
+		}
+	}
+	if found == nil {
+		return nil, errors.Errorf("%s: not in any target directory", targetPath)
+	}
+	return found, nil
+}
+
+// getRootActuator returns the actuator for changes to root. If root has a
+// helper and its target directory is not writable then changes are made
+// through the helper.
+func (c *Config) getRootActuator(fs afero.Fs, root *targetRoot) chezmoi.Actuator {
+	var actuator chezmoi.Actuator
+	switch {
+	case c.DryRun:
+		actuator = chezmoi.NewNullActuator()
+	case len(root.helper) != 0 && syscall.Access(root.targetDir, wOK) != nil:
+		actuator = chezmoi.NewHelperActuator(root.helper)
+	default:
+		actuator = chezmoi.NewFsActuator(fs, root.targetDir)
+	}
+	if c.Verbose {
+		actuator = chezmoi.NewLoggingActuator(actuator)
+	}
+	return actuator
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestMultiRootPaths(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/dot_bashrc":              "# bashrc\n",
+		"/home/user/.chezmoi/.chezmoiroots/etc/hosts": "127.0.0.1 localhost\n",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	c := &Config{
+		SourceDir: "/home/user/.chezmoi",
+		TargetDir: "/home/user",
+		Umask:     022,
+		Roots: map[string]RootConfig{
+			"etc": {TargetDir: "/etc"},
+		},
+	}
+	for _, tc := range []struct {
+		target         string
+		wantRootName   string
+		wantTargetName string
+		wantSourcePath string
+	}{
+		{
+			target:         "/home/user/.bashrc",
+			wantRootName:   defaultRootName,
+			wantTargetName: ".bashrc",
+			wantSourcePath: "/home/user/.chezmoi/dot_bashrc",
+		},
+		{
+			target:         "/etc/hosts",
+			wantRootName:   "etc",
+			wantTargetName: "hosts",
+			wantSourcePath: "/home/user/.chezmoi/.chezmoiroots/etc/hosts",
+		},
+	} {
+		t.Run(tc.target, func(t *testing.T) {
+			root, targetName, err := c.getTargetName(tc.target)
+			if err != nil || root.name != tc.wantRootName || targetName != tc.wantTargetName {
+				t.Errorf("c.getTargetName(%q) == %+v, %q, %v, want root %s, %q, <nil>", tc.target, root, targetName, err, tc.wantRootName, tc.wantTargetName)
+			}
+			sourcePaths, err := c.getSourcePaths(fs, []string{tc.target}, false)
+			if err != nil {
+				t.Fatalf("c.getSourcePaths(_, %q, false) == %v, %v, want _, <nil>", tc.target, sourcePaths, err)
+			}
+			if diff, equal := messagediff.PrettyDiff([]string{tc.wantSourcePath}, sourcePaths); !equal {
+				t.Errorf("c.getSourcePaths(_, %q, false) diff:\n%s\n", tc.target, diff)
+			}
+			if targetPath, err := c.getTargetPath(fs, tc.wantSourcePath); err != nil || targetPath != tc.target {
+				t.Errorf("c.getTargetPath(_, %q) == %q, %v, want %q, <nil>", tc.wantSourcePath, targetPath, err, tc.target)
+			}
+		})
+	}
+	if _, _, err := c.getTargetName("/usr/bin/chezmoi"); err == nil {
+		t.Errorf("c.getTargetName(%q) == _, _, <nil>, want _, _, !<nil>", "/usr/bin/chezmoi")
+	}
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/absfs/afero"
+	"github.com/spf13/cobra"
+)
+
+var sourcePathCommand = &cobra.Command{
+	Use:   "source-path [targets...]",
+	Short: "Print the path of a target's source, or of the source directory",
+	RunE:  makeRunE(config.runSourcePathCommandE),
+}
+
+func init() {
+	rootCommand.AddCommand(sourcePathCommand)
+}
+
+func (c *Config) runSourcePathCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		fmt.Println(c.SourceDir)
+		return nil
+	}
+	sourcePaths, err := c.getSourcePaths(fs, args, false)
+	if err != nil {
+		return err
+	}
+	for _, sourcePath := range sourcePaths {
+		fmt.Println(sourcePath)
+	}
+	return nil
+}
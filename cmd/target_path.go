@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/twpayne/chezmoi/lib/chezmoi"
+)
+
+var targetPathCommand = &cobra.Command{
+	Use:   "target-path [source paths...]",
+	Args:  cobra.MinimumNArgs(1),
+	Short: "Print the target path of a source file or directory",
+	RunE:  makeRunE(config.runTargetPathCommandE),
+}
+
+func init() {
+	rootCommand.AddCommand(targetPathCommand)
+}
+
+func (c *Config) runTargetPathCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
+	for _, arg := range args {
+		targetPath, err := c.getTargetPath(fs, arg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(targetPath)
+	}
+	return nil
+}
+
+// getTargetPath returns the target path of sourcePath, which must be in the
+// source directory, or a layer, of one of the selected roots. If source
+// directories are nested then the innermost is used. sourcePath does not need
+// to exist, in which case it is assumed to be a file.
+func (c *Config) getTargetPath(fs afero.Fs, sourcePath string) (string, error) {
+	absSourcePath, err := filepath.Abs(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	roots, err := c.getTargetRoots()
+	if err != nil {
+		return "", err
+	}
+	sourceName := ""
+	targetDir := ""
+	for _, root := range roots {
+		sourceDirs := []string{root.sourceDir}
+		if len(root.layers) != 0 {
+			sourceDirs, err = c.getLayerSourceDirs()
+			if err != nil {
+				return "", err
+			}
+		}
+		for _, sourceDir := range sourceDirs {
+			relPath, err := filepath.Rel(sourceDir, absSourcePath)
+			if err != nil || strings.HasPrefix(relPath, "..") {
+				continue
+			}
+			if sourceName == "" || len(relPath) < len(sourceName) {
+				sourceName = relPath
+				targetDir = root.targetDir
+			}
+		}
+	}
+	if sourceName == "" {
+		return "", errors.Errorf("%s: not in source directory", sourcePath)
+	}
+	if sourceName == "." {
+		return targetDir, nil
+	}
+	// Files and directories beginning with a "." are ignored by Populate.
+	for _, component := range strings.Split(sourceName, string(os.PathSeparator)) {
+		if strings.HasPrefix(component, ".") {
+			return "", errors.Errorf("%s: not a source file or directory", sourcePath)
+		}
+	}
+	isDir := false
+	if fi, err := fs.Stat(absSourcePath); err == nil {
+		isDir = fi.IsDir()
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	return filepath.Join(targetDir, chezmoi.TargetName(sourceName, isDir)), nil
+}
@@ -17,17 +17,38 @@ var verifyCommand = &cobra.Command{
 
 func init() {
 	rootCommand.AddCommand(verifyCommand)
+
+	persistentFlags := verifyCommand.PersistentFlags()
+	persistentFlags.BoolVarP(&config.KeepGoing, "keep-going", "k", false, "keep going as far as possible after an error")
 }
 
 func (c *Config) runVerifyCommandE(fs afero.Fs, command *cobra.Command, args []string) error {
-	targetState, err := c.getTargetState(fs)
+	c.fetchExternals = true
+	roots, err := c.getTargetRoots()
 	if err != nil {
 		return err
 	}
-	anyActuator := chezmoi.NewAnyActuator(chezmoi.NewNullActuator())
-	if err := targetState.Apply(fs, anyActuator); err != nil {
+	applyOptions, err := c.getApplyOptions(fs)
+	if err != nil {
 		return err
 	}
+	anyActuator := chezmoi.NewAnyActuator(chezmoi.NewNullActuator())
+	var errs chezmoi.MultiError
+	for _, root := range roots {
+		targetState, err := c.getRootTargetState(fs, root)
+		if err != nil {
+			return err
+		}
+		if err := targetState.Apply(fs, applyOptions, anyActuator); err != nil {
+			if !c.KeepGoing {
+				return err
+			}
+			errs = appendErrors(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
 	if anyActuator.Actuated() {
 		os.Exit(1)
 	}
@@ -1,11 +1,12 @@
 module github.com/twpayne/chezmoi
 
 require (
-	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/BurntSushi/toml v0.3.1
 	github.com/absfs/afero v1.1.2-0.20181111024946-2ab2519ed197
 	github.com/d4l3k/messagediff v1.2.1
-	github.com/davecgh/go-spew v1.1.1
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fatih/structtag v1.0.0 // indirect
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/google/renameio v0.0.0-20181108174601-76365acd908f
 	github.com/mitchellh/go-homedir v1.0.0
 	github.com/pkg/errors v0.8.0
@@ -14,4 +15,5 @@ require (
 	github.com/spf13/cobra v0.0.3
 	github.com/spf13/viper v1.2.1
 	github.com/stretchr/testify v1.2.2 // indirect
+	gopkg.in/yaml.v2 v2.2.1
 )
@@ -7,5 +7,11 @@ type Actuator interface {
 	Chmod(string, os.FileMode) error
 	Mkdir(string, os.FileMode) error
 	RemoveAll(string) error
+	Rename(string, string) error
 	WriteFile(string, []byte, os.FileMode, []byte) error
 }
+
+// A Symlinker is an Actuator that can also create symbolic links.
+type Symlinker interface {
+	Symlink(string, string) error
+}
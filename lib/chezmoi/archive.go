@@ -0,0 +1,324 @@
+package chezmoi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+)
+
+// Archive formats.
+const (
+	ArchiveFormatTar   = "tar"
+	ArchiveFormatTarGz = "tar.gz"
+	ArchiveFormatZip   = "zip"
+)
+
+// zipEpoch is the earliest time that ArchiveFormatZip can represent.
+var zipEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Archive entry types.
+const (
+	ArchiveTypeDir  = "dir"
+	ArchiveTypeFile = "file"
+)
+
+// ArchiveOptions are options to RootState.Archive.
+type ArchiveOptions struct {
+	// Format is one of ArchiveFormatTar, ArchiveFormatTarGz, or
+	// ArchiveFormatZip. If it is empty then ArchiveFormatTar is used.
+	Format string
+	// ModTime is the modification time of every entry. If it is zero then
+	// the Unix epoch is used. ArchiveFormatZip cannot represent times before
+	// 1980, so zipEpoch is used instead of earlier times.
+	ModTime time.Time
+	// UID, GID, Uname, and Gname are the owner of every entry. They are
+	// ignored by ArchiveFormatZip.
+	UID   int
+	GID   int
+	Uname string
+	Gname string
+	// IncludeTypes, if not empty, are the only entry types that are included.
+	IncludeTypes []string
+	// ExcludeTypes are entry types that are excluded.
+	ExcludeTypes []string
+	// IncludePaths, if not empty, are patterns of the only targets, and their
+	// descendants, that are included.
+	IncludePaths []string
+	// ExcludePaths are patterns of targets, and their descendants, that are
+	// excluded.
+	ExcludePaths []string
+}
+
+// An archiveWriter writes entries to an archive.
+type archiveWriter interface {
+	WriteDir(name string, mode os.FileMode) error
+	WriteFile(name string, mode os.FileMode, contents []byte) error
+	Close() error
+}
+
+// An archiver writes the target state to an archiveWriter.
+type archiver struct {
+	fs        afero.Fs
+	targetDir string
+	umask     os.FileMode
+	options   ArchiveOptions
+	w         archiveWriter
+}
+
+type tarArchiveWriter struct {
+	w              *tar.Writer
+	gzipWriter     *gzip.Writer
+	headerTemplate tar.Header
+}
+
+type zipArchiveWriter struct {
+	w       *zip.Writer
+	modTime time.Time
+}
+
+// Archive writes rs to w in the format given by archiveOptions. Modify scripts
+// are evaluated against the current targets in fs. Files that would be
+// removed by Apply have no target and so are not included.
+func (rs *RootState) Archive(fs afero.Fs, w io.Writer, umask os.FileMode, archiveOptions ArchiveOptions) error {
+	if err := archiveOptions.validate(); err != nil {
+		return err
+	}
+	if archiveOptions.ModTime.IsZero() {
+		archiveOptions.ModTime = time.Unix(0, 0)
+	}
+	a := &archiver{
+		fs:        fs,
+		targetDir: rs.TargetDir,
+		umask:     umask,
+		options:   archiveOptions,
+	}
+	switch archiveOptions.Format {
+	case "", ArchiveFormatTar:
+		a.w = newTarArchiveWriter(w, nil, archiveOptions)
+	case ArchiveFormatTarGz:
+		a.w = newTarArchiveWriter(w, gzip.NewWriter(w), archiveOptions)
+	case ArchiveFormatZip:
+		// Zip times include a time zone, so use UTC for reproducibility.
+		modTime := archiveOptions.ModTime.UTC()
+		if modTime.Before(zipEpoch) {
+			modTime = zipEpoch
+		}
+		a.w = &zipArchiveWriter{
+			w:       zip.NewWriter(w),
+			modTime: modTime,
+		}
+	}
+	for _, fileName := range sortedFileNames(rs.Files) {
+		if err := rs.Files[fileName].archive(a, fileName); err != nil {
+			return err
+		}
+	}
+	for _, dirName := range sortedDirNames(rs.Dirs) {
+		if err := rs.Dirs[dirName].archive(a, dirName); err != nil {
+			return err
+		}
+	}
+	return a.w.Close()
+}
+
+// archive writes ds to a.
+func (ds *DirState) archive(a *archiver, dirName string) error {
+	if a.options.include(dirName, ArchiveTypeDir) {
+		if err := a.w.WriteDir(dirName, ds.targetMode(a.umask)); err != nil {
+			return err
+		}
+	}
+	for _, fileName := range sortedFileNames(ds.Files) {
+		if err := ds.Files[fileName].archive(a, filepath.Join(dirName, fileName)); err != nil {
+			return err
+		}
+	}
+	for _, subDirName := range sortedDirNames(ds.Dirs) {
+		if err := ds.Dirs[subDirName].archive(a, filepath.Join(dirName, subDirName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archive writes fs to a. If fs is a modify script then it is evaluated
+// against the target in a's target directory.
+func (fs *FileState) archive(a *archiver, fileName string) error {
+	if !a.options.include(fileName, ArchiveTypeFile) {
+		return nil
+	}
+	remove, err := fs.isRemove()
+	if err != nil {
+		return err
+	}
+	if remove {
+		return nil
+	}
+	contents, err := fs.TargetContents(a.fs, filepath.Join(a.targetDir, fileName))
+	if err != nil {
+		return err
+	}
+	return a.w.WriteFile(fileName, fs.targetMode(a.umask), contents)
+}
+
+// validate returns an error if o is invalid.
+func (o *ArchiveOptions) validate() error {
+	switch o.Format {
+	case "", ArchiveFormatTar, ArchiveFormatTarGz, ArchiveFormatZip:
+	default:
+		return errors.Errorf("%s: unknown archive format", o.Format)
+	}
+	for _, types := range [][]string{o.IncludeTypes, o.ExcludeTypes} {
+		for _, t := range types {
+			if t != ArchiveTypeDir && t != ArchiveTypeFile {
+				return errors.Errorf("%s: unknown archive entry type", t)
+			}
+		}
+	}
+	for _, patterns := range [][]string{o.IncludePaths, o.ExcludePaths} {
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return errors.Wrap(err, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// include returns true if the entry called name of type entryType should be
+// included in the archive.
+func (o *ArchiveOptions) include(name, entryType string) bool {
+	if len(o.IncludeTypes) != 0 && !containsString(o.IncludeTypes, entryType) {
+		return false
+	}
+	if containsString(o.ExcludeTypes, entryType) {
+		return false
+	}
+	if len(o.IncludePaths) != 0 && !matchAnyPathPattern(name, o.IncludePaths) {
+		return false
+	}
+	return !matchAnyPathPattern(name, o.ExcludePaths)
+}
+
+func newTarArchiveWriter(w io.Writer, gzipWriter *gzip.Writer, archiveOptions ArchiveOptions) *tarArchiveWriter {
+	if gzipWriter != nil {
+		w = gzipWriter
+	}
+	return &tarArchiveWriter{
+		w:          tar.NewWriter(w),
+		gzipWriter: gzipWriter,
+		headerTemplate: tar.Header{
+			Uid:        archiveOptions.UID,
+			Gid:        archiveOptions.GID,
+			Uname:      archiveOptions.Uname,
+			Gname:      archiveOptions.Gname,
+			ModTime:    archiveOptions.ModTime,
+			AccessTime: archiveOptions.ModTime,
+			ChangeTime: archiveOptions.ModTime,
+		},
+	}
+}
+
+func (w *tarArchiveWriter) WriteDir(name string, mode os.FileMode) error {
+	header := w.headerTemplate
+	header.Typeflag = tar.TypeDir
+	header.Name = filepath.ToSlash(name)
+	header.Mode = int64(mode)
+	return w.w.WriteHeader(&header)
+}
+
+func (w *tarArchiveWriter) WriteFile(name string, mode os.FileMode, contents []byte) error {
+	header := w.headerTemplate
+	header.Typeflag = tar.TypeReg
+	header.Name = filepath.ToSlash(name)
+	header.Size = int64(len(contents))
+	header.Mode = int64(mode)
+	if err := w.w.WriteHeader(&header); err != nil {
+		return err
+	}
+	_, err := w.w.Write(contents)
+	return err
+}
+
+func (w *tarArchiveWriter) Close() error {
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	if w.gzipWriter != nil {
+		return w.gzipWriter.Close()
+	}
+	return nil
+}
+
+func (w *zipArchiveWriter) WriteDir(name string, mode os.FileMode) error {
+	header := &zip.FileHeader{
+		Name:     filepath.ToSlash(name) + "/",
+		Method:   zip.Store,
+		Modified: w.modTime,
+	}
+	header.SetMode(os.ModeDir | mode)
+	_, err := w.w.CreateHeader(header)
+	return err
+}
+
+func (w *zipArchiveWriter) WriteFile(name string, mode os.FileMode, contents []byte) error {
+	header := &zip.FileHeader{
+		Name:     filepath.ToSlash(name),
+		Method:   zip.Deflate,
+		Modified: w.modTime,
+	}
+	header.SetMode(mode)
+	fw, err := w.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(contents)
+	return err
+}
+
+func (w *zipArchiveWriter) Close() error {
+	return w.w.Close()
+}
+
+// ArchiveFormatFromName returns the archive format for the file name or URL
+// name, defaulting to ArchiveFormatTar.
+func ArchiveFormatFromName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveFormatTarGz
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveFormatZip
+	default:
+		return ArchiveFormatTar
+	}
+}
+
+// matchAnyPathPattern returns true if path, or any of its parent directories,
+// matches any of patterns.
+func matchAnyPathPattern(path string, patterns []string) bool {
+	for ; path != "." && path != string(os.PathSeparator); path = filepath.Dir(path) {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(filepath.Clean(pattern), path); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
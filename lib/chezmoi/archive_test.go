@@ -0,0 +1,250 @@
+package chezmoi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+// An archiveEntry is an entry read back from an archive.
+type archiveEntry struct {
+	Name     string
+	Dir      bool
+	Mode     int64
+	ModTime  int64
+	Contents string
+}
+
+func readTarEntries(r io.Reader) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, archiveEntry{
+			Name:     header.Name,
+			Dir:      header.Typeflag == tar.TypeDir,
+			Mode:     header.Mode,
+			ModTime:  header.ModTime.Unix(),
+			Contents: string(contents),
+		})
+	}
+}
+
+func readZipEntries(data []byte) ([]archiveEntry, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var entries []archiveEntry
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, archiveEntry{
+			Name:     f.Name,
+			Dir:      f.Mode().IsDir(),
+			Mode:     int64(f.Mode().Perm()),
+			ModTime:  f.Modified.Unix(),
+			Contents: string(contents),
+		})
+	}
+	return entries, nil
+}
+
+func readArchiveEntries(format string, data []byte) ([]archiveEntry, error) {
+	switch format {
+	case ArchiveFormatTarGz:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return readTarEntries(gr)
+	case ArchiveFormatZip:
+		return readZipEntries(data)
+	default:
+		return readTarEntries(bytes.NewReader(data))
+	}
+}
+
+func TestArchive(t *testing.T) {
+	fsMap := map[string]string{
+		"/home/user/.chezmoi/dot_bashrc":             "bar",
+		"/home/user/.chezmoi/dot_empty":              "",
+		"/home/user/.chezmoi/empty_dot_hushlogin":    "",
+		"/home/user/.chezmoi/create_dot_profile":     "",
+		"/home/user/.chezmoi/private_dot_ssh/config": "Host *\n",
+		"/home/user/.chezmoi/private_dot_ssh/id_rsa": "secret",
+	}
+	modTime := time.Unix(1540000000, 0)
+	for _, tc := range []struct {
+		name           string
+		archiveOptions ArchiveOptions
+		want           []archiveEntry
+	}{
+		{
+			name: "tar",
+			archiveOptions: ArchiveOptions{
+				ModTime: modTime,
+			},
+			want: []archiveEntry{
+				{Name: ".bashrc", Mode: 0644, ModTime: modTime.Unix(), Contents: "bar"},
+				{Name: ".hushlogin", Mode: 0644, ModTime: modTime.Unix()},
+				{Name: ".profile", Mode: 0644, ModTime: modTime.Unix()},
+				{Name: ".ssh", Dir: true, Mode: 0700, ModTime: modTime.Unix()},
+				{Name: ".ssh/config", Mode: 0644, ModTime: modTime.Unix(), Contents: "Host *\n"},
+				{Name: ".ssh/id_rsa", Mode: 0644, ModTime: modTime.Unix(), Contents: "secret"},
+			},
+		},
+		{
+			name: "tar.gz_files_only",
+			archiveOptions: ArchiveOptions{
+				Format:       ArchiveFormatTarGz,
+				IncludeTypes: []string{ArchiveTypeFile},
+				IncludePaths: []string{".ssh"},
+			},
+			want: []archiveEntry{
+				{Name: ".ssh/config", Mode: 0644, Contents: "Host *\n"},
+				{Name: ".ssh/id_rsa", Mode: 0644, Contents: "secret"},
+			},
+		},
+		{
+			name: "zip_excludes",
+			archiveOptions: ArchiveOptions{
+				Format:       ArchiveFormatZip,
+				ModTime:      modTime,
+				ExcludeTypes: []string{ArchiveTypeDir},
+				ExcludePaths: []string{".ssh/id_*", ".*login"},
+			},
+			want: []archiveEntry{
+				{Name: ".bashrc", Mode: 0644, ModTime: modTime.Unix(), Contents: "bar"},
+				{Name: ".profile", Mode: 0644, ModTime: modTime.Unix()},
+				{Name: ".ssh/config", Mode: 0644, ModTime: modTime.Unix(), Contents: "Host *\n"},
+			},
+		},
+		{
+			name: "zip_dirs_only",
+			archiveOptions: ArchiveOptions{
+				Format:       ArchiveFormatZip,
+				ModTime:      modTime,
+				IncludeTypes: []string{ArchiveTypeDir},
+			},
+			want: []archiveEntry{
+				{Name: ".ssh/", Dir: true, Mode: 0700, ModTime: modTime.Unix()},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(fsMap)
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+			}
+			rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+			if err := rs.Populate(fs); err != nil {
+				t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+			}
+			b1 := &bytes.Buffer{}
+			if err := rs.Archive(fs, b1, 022, tc.archiveOptions); err != nil {
+				t.Fatalf("rs.Archive(_, _, 022, %+v) == %v, want <nil>", tc.archiveOptions, err)
+			}
+			b2 := &bytes.Buffer{}
+			if err := rs.Archive(fs, b2, 022, tc.archiveOptions); err != nil {
+				t.Fatalf("rs.Archive(_, _, 022, %+v) == %v, want <nil>", tc.archiveOptions, err)
+			}
+			if !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+				t.Errorf("rs.Archive(_, _, 022, %+v) is not reproducible", tc.archiveOptions)
+			}
+			got, err := readArchiveEntries(tc.archiveOptions.Format, b1.Bytes())
+			if err != nil {
+				t.Fatalf("readArchiveEntries(%q, _) == %v, %v, want !<nil>, <nil>", tc.archiveOptions.Format, got, err)
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.want, got); !equal {
+				t.Errorf("rs.Archive(_, _, 022, %+v) diff:\n%s\n", tc.archiveOptions, diff)
+			}
+		})
+	}
+}
+
+func TestArchiveZipTimeZone(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/dot_bashrc": "bar",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	defer func(local *time.Location) {
+		time.Local = local
+	}(time.Local)
+	for _, modTime := range []int64{0, 1540000000} {
+		var archives [][]byte
+		for _, local := range []*time.Location{time.UTC, time.FixedZone("EST", -5*60*60)} {
+			time.Local = local
+			archiveOptions := ArchiveOptions{
+				Format:  ArchiveFormatZip,
+				ModTime: time.Unix(modTime, 0),
+			}
+			b := &bytes.Buffer{}
+			if err := rs.Archive(fs, b, 022, archiveOptions); err != nil {
+				t.Fatalf("rs.Archive(_, _, 022, %+v) == %v, want <nil>", archiveOptions, err)
+			}
+			archives = append(archives, b.Bytes())
+		}
+		if !bytes.Equal(archives[0], archives[1]) {
+			t.Errorf("rs.Archive(_, _, 022, _) with ModTime %d depends on the local time zone", modTime)
+		}
+		entries, err := readZipEntries(archives[0])
+		if err != nil {
+			t.Fatalf("readZipEntries(_) == %v, %v, want !<nil>, <nil>", entries, err)
+		}
+		wantModTime := modTime
+		if wantModTime < zipEpoch.Unix() {
+			wantModTime = zipEpoch.Unix()
+		}
+		if len(entries) != 1 || entries[0].ModTime != wantModTime {
+			t.Errorf("readZipEntries(_) == %+v, want one entry with ModTime %d", entries, wantModTime)
+		}
+	}
+}
+
+func TestArchiveOptionsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		archiveOptions ArchiveOptions
+		wantErr        bool
+	}{
+		{archiveOptions: ArchiveOptions{}},
+		{archiveOptions: ArchiveOptions{Format: ArchiveFormatZip, IncludeTypes: []string{ArchiveTypeDir}}},
+		{archiveOptions: ArchiveOptions{Format: "rar"}, wantErr: true},
+		{archiveOptions: ArchiveOptions{ExcludeTypes: []string{"symlink"}}, wantErr: true},
+		{archiveOptions: ArchiveOptions{ExcludePaths: []string{"["}}, wantErr: true},
+	} {
+		if err := tc.archiveOptions.validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%+v.validate() == %v, want error %t", tc.archiveOptions, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package chezmoi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+)
+
+// attributesFileName is the name of the file in the source directory that
+// maps target patterns to explicit modes.
+const attributesFileName = ".chezmoiattributes"
+
+// A modeAttribute sets the mode of all targets matching pattern.
+type modeAttribute struct {
+	pattern string
+	mode    os.FileMode
+}
+
+// parseAttributes parses the contents of an attributes file. Each line
+// contains a target pattern and an octal mode, separated by whitespace. The
+// mode is the last field, so the pattern may contain whitespace, which can
+// also be escaped with a backslash. Blank lines and lines beginning with # are
+// ignored.
+func parseAttributes(contents []byte) ([]modeAttribute, error) {
+	var attributes []modeAttribute
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	for lineNumber := 1; s.Scan(); lineNumber++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rawPattern, rawMode, ok := splitAttributeLine(line)
+		if !ok {
+			return nil, errors.Errorf("%s:%d: expected pattern and mode", attributesFileName, lineNumber)
+		}
+		pattern := filepath.Clean(rawPattern)
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d: %s", attributesFileName, lineNumber, rawPattern)
+		}
+		mode, err := strconv.ParseUint(rawMode, 8, 32)
+		if err != nil || mode&^uint64(os.ModePerm) != 0 {
+			return nil, errors.Errorf("%s:%d: %s: invalid mode", attributesFileName, lineNumber, rawMode)
+		}
+		attributes = append(attributes, modeAttribute{
+			pattern: pattern,
+			mode:    os.FileMode(mode),
+		})
+	}
+	return attributes, s.Err()
+}
+
+// populateAttributes sets the modes of all states matching patterns in the
+// attributes file in the source directory, if it exists. Later patterns take
+// precedence over earlier ones.
+func (rs *RootState) populateAttributes(fs afero.Fs) error {
+	contents, err := afero.ReadFile(fs, filepath.Join(rs.SourceDir, attributesFileName))
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	attributes, err := parseAttributes(contents)
+	if err != nil {
+		return err
+	}
+	for targetName, state := range rs.AllStates() {
+		for i := len(attributes) - 1; i >= 0; i-- {
+			if ok, _ := filepath.Match(attributes[i].pattern, targetName); !ok {
+				continue
+			}
+			switch state := state.(type) {
+			case *DirState:
+				state.Mode = os.ModeDir | attributes[i].mode
+				state.exactMode = true
+			case *FileState:
+				state.Mode = attributes[i].mode
+				state.exactMode = true
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// addAttribute sets the mode of targetName in the attributes file in the
+// source directory, replacing any existing attribute for exactly targetName.
+func (rs *RootState) addAttribute(fs afero.Fs, targetName string, mode os.FileMode, actuator Actuator) error {
+	pattern := attributePattern(targetName)
+	return rs.rewriteAttributes(fs, map[string]string{
+		pattern: fmt.Sprintf("%s %04o", pattern, mode&os.ModePerm),
+	}, actuator)
+}
+
+// rewriteAttributes rewrites the attributes file in the source directory,
+// removing the lines for each pattern in lines and then appending the
+// non-empty values of lines, so that they take precedence over all other
+// patterns.
+func (rs *RootState) rewriteAttributes(fs afero.Fs, lines map[string]string, actuator Actuator) error {
+	path := filepath.Join(rs.SourceDir, attributesFileName)
+	contents, err := afero.ReadFile(fs, path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	newContents := &bytes.Buffer{}
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	for s.Scan() {
+		line := s.Text()
+		if pattern, _, ok := splitAttributeLine(strings.TrimSpace(line)); ok && !strings.HasPrefix(pattern, "#") {
+			if _, ok := lines[escapeWhitespace(filepath.Clean(pattern))]; ok {
+				continue
+			}
+		}
+		newContents.WriteString(line + "\n")
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	var patterns []string
+	for pattern, line := range lines {
+		if line != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		newContents.WriteString(lines[pattern] + "\n")
+	}
+	if bytes.Equal(newContents.Bytes(), contents) {
+		return nil
+	}
+	return actuator.WriteFile(path, newContents.Bytes(), 0666&^rs.Umask, contents)
+}
+
+// splitAttributeLine splits line, which must not have leading or trailing
+// whitespace, into its pattern and its mode, which is the last field. Fields
+// are separated by whitespace that is not escaped with a backslash. It returns
+// false if line has fewer than two fields.
+func splitAttributeLine(line string) (string, string, bool) {
+	patternEnd, modeStart := -1, -1
+	// fieldEnd is the end of the last rune that is not a separator.
+	fieldEnd := 0
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case unicode.IsSpace(r):
+			patternEnd, modeStart = fieldEnd, i+utf8.RuneLen(r)
+			continue
+		}
+		fieldEnd = i + utf8.RuneLen(r)
+	}
+	if patternEnd <= 0 || modeStart >= len(line) {
+		return "", "", false
+	}
+	return line[:patternEnd], line[modeStart:], true
+}
+
+// attributePattern returns the pattern in the attributes file that matches
+// exactly targetName.
+func attributePattern(targetName string) string {
+	return escapeWhitespace(escapeGlob(targetName))
+}
+
+// escapeWhitespace returns pattern with all whitespace that is not already
+// escaped escaped with a backslash, so that it is not read as a separator in
+// the attributes file.
+func escapeWhitespace(pattern string) string {
+	b := &strings.Builder{}
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case unicode.IsSpace(r):
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// escapeGlob returns name with all glob metacharacters escaped.
+func escapeGlob(name string) string {
+	b := &strings.Builder{}
+	for _, r := range name {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
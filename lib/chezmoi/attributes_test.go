@@ -0,0 +1,184 @@
+package chezmoi
+
+import (
+	"os"
+	"testing"
+
+	"github.com/absfs/afero"
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestParseAttributes(t *testing.T) {
+	for _, tc := range []struct {
+		contents   string
+		want       []modeAttribute
+		wantErrStr string
+	}{
+		{
+			contents: "# comment\n\n.ssh/config 0640\n.config/shared/* 664\n",
+			want: []modeAttribute{
+				{pattern: ".ssh/config", mode: 0640},
+				{pattern: ".config/shared/*", mode: 0664},
+			},
+		},
+		{
+			contents: "My File 0640\nMy\\ Other\\ File\\  0600\n\tindented\t \t0644  \n",
+			want: []modeAttribute{
+				{pattern: "My File", mode: 0640},
+				{pattern: "My\\ Other\\ File\\ ", mode: 0600},
+				{pattern: "indented", mode: 0644},
+			},
+		},
+		{
+			contents:   ".ssh/config\n",
+			wantErrStr: ".chezmoiattributes:1: expected pattern and mode",
+		},
+		{
+			contents:   "\n.ssh/config 0888\n",
+			wantErrStr: ".chezmoiattributes:2: 0888: invalid mode",
+		},
+		{
+			contents:   ".ssh/config 01777\n",
+			wantErrStr: ".chezmoiattributes:1: 01777: invalid mode",
+		},
+	} {
+		got, err := parseAttributes([]byte(tc.contents))
+		if tc.wantErrStr != "" {
+			if err == nil || err.Error() != tc.wantErrStr {
+				t.Errorf("parseAttributes(%q) == _, %v, want _, %q", tc.contents, err, tc.wantErrStr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseAttributes(%q) == _, %v, want _, <nil>", tc.contents, err)
+			continue
+		}
+		if diff, equal := messagediff.PrettyDiff(tc.want, got); !equal {
+			t.Errorf("parseAttributes(%q) diff:\n%s\n", tc.contents, diff)
+		}
+	}
+}
+
+func TestAttributesRoundTrip(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/.keep": "",
+		"/home/user/.netrc":         "netrc",
+		"/home/user/shared/file":    "shared",
+		"/home/user/readonly":       "readonly",
+		"/home/user/weird*name":     "weird",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	for path, mode := range map[string]os.FileMode{
+		"/home/user/.netrc":      0600,
+		"/home/user/shared/file": 0640,
+		"/home/user/readonly":    0444,
+		"/home/user/weird*name":  0604,
+	} {
+		if err := fs.Chmod(path, mode); err != nil {
+			t.Fatalf("fs.Chmod(%q, %v) == %v, want <nil>", path, mode, err)
+		}
+	}
+	rs := NewRootState("/home/user", memMapFsUmask, "/home/user/.chezmoi", nil)
+	actuator := NewFsActuator(fs, "/home/user")
+	for _, target := range []string{"/home/user/.netrc", "/home/user/shared/file", "/home/user/readonly", "/home/user/weird*name"} {
+		if err := rs.Add(fs, AddOptions{}, target, nil, actuator); err != nil {
+			t.Fatalf("rs.Add(_, _, %q, nil, _) == %v, want <nil>", target, err)
+		}
+	}
+	gotAttributes, err := afero.ReadFile(fs, "/home/user/.chezmoi/.chezmoiattributes")
+	if err != nil {
+		t.Fatalf("afero.ReadFile(_, _) == _, %v, want _, <nil>", err)
+	}
+	if wantAttributes := "shared/file 0640\nweird\\*name 0604\n"; string(gotAttributes) != wantAttributes {
+		t.Errorf("attributes == %q, want %q", gotAttributes, wantAttributes)
+	}
+	if _, err := fs.Stat("/home/user/.chezmoi/private_dot_netrc"); err != nil {
+		t.Errorf("fs.Stat(%q) == _, %v, want _, <nil>", "/home/user/.chezmoi/private_dot_netrc", err)
+	}
+	if _, err := fs.Stat("/home/user/.chezmoi/readonly_readonly"); err != nil {
+		t.Errorf("fs.Stat(%q) == _, %v, want _, <nil>", "/home/user/.chezmoi/readonly_readonly", err)
+	}
+
+	populatedRS := NewRootState("/home/user", memMapFsUmask, "/home/user/.chezmoi", nil)
+	if err := populatedRS.Populate(fs); err != nil {
+		t.Fatalf("populatedRS.Populate(_) == %v, want <nil>", err)
+	}
+	for targetName, wantMode := range map[string]os.FileMode{
+		".netrc":      0600,
+		"shared/file": 0640,
+		"readonly":    0444,
+		"weird*name":  0604,
+	} {
+		fileState, ok := populatedRS.Get(targetName).(*FileState)
+		if !ok {
+			t.Errorf("populatedRS.Get(%q) is not a *FileState", targetName)
+			continue
+		}
+		if gotMode := fileState.targetMode(populatedRS.Umask); gotMode != wantMode {
+			t.Errorf("%s: got mode %v, want %v", targetName, gotMode, wantMode)
+		}
+	}
+	anyActuator := NewAnyActuator(NewNullActuator())
+	if err := populatedRS.Apply(fs, ApplyOptions{}, anyActuator); err != nil {
+		t.Fatalf("populatedRS.Apply(_, _, _) == %v, want <nil>", err)
+	}
+	if anyActuator.Actuated() {
+		t.Errorf("anyActuator.Actuated() == true, want false")
+	}
+}
+
+func TestAddAttributeReplaces(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/.chezmoiattributes": "# comment\nshared/file 0640\n.netrc 0604\n",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	actuator := NewFsActuator(fs, "/home/user")
+	for _, mode := range []os.FileMode{0660, 0644} {
+		if err := rs.addAttribute(fs, "shared/file", mode, actuator); err != nil {
+			t.Fatalf("rs.addAttribute(_, %q, %v, _) == %v, want <nil>", "shared/file", mode, err)
+		}
+	}
+	gotAttributes, err := afero.ReadFile(fs, "/home/user/.chezmoi/.chezmoiattributes")
+	if err != nil {
+		t.Fatalf("afero.ReadFile(_, _) == _, %v, want _, <nil>", err)
+	}
+	if wantAttributes := "# comment\n.netrc 0604\nshared/file 0644\n"; string(gotAttributes) != wantAttributes {
+		t.Errorf("attributes == %q, want %q", gotAttributes, wantAttributes)
+	}
+}
+
+func TestAddAttributeWhitespace(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/.chezmoiattributes": "My File 0600\n",
+		"/home/user/.chezmoi/My File":            "contents",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	actuator := NewFsActuator(fs, "/home/user")
+	for _, mode := range []os.FileMode{0660, 0640} {
+		if err := rs.addAttribute(fs, "My File", mode, actuator); err != nil {
+			t.Fatalf("rs.addAttribute(_, %q, %v, _) == %v, want <nil>", "My File", mode, err)
+		}
+	}
+	gotAttributes, err := afero.ReadFile(fs, "/home/user/.chezmoi/.chezmoiattributes")
+	if err != nil {
+		t.Fatalf("afero.ReadFile(_, _) == _, %v, want _, <nil>", err)
+	}
+	if wantAttributes := "My\\ File 0640\n"; string(gotAttributes) != wantAttributes {
+		t.Errorf("attributes == %q, want %q", gotAttributes, wantAttributes)
+	}
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	if mode := rs.Files["My File"].Mode; mode != 0640 {
+		t.Errorf("rs.Files[\"My File\"].Mode == %o, want 640", mode)
+	}
+}
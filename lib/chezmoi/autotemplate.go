@@ -1,41 +1,78 @@
 package chezmoi
 
 import (
-	"regexp"
+	"bytes"
+	"path/filepath"
 	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Auto template formats.
+const (
+	AutoTemplateFormatAuto = "auto"
+	AutoTemplateFormatINI  = "ini"
+	AutoTemplateFormatJSON = "json"
+	AutoTemplateFormatTOML = "toml"
+	AutoTemplateFormatYAML = "yaml"
+)
+
+// AutoTemplateOptions are options for automatically generating templates.
+type AutoTemplateOptions struct {
+	// MinValueLength is the minimum length of a value for it to be replaced.
+	MinValueLength int
+	// Format is the format of the contents. If it is empty then any
+	// occurrence of a value is replaced, except in the keys of key = value
+	// and key: value lines. If it is AutoTemplateFormatAuto then
+	// the format is determined from the target name. Otherwise, only whole
+	// values in the given format are replaced.
+	Format string
+}
+
+// A Substitution is a replacement of a value with a template variable.
+type Substitution struct {
+	Line     int
+	Value    string
+	Variable string
+}
+
 type templateVariable struct {
-	name        string
-	value       string
-	valueRegexp *regexp.Regexp
+	name  string
+	value string
+	depth int
 }
 
-type byValueLength []templateVariable
+// A span is a half-open range of bytes.
+type span struct {
+	start, end int
+}
+
+// byPreference sorts template variables by decreasing preference: longest
+// value first, then most deeply nested, then by name.
+type byPreference []templateVariable
 
-func (b byValueLength) Len() int { return len(b) }
-func (b byValueLength) Less(i, j int) bool {
+func (b byPreference) Len() int { return len(b) }
+func (b byPreference) Less(i, j int) bool {
 	switch {
-	case len(b[i].value) < len(b[j].value):
-		return true
-	case len(b[i].value) == len(b[j].value):
-		// Fallback to name
-		return b[i].name > b[j].name
+	case len(b[i].value) != len(b[j].value):
+		return len(b[i].value) > len(b[j].value)
+	case b[i].depth != b[j].depth:
+		return b[i].depth > b[j].depth
 	default:
-		return false
+		return b[i].name < b[j].name
 	}
 }
-func (b byValueLength) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byPreference) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
 
 func extractVariables(variables []templateVariable, parent []string, data map[string]interface{}) []templateVariable {
 	for name, value := range data {
 		switch value := value.(type) {
 		case string:
 			variables = append(variables, templateVariable{
-				name:        strings.Join(append(parent, name), "."),
-				value:       value,
-				valueRegexp: regexp.MustCompile(`\b` + regexp.QuoteMeta(value) + `\b`),
+				name:  strings.Join(append(parent, name), "."),
+				value: value,
+				depth: len(parent),
 			})
 		case map[string]interface{}:
 			variables = extractVariables(variables, append(parent, name), value)
@@ -44,14 +81,336 @@ func extractVariables(variables []templateVariable, parent []string, data map[st
 	return variables
 }
 
-func autoTemplate(contents []byte, data map[string]interface{}) []byte {
-	// FIXME this naive approach will generate incorrect templates if the
-	// variable names match variable values
-	variables := extractVariables(nil, nil, data)
-	sort.Sort(sort.Reverse(byValueLength(variables)))
-	contentsStr := string(contents)
+// autoTemplateFormat returns the auto template format for the target name.
+func autoTemplateFormat(name string) string {
+	switch base := filepath.Base(name); base {
+	case ".gitconfig", ".hgrc":
+		return AutoTemplateFormatINI
+	}
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".cfg", ".conf", ".ini":
+		return AutoTemplateFormatINI
+	case ".json":
+		return AutoTemplateFormatJSON
+	case ".toml":
+		return AutoTemplateFormatTOML
+	case ".yaml", ".yml":
+		return AutoTemplateFormatYAML
+	default:
+		return ""
+	}
+}
+
+// autoTemplate returns contents with values from data replaced by template
+// variables, and the substitutions made. Existing template actions are left
+// unchanged.
+func autoTemplate(contents []byte, data map[string]interface{}, options AutoTemplateOptions) ([]byte, []Substitution) {
+	var variables []templateVariable
+	for _, variable := range extractVariables(nil, nil, data) {
+		if variable.value == "" || len(variable.value) < options.MinValueLength {
+			continue
+		}
+		variables = append(variables, variable)
+	}
+	sort.Sort(byPreference(variables))
+
+	var valueSpans []span
+	switch options.Format {
+	case AutoTemplateFormatINI, AutoTemplateFormatTOML:
+		valueSpans = iniValueSpans(contents)
+	case AutoTemplateFormatJSON:
+		valueSpans = jsonValueSpans(contents)
+	case AutoTemplateFormatYAML:
+		valueSpans = yamlValueSpans(contents)
+	}
+
+	var keys []span
+	if options.Format == "" {
+		keys = keySpans(contents)
+	}
+
+	var matches []span
+	var matchedVariables []templateVariable
+	for _, text := range textSpans(contents) {
+		if options.Format == "" {
+			for i := text.start; i < text.end; {
+				if len(keys) != 0 && i >= keys[0].end {
+					keys = keys[1:]
+					continue
+				}
+				if len(keys) != 0 && i >= keys[0].start {
+					i = keys[0].end
+					continue
+				}
+				variable, ok := matchVariable(contents, span{i, text.end}, variables)
+				if !ok {
+					i++
+					continue
+				}
+				matches = append(matches, span{i, i + len(variable.value)})
+				matchedVariables = append(matchedVariables, variable)
+				i += len(variable.value)
+			}
+			continue
+		}
+		for _, valueSpan := range valueSpans {
+			if valueSpan.start < text.start || valueSpan.end > text.end {
+				continue
+			}
+			value := string(contents[valueSpan.start:valueSpan.end])
+			for _, variable := range variables {
+				if variable.value == value {
+					matches = append(matches, valueSpan)
+					matchedVariables = append(matchedVariables, variable)
+					break
+				}
+			}
+		}
+	}
+
+	output := &bytes.Buffer{}
+	var substitutions []Substitution
+	offset := 0
+	for i, match := range matches {
+		output.Write(contents[offset:match.start])
+		output.WriteString("{{ ." + matchedVariables[i].name + " }}")
+		substitutions = append(substitutions, Substitution{
+			Line:     1 + bytes.Count(contents[:match.start], []byte("\n")),
+			Value:    matchedVariables[i].value,
+			Variable: matchedVariables[i].name,
+		})
+		offset = match.end
+	}
+	output.Write(contents[offset:])
+	return output.Bytes(), substitutions
+}
+
+// matchVariable returns the most preferred variable whose value occurs at the
+// start of s in contents on word boundaries and not inside a URL.
+func matchVariable(contents []byte, s span, variables []templateVariable) (templateVariable, bool) {
 	for _, variable := range variables {
-		contentsStr = variable.valueRegexp.ReplaceAllString(contentsStr, "{{ ."+variable.name+" }}")
+		end := s.start + len(variable.value)
+		if end > s.end || string(contents[s.start:end]) != variable.value {
+			continue
+		}
+		if isWordStart(variable.value) && s.start > 0 && isWordRuneBefore(contents, s.start) {
+			continue
+		}
+		if isWordEnd(variable.value) && end < len(contents) && isWordRuneAfter(contents, end) {
+			continue
+		}
+		if insidePartOfURL(contents, span{s.start, end}) {
+			continue
+		}
+		return variable, true
 	}
-	return []byte(contentsStr)
+	return templateVariable{}, false
+}
+
+// textSpans returns the spans of contents that are outside template actions.
+func textSpans(contents []byte) []span {
+	var spans []span
+	offset := 0
+	for {
+		i := bytes.Index(contents[offset:], []byte("{{"))
+		if i == -1 {
+			break
+		}
+		j := bytes.Index(contents[offset+i:], []byte("}}"))
+		if j == -1 {
+			break
+		}
+		spans = append(spans, span{offset, offset + i})
+		offset += i + j + 2
+	}
+	return append(spans, span{offset, len(contents)})
+}
+
+// insidePartOfURL returns true if s lies inside, but does not cover, a
+// whitespace-delimited token in contents that looks like a URL.
+func insidePartOfURL(contents []byte, s span) bool {
+	start := s.start
+	for start > 0 && !isSpace(contents[start-1]) {
+		start--
+	}
+	end := s.end
+	for end < len(contents) && !isSpace(contents[end]) {
+		end++
+	}
+	if start == s.start && end == s.end {
+		return false
+	}
+	return bytes.Contains(contents[start:end], []byte("://"))
+}
+
+// keySpans returns the spans of the keys of key = value and key: value lines in
+// contents, in order. Keys may not contain whitespace, and a colon must be
+// followed by whitespace so that URLs are not mistaken for keys.
+func keySpans(contents []byte) []span {
+	var spans []span
+	forEachLine(contents, func(offset int, line []byte) {
+		start := 0
+		for start < len(line) && isSpace(line[start]) {
+			start++
+		}
+		end := start
+		for end < len(line) && !isSpace(line[end]) && line[end] != '=' && line[end] != ':' {
+			end++
+		}
+		if end == start {
+			return
+		}
+		i := end
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		switch {
+		case i < len(line) && line[i] == '=':
+		case i < len(line) && line[i] == ':' && (i+1 == len(line) || isSpace(line[i+1])):
+		default:
+			return
+		}
+		spans = append(spans, span{offset + start, offset + end})
+	})
+	return spans
+}
+
+// iniValueSpans returns the spans of the values in INI or TOML contents.
+func iniValueSpans(contents []byte) []span {
+	var spans []span
+	forEachLine(contents, func(offset int, line []byte) {
+		trimmed := bytes.TrimLeft(line, " \t")
+		if len(trimmed) == 0 || bytes.IndexByte([]byte("#;["), trimmed[0]) != -1 {
+			return
+		}
+		i := bytes.IndexByte(line, '=')
+		if i == -1 {
+			return
+		}
+		if s, ok := trimValue(line, span{i + 1, len(line)}); ok {
+			spans = append(spans, span{offset + s.start, offset + s.end})
+		}
+	})
+	return spans
+}
+
+// jsonValueSpans returns the spans of the string values, excluding their
+// quotes, in JSON contents. Object keys and strings containing escape
+// sequences are excluded.
+func jsonValueSpans(contents []byte) []span {
+	var spans []span
+	for i := 0; i < len(contents); i++ {
+		if contents[i] != '"' {
+			continue
+		}
+		start := i + 1
+		escaped := false
+		for i = start; i < len(contents) && contents[i] != '"'; i++ {
+			if contents[i] == '\\' {
+				escaped = true
+				i++
+			}
+		}
+		if i >= len(contents) {
+			break
+		}
+		end := i
+		j := end + 1
+		for j < len(contents) && isSpace(contents[j]) {
+			j++
+		}
+		if escaped || (j < len(contents) && contents[j] == ':') {
+			continue
+		}
+		spans = append(spans, span{start, end})
+	}
+	return spans
+}
+
+// yamlValueSpans returns the spans of the scalar values in YAML contents.
+func yamlValueSpans(contents []byte) []span {
+	var spans []span
+	forEachLine(contents, func(offset int, line []byte) {
+		start := 0
+		for start < len(line) && (line[start] == ' ' || line[start] == '\t') {
+			start++
+		}
+		isListItem := false
+		for bytes.HasPrefix(line[start:], []byte("- ")) {
+			start += 2
+			isListItem = true
+		}
+		if start == len(line) || line[start] == '#' {
+			return
+		}
+		if i := bytes.Index(line[start:], []byte(": ")); i != -1 {
+			start += i + 2
+		} else if !isListItem {
+			return
+		}
+		s, ok := trimValue(line, span{start, len(line)})
+		if !ok || bytes.IndexByte([]byte("|>{[&*!"), line[s.start]) != -1 {
+			return
+		}
+		spans = append(spans, span{offset + s.start, offset + s.end})
+	})
+	return spans
+}
+
+// forEachLine calls f with the offset and contents of each line in contents,
+// excluding the newline.
+func forEachLine(contents []byte, f func(int, []byte)) {
+	offset := 0
+	for offset < len(contents) {
+		end := bytes.IndexByte(contents[offset:], '\n')
+		if end == -1 {
+			end = len(contents) - offset
+		}
+		f(offset, contents[offset:offset+end])
+		offset += end + 1
+	}
+}
+
+// trimValue trims whitespace and matching quotes from s in line. It returns
+// false if the resulting value is empty.
+func trimValue(line []byte, s span) (span, bool) {
+	for s.start < s.end && isSpace(line[s.start]) {
+		s.start++
+	}
+	for s.end > s.start && isSpace(line[s.end-1]) {
+		s.end--
+	}
+	if s.end-s.start >= 2 && (line[s.start] == '"' || line[s.start] == '\'') && line[s.end-1] == line[s.start] {
+		s.start++
+		s.end--
+	}
+	return s, s.start < s.end
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isWordStart(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return isWordRune(r)
+}
+
+func isWordEnd(s string) bool {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return isWordRune(r)
+}
+
+func isWordRuneBefore(contents []byte, i int) bool {
+	r, _ := utf8.DecodeLastRune(contents[:i])
+	return isWordRune(r)
+}
+
+func isWordRuneAfter(contents []byte, i int) bool {
+	r, _ := utf8.DecodeRune(contents[i:])
+	return isWordRune(r)
 }
@@ -1,11 +1,16 @@
 package chezmoi
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/d4l3k/messagediff"
+)
 
 func TestAutoTemplate(t *testing.T) {
 	for _, tc := range []struct {
 		contentsStr string
 		data        map[string]interface{}
+		options     AutoTemplateOptions
 		wantStr     string
 	}{
 		{
@@ -39,22 +44,124 @@ func TestAutoTemplate(t *testing.T) {
 			},
 			wantStr: "darwinian evolution", // not "{{ .os }}ian evolution"
 		},
-		/*
-			// FIXME this test currently fails because we match on word
-			// boundaries and ^/ is not a word boundary.
-			{
-				contentsStr: "/home/user",
-				data: map[string]interface{}{
-					"homedir": "/home/user",
+		{
+			contentsStr: "/home/user",
+			data: map[string]interface{}{
+				"homedir": "/home/user",
+			},
+			wantStr: "{{ .homedir }}",
+		},
+		{
+			contentsStr: "name = Alice\nuser = alice\n",
+			data: map[string]interface{}{
+				"name": "alice",
+				"user": "name",
+			},
+			wantStr: "name = Alice\nuser = {{ .name }}\n", // keys that match values are unchanged
+		},
+		{
+			contentsStr: "email = {{ .email }}\nname = John Smith\n",
+			data: map[string]interface{}{
+				"email": "email",
+				"name":  "John Smith",
+			},
+			wantStr: "email = {{ .email }}\nname = {{ .name }}\n", // existing actions are unchanged
+		},
+		{
+			contentsStr: "email = hello@example.com\n",
+			data: map[string]interface{}{
+				"email": "hello@example.com",
+				"work": map[string]interface{}{
+					"email": "hello@example.com",
 				},
-				wantStr: "{{ .homedir }}",
 			},
-		*/
+			wantStr: "email = {{ .work.email }}\n", // most deeply nested
+		},
+		{
+			contentsStr: "email = hello@example.com\n",
+			data: map[string]interface{}{
+				"b": "hello@example.com",
+				"a": "hello@example.com",
+			},
+			wantStr: "email = {{ .a }}\n", // then by name
+		},
+		{
+			contentsStr: "alice: alice\n\"alice\": \"alice\"\nalice:alice\n",
+			data: map[string]interface{}{
+				"user": "alice",
+			},
+			wantStr: "alice: {{ .user }}\n\"alice\": \"{{ .user }}\"\n{{ .user }}:{{ .user }}\n", // keys are unchanged
+		},
+		{
+			contentsStr: "url = https://github.com/alice/dotfiles\nuser = alice\n",
+			data: map[string]interface{}{
+				"user": "alice",
+			},
+			wantStr: "url = https://github.com/alice/dotfiles\nuser = {{ .user }}\n",
+		},
+		{
+			contentsStr: "os = go\nlanguage = go\n",
+			data: map[string]interface{}{
+				"os": "go",
+			},
+			options: AutoTemplateOptions{
+				MinValueLength: 3,
+			},
+			wantStr: "os = go\nlanguage = go\n",
+		},
+		{
+			contentsStr: "[user]\n\tname = John Smith\n\temail = \"john@example.com\"\n[url \"git@github.com:john/\"]\n\tinsteadOf = https://github.com/john/\n",
+			data: map[string]interface{}{
+				"name":  "John Smith",
+				"email": "john@example.com",
+				"user":  "john",
+			},
+			options: AutoTemplateOptions{
+				Format: AutoTemplateFormatINI,
+			},
+			wantStr: "[user]\n\tname = {{ .name }}\n\temail = \"{{ .email }}\"\n[url \"git@github.com:john/\"]\n\tinsteadOf = https://github.com/john/\n",
+		},
+		{
+			contentsStr: "{\n  \"user\": \"john\",\n  \"john\": \"john smith\",\n  \"users\": [\"john\"]\n}\n",
+			data: map[string]interface{}{
+				"user": "john",
+			},
+			options: AutoTemplateOptions{
+				Format: AutoTemplateFormatJSON,
+			},
+			wantStr: "{\n  \"user\": \"{{ .user }}\",\n  \"john\": \"john smith\",\n  \"users\": [\"{{ .user }}\"]\n}\n",
+		},
+		{
+			contentsStr: "user: john\njohn: john smith\nusers:\n  - john\n  - 'john'\n",
+			data: map[string]interface{}{
+				"user": "john",
+			},
+			options: AutoTemplateOptions{
+				Format: AutoTemplateFormatYAML,
+			},
+			wantStr: "user: {{ .user }}\njohn: john smith\nusers:\n  - {{ .user }}\n  - '{{ .user }}'\n",
+		},
 	} {
-		got := autoTemplate([]byte(tc.contentsStr), tc.data)
+		got, _ := autoTemplate([]byte(tc.contentsStr), tc.data, tc.options)
 		gotStr := string(got)
 		if gotStr != tc.wantStr {
-			t.Errorf("autoTemplate([]byte(%q), %v) == %q, want %q", tc.contentsStr, tc.data, gotStr, tc.wantStr)
+			t.Errorf("autoTemplate([]byte(%q), %v, %+v) == %q, want %q", tc.contentsStr, tc.data, tc.options, gotStr, tc.wantStr)
 		}
 	}
 }
+
+func TestAutoTemplateSubstitutions(t *testing.T) {
+	contents := []byte("[user]\n\tname = John Smith\n\temail = john@example.com\n")
+	data := map[string]interface{}{
+		"name":  "John Smith",
+		"email": "john@example.com",
+	}
+	_, got := autoTemplate(contents, data, AutoTemplateOptions{})
+	want := []Substitution{
+		{Line: 2, Value: "John Smith", Variable: "name"},
+		{Line: 3, Value: "john@example.com", Variable: "email"},
+	}
+	if diff, equal := messagediff.PrettyDiff(want, got); !equal {
+		t.Errorf("autoTemplate(%q, %v, _) substitutions diff:\n%s\n", contents, data, diff)
+	}
+}
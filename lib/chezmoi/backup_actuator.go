@@ -0,0 +1,262 @@
+package chezmoi
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+)
+
+// BackupTimeFormat is the format of the names of backup directories. It has
+// nanosecond precision so that applies in the same second have different
+// backups.
+const BackupTimeFormat = "20060102T150405.000000000Z"
+
+// legacyBackupTimeFormat is the format of the names of backup directories
+// made before they had sub-second precision.
+const legacyBackupTimeFormat = "20060102T150405Z"
+
+// A BackupActuator wraps an Actuator and copies every existing target to a
+// backup directory, mirroring its absolute path, before it is first changed.
+type BackupActuator struct {
+	fs        afero.Fs
+	backupDir string
+	a         Actuator
+	backedUp  map[string]bool
+}
+
+// NewBackupActuator returns a new BackupActuator that backs up targets in fs
+// to backupDir before changing them with a.
+func NewBackupActuator(fs afero.Fs, backupDir string, a Actuator) *BackupActuator {
+	return &BackupActuator{
+		fs:        fs,
+		backupDir: backupDir,
+		a:         a,
+		backedUp:  make(map[string]bool),
+	}
+}
+
+// Chmod implements Actuator.Chmod.
+func (a *BackupActuator) Chmod(name string, mode os.FileMode) error {
+	if err := a.backup(name); err != nil {
+		return err
+	}
+	return a.a.Chmod(name, mode)
+}
+
+// Mkdir implements Actuator.Mkdir.
+func (a *BackupActuator) Mkdir(name string, mode os.FileMode) error {
+	return a.a.Mkdir(name, mode)
+}
+
+// RemoveAll implements Actuator.RemoveAll.
+func (a *BackupActuator) RemoveAll(name string) error {
+	if err := a.backup(name); err != nil {
+		return err
+	}
+	return a.a.RemoveAll(name)
+}
+
+// Rename implements Actuator.Rename. Both oldpath and any existing newpath are
+// backed up.
+func (a *BackupActuator) Rename(oldpath, newpath string) error {
+	if err := a.backup(oldpath); err != nil {
+		return err
+	}
+	if err := a.backup(newpath); err != nil {
+		return err
+	}
+	return a.a.Rename(oldpath, newpath)
+}
+
+// WriteFile implements Actuator.WriteFile.
+func (a *BackupActuator) WriteFile(name string, contents []byte, mode os.FileMode, currentContents []byte) error {
+	if err := a.backup(name); err != nil {
+		return err
+	}
+	return a.a.WriteFile(name, contents, mode, currentContents)
+}
+
+// backup copies name, and all its descendants, to a's backup directory, unless
+// it has already been backed up.
+func (a *BackupActuator) backup(name string) error {
+	if a.backedUp[name] {
+		return nil
+	}
+	if _, err := a.fs.Stat(name); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := afero.Walk(a.fs, name, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		backupPath := filepath.Join(a.backupDir, path)
+		if _, err := a.fs.Stat(backupPath); err == nil {
+			return nil
+		}
+		if err := a.fs.MkdirAll(filepath.Dir(backupPath), 0700); err != nil {
+			return err
+		}
+		switch {
+		case fi.Mode().IsDir():
+			return a.fs.Mkdir(backupPath, fi.Mode()&os.ModePerm)
+		case fi.Mode().IsRegular():
+			contents, err := afero.ReadFile(a.fs, path)
+			if err != nil {
+				return err
+			}
+			return afero.WriteFile(a.fs, backupPath, contents, fi.Mode()&os.ModePerm)
+		default:
+			return nil
+		}
+	}); err != nil {
+		return err
+	}
+	a.backedUp[name] = true
+	return nil
+}
+
+// ParseBackupName returns the time at which the backup called name was made.
+func ParseBackupName(name string) (time.Time, error) {
+	for _, layout := range []string{BackupTimeFormat, legacyBackupTimeFormat} {
+		if t, err := time.Parse(layout, name); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("%s: invalid backup name", name)
+}
+
+// NewBackupDir returns a new backup directory in backupsDir for a backup made
+// at t. If a backup directory for t already exists then t is advanced until
+// there is none, so that no backups are overwritten.
+func NewBackupDir(fs afero.Fs, backupsDir string, t time.Time) (string, error) {
+	for {
+		backupDir := filepath.Join(backupsDir, t.UTC().Format(BackupTimeFormat))
+		switch _, err := fs.Stat(backupDir); {
+		case os.IsNotExist(err):
+			return backupDir, nil
+		case err != nil:
+			return "", err
+		}
+		t = t.Add(time.Nanosecond)
+	}
+}
+
+// Backups returns the names of the backups in backupsDir, oldest first.
+func Backups(fs afero.Fs, backupsDir string) ([]string, error) {
+	infos, err := afero.ReadDir(fs, backupsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	times := make(map[string]time.Time)
+	for _, fi := range infos {
+		t, err := ParseBackupName(fi.Name())
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		names = append(names, fi.Name())
+		times[fi.Name()] = t
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return times[names[i]].Before(times[names[j]])
+	})
+	return names, nil
+}
+
+// FindBackup returns the name of the most recent backup in backupsDir made at
+// or before at.
+func FindBackup(fs afero.Fs, backupsDir string, at time.Time) (string, error) {
+	names, err := Backups(fs, backupsDir)
+	if err != nil {
+		return "", err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		if t, _ := ParseBackupName(names[i]); !t.After(at) {
+			return names[i], nil
+		}
+	}
+	return "", errors.Errorf("%s: no backups at or before %s", backupsDir, at.UTC().Format(time.RFC3339))
+}
+
+// PruneBackups removes all but the keep most recent backups in backupsDir.
+func PruneBackups(fs afero.Fs, backupsDir string, keep int) error {
+	names, err := Backups(fs, backupsDir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(names)-keep; i++ {
+		if err := fs.RemoveAll(filepath.Join(backupsDir, names[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreBackup restores target, and all its descendants, from backupDir with
+// actuator. Regular files are overwritten and missing directories are
+// created. Targets without a backup are left unchanged.
+func RestoreBackup(fs afero.Fs, backupDir, target string, actuator Actuator) error {
+	backupPath := filepath.Join(backupDir, target)
+	if _, err := fs.Stat(backupPath); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return afero.Walk(fs, backupPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		targetPath := string(filepath.Separator) + strings.TrimPrefix(path[len(backupDir):], string(filepath.Separator))
+		info, err := fs.Stat(targetPath)
+		switch {
+		case err == nil:
+		case os.IsNotExist(err):
+			info = nil
+		default:
+			return err
+		}
+		switch {
+		case fi.Mode().IsDir():
+			if info == nil {
+				return actuator.Mkdir(targetPath, fi.Mode()&os.ModePerm)
+			}
+			if !info.IsDir() {
+				return errors.Errorf("%s: not a directory", targetPath)
+			}
+			return nil
+		case fi.Mode().IsRegular():
+			contents, err := afero.ReadFile(fs, path)
+			if err != nil {
+				return err
+			}
+			var currentContents []byte
+			switch {
+			case info == nil:
+			case info.IsDir():
+				if err := actuator.RemoveAll(targetPath); err != nil {
+					return err
+				}
+			default:
+				if currentContents, err = afero.ReadFile(fs, targetPath); err != nil {
+					return err
+				}
+				if info.Mode()&os.ModePerm == fi.Mode()&os.ModePerm && bytes.Equal(currentContents, contents) {
+					return nil
+				}
+			}
+			return actuator.WriteFile(targetPath, contents, fi.Mode()&os.ModePerm, currentContents)
+		default:
+			return nil
+		}
+	})
+}
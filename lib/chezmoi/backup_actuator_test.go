@@ -0,0 +1,148 @@
+package chezmoi
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestBackupActuator(t *testing.T) {
+	fsMap := map[string]string{
+		"/home/user/.bashrc":         "bashrc",
+		"/home/user/.config/a/b.txt": "b",
+	}
+	fs, err := absfstesting.MakeMemMapFs(fsMap)
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	backupDir := "/home/user/.chezmoi.backups/20180101T000000Z"
+	a := NewBackupActuator(fs, backupDir, NewFsActuator(fs, "/home/user"))
+	for _, f := range []func() error{
+		func() error { return a.WriteFile("/home/user/.bashrc", []byte("new bashrc"), 0644, []byte("bashrc")) },
+		func() error {
+			return a.WriteFile("/home/user/.bashrc", []byte("newer bashrc"), 0644, []byte("new bashrc"))
+		},
+		func() error { return a.WriteFile("/home/user/.zshrc", []byte("zshrc"), 0644, nil) },
+		func() error { return a.RemoveAll("/home/user/.config") },
+	} {
+		if err := f(); err != nil {
+			t.Fatalf("got %v, want <nil>", err)
+		}
+	}
+	gotFsMap, err := absfstesting.MakeMapFs(fs)
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMapFs(%v) == %v, %v, want !<nil>, <nil>", fs, gotFsMap, err)
+	}
+	wantFsMap := map[string]string{
+		"/home/user/.bashrc": "newer bashrc",
+		"/home/user/.zshrc":  "zshrc",
+		"/home/user/.chezmoi.backups/20180101T000000Z/home/user/.bashrc":         "bashrc",
+		"/home/user/.chezmoi.backups/20180101T000000Z/home/user/.config/a/b.txt": "b",
+	}
+	if diff, equal := messagediff.PrettyDiff(wantFsMap, gotFsMap); !equal {
+		t.Errorf("%s\n", diff)
+	}
+
+	if err := RestoreBackup(fs, backupDir, "/home/user", NewFsActuator(fs, "/home/user")); err != nil {
+		t.Fatalf("RestoreBackup(...) == %v, want <nil>", err)
+	}
+	gotFsMap, err = absfstesting.MakeMapFs(fs)
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMapFs(%v) == %v, %v, want !<nil>, <nil>", fs, gotFsMap, err)
+	}
+	wantFsMap["/home/user/.bashrc"] = "bashrc"
+	wantFsMap["/home/user/.config/a/b.txt"] = "b"
+	if diff, equal := messagediff.PrettyDiff(wantFsMap, gotFsMap); !equal {
+		t.Errorf("%s\n", diff)
+	}
+}
+
+func TestFindAndPruneBackups(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/backups/20180101T000000Z/home/user/.bashrc": "1",
+		"/backups/20180102T000000Z/home/user/.bashrc": "2",
+		"/backups/20180103T000000Z/home/user/.bashrc": "3",
+		"/backups/notabackup/home/user/.bashrc":       "",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	for _, tc := range []struct {
+		at      time.Time
+		want    string
+		wantErr bool
+	}{
+		{at: time.Date(2017, 12, 31, 0, 0, 0, 0, time.UTC), wantErr: true},
+		{at: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), want: "20180101T000000Z"},
+		{at: time.Date(2018, 1, 2, 12, 0, 0, 0, time.UTC), want: "20180102T000000Z"},
+		{at: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), want: "20180103T000000Z"},
+	} {
+		got, err := FindBackup(fs, "/backups", tc.at)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("FindBackup(_, %q, %v) == %q, %v, want %q, wantErr %v", "/backups", tc.at, got, err, tc.want, tc.wantErr)
+		}
+	}
+	if err := PruneBackups(fs, "/backups", 2); err != nil {
+		t.Fatalf("PruneBackups(_, %q, 2) == %v, want <nil>", "/backups", err)
+	}
+	got, err := Backups(fs, "/backups")
+	want := []string{"20180102T000000Z", "20180103T000000Z"}
+	if err != nil {
+		t.Fatalf("Backups(_, %q) == %v, %v, want %v, <nil>", "/backups", got, err, want)
+	}
+	if diff, equal := messagediff.PrettyDiff(want, got); !equal {
+		t.Errorf("%s\n", diff)
+	}
+}
+
+func TestBackupsInSameSecond(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/backups/20180101T000000Z/home/user/.bashrc": "0",
+		"/home/user/.bashrc":                          "1",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	now := time.Date(2018, 1, 1, 0, 0, 0, 100000000, time.UTC)
+	var backupDirs []string
+	for i, at := range []time.Time{now, now, now.Add(time.Millisecond)} {
+		backupDir, err := NewBackupDir(fs, "/backups", at)
+		if err != nil {
+			t.Fatalf("NewBackupDir(_, %q, %v) == _, %v, want _, <nil>", "/backups", at, err)
+		}
+		a := NewBackupActuator(fs, backupDir, NewFsActuator(fs, "/home/user"))
+		contents := []byte(strconv.Itoa(i + 2))
+		if err := a.WriteFile("/home/user/.bashrc", contents, 0644, nil); err != nil {
+			t.Fatalf("a.WriteFile(...) == %v, want <nil>", err)
+		}
+		backupDirs = append(backupDirs, backupDir)
+	}
+	gotFsMap, err := absfstesting.MakeMapFs(fs)
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMapFs(%v) == %v, %v, want !<nil>, <nil>", fs, gotFsMap, err)
+	}
+	wantFsMap := map[string]string{
+		"/backups/20180101T000000Z/home/user/.bashrc":           "0",
+		"/backups/20180101T000000.100000000Z/home/user/.bashrc": "1",
+		"/backups/20180101T000000.100000001Z/home/user/.bashrc": "2",
+		"/backups/20180101T000000.101000000Z/home/user/.bashrc": "3",
+		"/home/user/.bashrc": "4",
+	}
+	if diff, equal := messagediff.PrettyDiff(wantFsMap, gotFsMap); !equal {
+		t.Errorf("backup dirs %v diff:\n%s\n", backupDirs, diff)
+	}
+	gotNames, err := Backups(fs, "/backups")
+	if err != nil {
+		t.Fatalf("Backups(_, %q) == _, %v, want _, <nil>", "/backups", err)
+	}
+	wantNames := []string{"20180101T000000Z", "20180101T000000.100000000Z", "20180101T000000.100000001Z", "20180101T000000.101000000Z"}
+	if diff, equal := messagediff.PrettyDiff(wantNames, gotNames); !equal {
+		t.Errorf("Backups(_, %q) diff:\n%s\n", "/backups", diff)
+	}
+	if got, err := FindBackup(fs, "/backups", now.Add(time.Microsecond)); err != nil || got != "20180101T000000.100000001Z" {
+		t.Errorf("FindBackup(_, %q, _) == %q, %v, want %q, <nil>", "/backups", got, err, "20180101T000000.100000001Z")
+	}
+}
@@ -0,0 +1,182 @@
+package chezmoi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Attribute modifier values.
+const (
+	attributeUnchanged = 0
+	attributeSet       = 1
+	attributeClear     = -1
+)
+
+// AttributeModifiers are changes to the attributes encoded in a source name.
+// Each field is zero if the attribute is unchanged, positive if it is set, and
+// negative if it is cleared.
+type AttributeModifiers struct {
+	Empty      int
+	Executable int
+	Private    int
+	Readonly   int
+	Template   int
+}
+
+// ParseAttributeModifiers parses a comma-separated list of attribute names,
+// each optionally prefixed with "+" to set the attribute, which is the
+// default, or "-" or "no" to clear it, for example "+private,-executable" or
+// "private,noexecutable".
+func ParseAttributeModifiers(s string) (*AttributeModifiers, error) {
+	am := &AttributeModifiers{}
+	for _, modifier := range strings.Split(s, ",") {
+		modifier = strings.TrimSpace(modifier)
+		value := attributeSet
+		switch {
+		case strings.HasPrefix(modifier, "+"):
+			modifier = strings.TrimPrefix(modifier, "+")
+		case strings.HasPrefix(modifier, "-"):
+			modifier = strings.TrimPrefix(modifier, "-")
+			value = attributeClear
+		case strings.HasPrefix(modifier, "no"):
+			modifier = strings.TrimPrefix(modifier, "no")
+			value = attributeClear
+		}
+		switch modifier {
+		case "empty":
+			am.Empty = value
+		case "executable":
+			am.Executable = value
+		case "private":
+			am.Private = value
+		case "readonly":
+			am.Readonly = value
+		case "template":
+			am.Template = value
+		default:
+			return nil, errors.Errorf("%s: unknown attribute", modifier)
+		}
+	}
+	return am, nil
+}
+
+// Chattr changes the attributes of the target targetName by renaming its
+// source file or directory with actuator. Directories only have the private
+// attribute, so changing any other attribute of a directory is an error. The
+// source names of a directory's descendants are updated too. Targets that do
+// not have a source file or directory of their own, such as those populated
+// from an externals file, cannot be changed.
+func (rs *RootState) Chattr(targetName string, am *AttributeModifiers, actuator Actuator) error {
+	var oldSourceName, newSourceName string
+	// update updates the state's attributes once its source has been renamed.
+	var update func()
+	state := rs.Get(targetName)
+	if IsExternal(state) {
+		return errors.Errorf("%s: managed by %s", targetName, state.SourceName())
+	}
+	switch state := state.(type) {
+	case *DirState:
+		if am.Empty != attributeUnchanged || am.Executable != attributeUnchanged || am.Readonly != attributeUnchanged || am.Template != attributeUnchanged {
+			return errors.Errorf("%s: directories only have the private attribute", targetName)
+		}
+		oldSourceName = state.sourceName
+		name, mode := parseDirName(filepath.Base(oldSourceName))
+		if name != filepath.Base(targetName) {
+			return errors.Errorf("%s: not the source of %s", oldSourceName, targetName)
+		}
+		mode = am.modifyMode(mode, false)
+		newSourceName = filepath.Join(filepath.Dir(oldSourceName), makeDirName(name, mode))
+		update = func() {
+			state.Mode = mode
+			state.setSourceName(newSourceName)
+		}
+	case *FileState:
+		oldSourceName = state.sourceName
+		fa := parseFileName(filepath.Base(oldSourceName))
+		if fa.name != filepath.Base(targetName) {
+			return errors.Errorf("%s: not the source of %s", oldSourceName, targetName)
+		}
+		mode := am.modifyMode(fa.mode, true)
+		if state.exactMode && mode != fa.mode {
+			return errors.Errorf("%s: mode is set in %s", targetName, attributesFileName)
+		}
+		fa.mode = mode
+		fa.isEmpty = am.modifyBool(fa.isEmpty, am.Empty)
+		fa.isTemplate = am.modifyBool(fa.isTemplate, am.Template)
+		newSourceName = filepath.Join(filepath.Dir(oldSourceName), makeFileName(fa))
+		update = func() {
+			state.sourceName = newSourceName
+			state.Mode = fa.mode
+			state.Empty = fa.isEmpty
+		}
+	default:
+		return errors.Errorf("%s: not found", targetName)
+	}
+	if newSourceName == oldSourceName {
+		return nil
+	}
+	if err := actuator.Rename(filepath.Join(rs.SourceDir, oldSourceName), filepath.Join(rs.SourceDir, newSourceName)); err != nil {
+		return err
+	}
+	update()
+	return nil
+}
+
+// modifyBool returns value with modifier applied.
+func (am *AttributeModifiers) modifyBool(value bool, modifier int) bool {
+	switch {
+	case modifier > attributeUnchanged:
+		return true
+	case modifier < attributeUnchanged:
+		return false
+	default:
+		return value
+	}
+}
+
+// modifyMode returns mode, the mode encoded in a source name, with am's
+// changes to the private, and, for files, executable and readonly attributes
+// applied.
+func (am *AttributeModifiers) modifyMode(mode os.FileMode, isFile bool) os.FileMode {
+	private := am.modifyBool(mode&077 == 0, am.Private)
+	executable := mode&0111 != 0
+	readonly := false
+	newMode := os.FileMode(0777)
+	if isFile {
+		executable = am.modifyBool(executable, am.Executable)
+		readonly = am.modifyBool(mode&0222 == 0, am.Readonly)
+		newMode = 0666
+		if executable {
+			newMode |= 0111
+		}
+	}
+	if private {
+		newMode &= 0700
+	}
+	if readonly {
+		newMode &^= 0222
+	}
+	return newMode
+}
+
+// setSourceName sets the source name of ds to sourceName and updates the
+// source names of all of its descendants, except those populated from an
+// externals file.
+func (ds *DirState) setSourceName(sourceName string) {
+	ds.sourceName = sourceName
+	for _, fileState := range ds.Files {
+		if fileState.external {
+			continue
+		}
+		fileState.sourceName = filepath.Join(sourceName, filepath.Base(fileState.sourceName))
+	}
+	for _, dirState := range ds.Dirs {
+		if dirState.external {
+			continue
+		}
+		dirState.setSourceName(filepath.Join(sourceName, filepath.Base(dirState.sourceName)))
+	}
+}
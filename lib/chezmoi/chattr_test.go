@@ -0,0 +1,256 @@
+package chezmoi
+
+import (
+	"testing"
+
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestParseAttributeModifiers(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    *AttributeModifiers
+		wantErr bool
+	}{
+		{s: "private", want: &AttributeModifiers{Private: 1}},
+		{s: "+private,-executable", want: &AttributeModifiers{Private: 1, Executable: -1}},
+		{s: "empty, notemplate ,+readonly", want: &AttributeModifiers{Empty: 1, Template: -1, Readonly: 1}},
+		{s: "+symlink", wantErr: true},
+		{s: "", wantErr: true},
+	} {
+		got, err := ParseAttributeModifiers(tc.s)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseAttributeModifiers(%q) == %+v, <nil>, want _, !<nil>", tc.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAttributeModifiers(%q) == _, %v, want _, <nil>", tc.s, err)
+			continue
+		}
+		if diff, equal := messagediff.PrettyDiff(tc.want, got); !equal {
+			t.Errorf("ParseAttributeModifiers(%q) diff:\n%s\n", tc.s, diff)
+		}
+	}
+}
+
+func TestChattr(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		fsMap      map[string]string
+		targetName string
+		modifiers  string
+		wantErr    bool
+		wantFsMap  map[string]string
+	}{
+		{
+			name: "private_template",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/dot_bashrc": "bar",
+			},
+			targetName: ".bashrc",
+			modifiers:  "+private,+template",
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/private_dot_bashrc.tmpl": "bar",
+			},
+		},
+		{
+			name: "clear",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/bin/private_readonly_empty_executable_run.tmpl": "",
+			},
+			targetName: "bin/run",
+			modifiers:  "-private,-readonly,-empty,-executable,-template",
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/bin/run": "",
+			},
+		},
+		{
+			name: "keep_prefixes",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/modify_dot_config": "#!/bin/sh\n",
+			},
+			targetName: ".config",
+			modifiers:  "executable",
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/modify_executable_dot_config": "#!/bin/sh\n",
+			},
+		},
+		{
+			name: "unchanged",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/private_dot_netrc": "secret",
+			},
+			targetName: ".netrc",
+			modifiers:  "private",
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/private_dot_netrc": "secret",
+			},
+		},
+		{
+			name: "exact_mode",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiattributes": ".foo 0640\n",
+				"/home/user/.chezmoi/dot_foo":            "foo",
+			},
+			targetName: ".foo",
+			modifiers:  "private",
+			wantErr:    true,
+		},
+		{
+			name: "external",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiexternal.yaml": ".local/bin/tool:\n  type: file\n  url: /tmp/tool\n",
+				"/tmp/tool": "#!/bin/sh\n",
+			},
+			targetName: ".local/bin/tool",
+			modifiers:  "executable",
+			wantErr:    true,
+		},
+		{
+			name: "external_parent_dir",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiexternal.yaml": ".local/bin/tool:\n  type: file\n  url: /tmp/tool\n",
+				"/tmp/tool": "#!/bin/sh\n",
+			},
+			targetName: ".local",
+			modifiers:  "private",
+			wantErr:    true,
+		},
+		{
+			name: "not_found",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/dot_bashrc": "bar",
+			},
+			targetName: ".zshrc",
+			modifiers:  "private",
+			wantErr:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(tc.fsMap)
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(%v) == %v, %v, want !<nil>, <nil>", tc.fsMap, fs, err)
+			}
+			rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+			if err := rs.Populate(fs); err != nil {
+				t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+			}
+			am, err := ParseAttributeModifiers(tc.modifiers)
+			if err != nil {
+				t.Fatalf("ParseAttributeModifiers(%q) == _, %v, want _, <nil>", tc.modifiers, err)
+			}
+			err = rs.Chattr(tc.targetName, am, NewFsActuator(fs, "/home/user"))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("rs.Chattr(%q, _, _) == <nil>, want !<nil>", tc.targetName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rs.Chattr(%q, _, _) == %v, want <nil>", tc.targetName, err)
+			}
+			gotFsMap, err := absfstesting.MakeMapFs(fs)
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMapFs(_) == %v, %v, want !<nil>, <nil>", gotFsMap, err)
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.wantFsMap, gotFsMap); !equal {
+				t.Errorf("rs.Chattr(%q, _, _) diff:\n%s\n", tc.targetName, diff)
+			}
+		})
+	}
+}
+
+func TestChattrDir(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/dot_ssh/config":          "Host *\n",
+		"/home/user/.chezmoi/dot_ssh/keys/private_id": "key",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	// Attributes other than private do not apply to directories.
+	for _, am := range []*AttributeModifiers{
+		{Private: 1, Executable: 1},
+		{Empty: 1},
+		{Readonly: 1},
+		{Template: -1},
+	} {
+		if err := rs.Chattr(".ssh", am, &recordingActuator{}); err == nil {
+			t.Errorf("rs.Chattr(\".ssh\", %+v, _) == <nil>, want !<nil>", am)
+		}
+	}
+	a := &recordingActuator{}
+	if err := rs.Chattr(".ssh", &AttributeModifiers{Private: 1}, a); err != nil {
+		t.Fatalf("rs.Chattr(\".ssh\", _, _) == %v, want <nil>", err)
+	}
+	wantActions := []string{"mv /home/user/.chezmoi/dot_ssh /home/user/.chezmoi/private_dot_ssh"}
+	if diff, equal := messagediff.PrettyDiff(wantActions, a.actions); !equal {
+		t.Errorf("rs.Chattr(\".ssh\", _, _) actions diff:\n%s\n", diff)
+	}
+	wantSourceNames := map[string]string{
+		".ssh":         "private_dot_ssh",
+		".ssh/config":  "private_dot_ssh/config",
+		".ssh/keys":    "private_dot_ssh/keys",
+		".ssh/keys/id": "private_dot_ssh/keys/private_id",
+	}
+	gotSourceNames := make(map[string]string)
+	for targetName, state := range rs.AllStates() {
+		gotSourceNames[targetName] = state.SourceName()
+	}
+	if diff, equal := messagediff.PrettyDiff(wantSourceNames, gotSourceNames); !equal {
+		t.Errorf("rs.Chattr(\".ssh\", _, _) source names diff:\n%s\n", diff)
+	}
+	if mode := rs.Dirs[".ssh"].Mode; mode != 0700 {
+		t.Errorf("rs.Dirs[\".ssh\"].Mode == %o, want 700", mode)
+	}
+}
+
+func TestChattrDirWithExternal(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/.chezmoiexternal.yaml": ".local/bin/tool:\n  type: file\n  url: /tmp/tool\n",
+		"/home/user/.chezmoi/dot_local/dot_profile": "",
+		"/tmp/tool": "#!/bin/sh\n",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	if err := rs.Chattr(".local", &AttributeModifiers{Private: 1}, &recordingActuator{}); err != nil {
+		t.Fatalf("rs.Chattr(\".local\", _, _) == %v, want <nil>", err)
+	}
+	wantSourceNames := map[string]string{
+		".local":          "private_dot_local",
+		".local/.profile": "private_dot_local/dot_profile",
+		".local/bin":      ".chezmoiexternal.yaml",
+		".local/bin/tool": ".chezmoiexternal.yaml",
+	}
+	gotSourceNames := make(map[string]string)
+	for targetName, state := range rs.AllStates() {
+		gotSourceNames[targetName] = state.SourceName()
+	}
+	if diff, equal := messagediff.PrettyDiff(wantSourceNames, gotSourceNames); !equal {
+		t.Errorf("rs.Chattr(\".local\", _, _) source names diff:\n%s\n", diff)
+	}
+}
+
+func TestChattrNotSource(t *testing.T) {
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	rs.Files[".foo"] = &FileState{sourceName: ".chezmoiignore", Mode: 0666}
+	a := &recordingActuator{}
+	if err := rs.Chattr(".foo", &AttributeModifiers{Private: 1}, a); err == nil {
+		t.Errorf("rs.Chattr(\".foo\", _, _) == <nil>, want !<nil>")
+	}
+	if len(a.actions) != 0 {
+		t.Errorf("rs.Chattr(\".foo\", _, _) actions == %v, want none", a.actions)
+	}
+}
@@ -1,59 +1,180 @@
 package chezmoi
 
 import (
-	"archive/tar"
 	"bytes"
+	"fmt"
 	"os"
-	"os/user"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"syscall"
-	"text/template"
-	"time"
 
 	"github.com/absfs/afero"
 	"github.com/pkg/errors"
 )
 
 const (
+	createPrefix     = "create_"
+	modifyPrefix     = "modify_"
+	removePrefix     = "remove_"
 	privatePrefix    = "private_"
+	readonlyPrefix   = "readonly_"
 	emptyPrefix      = "empty_"
 	executablePrefix = "executable_"
 	dotPrefix        = "dot_"
+	literalPrefix    = "literal_"
 	templateSuffix   = ".tmpl"
+	literalSuffix    = ".literal"
 )
 
-// A Stater is either a DirState or a FileState.
+// A Stater is a DirState, a FileState, or a RemoveState.
 type Stater interface {
 	SourceName() string
 }
 
-// A FileState represents the target state of a file.
+// A FileState represents the target state of a file. If Create is true then
+// its contents are only written if the target does not already exist or is
+// empty. If Modify is true then its contents are a script that transforms the
+// current contents of the target into the desired contents. Contents are
+// computed lazily, see Contents.
 type FileState struct {
 	sourceName string
+	exactMode  bool
+	external   bool
 	Empty      bool
+	Create     bool
+	Modify     bool
 	Mode       os.FileMode
-	Contents   []byte
+	contents   *lazyContents
 }
 
 // A DirState represents the target state of a directory.
 type DirState struct {
 	sourceName string
+	exactMode  bool
+	external   bool
 	Mode       os.FileMode
 	Dirs       map[string]*DirState
 	Files      map[string]*FileState
 }
 
+// fileAttributes holds the attributes of a file encoded in its source name.
+type fileAttributes struct {
+	name       string
+	mode       os.FileMode
+	isCreate   bool
+	isEmpty    bool
+	isModify   bool
+	isRemove   bool
+	isTemplate bool
+}
+
 // A RootState represents the root target state.
 type RootState struct {
-	TargetDir string
-	Umask     os.FileMode
-	SourceDir string
-	Data      map[string]interface{}
-	Dirs      map[string]*DirState
-	Files     map[string]*FileState
+	TargetDir       string
+	Umask           os.FileMode
+	SourceDir       string
+	Data            map[string]interface{}
+	TemplateOptions []string
+	// Parallelism is the maximum number of files that Apply reads and
+	// executes concurrently. Values less than two mean no concurrency.
+	Parallelism int
+	// KeepGoing, if true, causes Populate to record errors instead of
+	// returning them, and Apply to continue with all other targets after an
+	// error. Apply then returns a MultiError of all errors.
+	KeepGoing bool
+	// CacheDir is the directory in which externals are cached. If it is
+	// empty then remote files and archives are fetched every time and git
+	// repositories cannot be used.
+	CacheDir string
+	// FetchExternals, if true, causes Populate to download, clone, and pull
+	// externals. Otherwise archives and git repositories are only read from
+	// CacheDir, and are empty if they have not been fetched yet. Files are
+	// always fetched when their contents are first needed.
+	FetchExternals bool
+	// Layers, if not empty, are the RootStates that were merged to create
+	// this RootState, in increasing order of precedence. See MergeLayers.
+	Layers  []*RootState
+	Dirs    map[string]*DirState
+	Files   map[string]*FileState
+	Removes []*RemoveState
+	// Warnings are problems found by Populate that do not prevent the target
+	// state from being used.
+	Warnings       []string
+	populateErrors []error
+}
+
+// An applyStep is a directory or file to be applied.
+type applyStep struct {
+	targetPath string
+	dirState   *DirState
+	fileState  *FileState
+	plan       *filePlan
+}
+
+// A filePlan is the current state of a target file and the contents that a
+// FileState would write to it.
+type filePlan struct {
+	fi              os.FileInfo
+	statErr         error
+	remove          bool
+	inSync          bool
+	currentContents []byte
+	contents        []byte
+	err             error
+}
+
+// AddOptions are options to RootState.Add.
+type AddOptions struct {
+	Empty        bool
+	Template     bool
+	AutoTemplate AutoTemplateOptions
+	// Substitutions, if not nil, is called with the substitutions made when
+	// adding each file as a template.
+	Substitutions func(targetPath string, substitutions []Substitution)
+}
+
+// ApplyOptions are options to RootState.Apply.
+type ApplyOptions struct {
+	// ConfirmRemove, if not nil, is called before removing each target that
+	// should not exist. The target is only removed if it returns true.
+	ConfirmRemove func(targetPath string) (bool, error)
+	// State, if not nil, records targets that are known to be in sync so that
+	// they are not read again while they are unchanged.
+	State *StateStore
+	// TargetNames, if not empty, restricts Apply to the given targets and
+	// their descendants. The parent directories of the given targets are
+	// applied too so that the targets can be created.
+	TargetNames []string
+	// VerifyContents, if true, causes the contents of all targets to be
+	// compared, even if State records them as being in sync.
+	VerifyContents bool
+	// ReadCurrentContents, if true, causes the current contents of targets
+	// that are overwritten to be read and passed to the actuator, for example
+	// so that it can print a diff. Otherwise they are only read when needed
+	// to compute the new contents.
+	ReadCurrentContents bool
+}
+
+// includes returns true if targetPath in targetDir is selected by o. If
+// parents is true then the parent directories of selected targets are also
+// included.
+func (o ApplyOptions) includes(targetDir, targetPath string, parents bool) bool {
+	if len(o.TargetNames) == 0 {
+		return true
+	}
+	for _, targetName := range o.TargetNames {
+		selectedPath := filepath.Join(targetDir, targetName)
+		switch {
+		case targetPath == selectedPath:
+			return true
+		case strings.HasPrefix(targetPath, selectedPath+string(filepath.Separator)):
+			return true
+		case parents && strings.HasPrefix(selectedPath, targetPath+string(filepath.Separator)):
+			return true
+		}
+	}
+	return false
 }
 
 // newDirState returns a new directory state.
@@ -77,37 +198,30 @@ func (ds *DirState) allStates(result map[string]Stater, dirName string) {
 	}
 }
 
-// archive writes ds to w.
-func (ds *DirState) archive(w *tar.Writer, dirName string, headerTemplate *tar.Header, umask os.FileMode) error {
-	header := *headerTemplate
-	header.Typeflag = tar.TypeDir
-	header.Name = dirName
-	header.Mode = int64(ds.Mode &^ umask & os.ModePerm)
-	if err := w.WriteHeader(&header); err != nil {
-		return err
-	}
-	for _, fileName := range sortedFileNames(ds.Files) {
-		if err := ds.Files[fileName].archive(w, filepath.Join(dirName, fileName), headerTemplate, umask); err != nil {
-			return err
-		}
-	}
-	for _, subDirName := range sortedDirNames(ds.Dirs) {
-		if err := ds.Dirs[subDirName].archive(w, filepath.Join(dirName, subDirName), headerTemplate, umask); err != nil {
-			return err
-		}
+// apply ensures that targetDir in fs is a directory with ds's permissions.
+// ds's files and subdirectories are applied separately, see
+// appendApplySteps. If ds's permissions do not allow its owner to change its
+// entries then they are recorded in rd, and the directory is only made
+// read-only once its contents have been applied.
+func (ds *DirState) apply(fs afero.Fs, targetDir string, umask os.FileMode, actuator Actuator, rd *readonlyDirs) error {
+	mode := ds.targetMode(umask)
+	writable := isWritableDirMode(mode)
+	if !writable {
+		rd.modes[targetDir] = mode
 	}
-	return nil
-}
-
-// apply ensures that targetDir in fs matches ds.
-func (ds *DirState) apply(fs afero.Fs, targetDir string, umask os.FileMode, actuator Actuator) error {
 	fi, err := fs.Stat(targetDir)
 	switch {
 	case err == nil && fi.Mode().IsDir():
-		if fi.Mode()&os.ModePerm != ds.Mode&^umask {
-			if err := actuator.Chmod(targetDir, ds.Mode&^umask); err != nil {
+		switch perm := fi.Mode() & os.ModePerm; {
+		case perm == mode:
+		case writable:
+			if err := actuator.Chmod(targetDir, mode); err != nil {
 				return err
 			}
+		case isWritableDirMode(perm):
+			rd.postpone(targetDir)
+		default:
+			return rd.unlock(actuator, targetDir)
 		}
 	case err == nil:
 		if err := actuator.RemoveAll(targetDir); err != nil {
@@ -115,23 +229,29 @@ func (ds *DirState) apply(fs afero.Fs, targetDir string, umask os.FileMode, actu
 		}
 		fallthrough
 	case os.IsNotExist(err):
-		if err := actuator.Mkdir(targetDir, ds.Mode&^umask); err != nil {
+		if err := actuator.Mkdir(targetDir, mode|writableDirMode); err != nil {
 			return err
 		}
+		if !writable {
+			rd.postpone(targetDir)
+		}
 	default:
 		return err
 	}
+	return nil
+}
+
+// appendApplySteps appends the steps to apply ds to targetDir to steps, in
+// the order that they must be applied.
+func (ds *DirState) appendApplySteps(steps []*applyStep, targetDir string) []*applyStep {
+	steps = append(steps, &applyStep{targetPath: targetDir, dirState: ds})
 	for _, fileName := range sortedFileNames(ds.Files) {
-		if err := ds.Files[fileName].apply(fs, filepath.Join(targetDir, fileName), umask, actuator); err != nil {
-			return err
-		}
+		steps = append(steps, &applyStep{targetPath: filepath.Join(targetDir, fileName), fileState: ds.Files[fileName]})
 	}
 	for _, dirName := range sortedDirNames(ds.Dirs) {
-		if err := ds.Dirs[dirName].apply(fs, filepath.Join(targetDir, dirName), umask, actuator); err != nil {
-			return err
-		}
+		steps = ds.Dirs[dirName].appendApplySteps(steps, filepath.Join(targetDir, dirName))
 	}
-	return nil
+	return steps
 }
 
 // SourceName implements Stater.SourceName.
@@ -139,57 +259,174 @@ func (ds *DirState) SourceName() string {
 	return ds.sourceName
 }
 
-// archive writes fs to w.
-func (fs *FileState) archive(w *tar.Writer, fileName string, headerTemplate *tar.Header, umask os.FileMode) error {
-	if len(fs.Contents) == 0 && !fs.Empty {
-		return nil
+// targetMode returns the permissions of the target directory. umask is not
+// applied to modes set explicitly in the attributes file.
+func (ds *DirState) targetMode(umask os.FileMode) os.FileMode {
+	if ds.exactMode {
+		return ds.Mode & os.ModePerm
 	}
-	header := *headerTemplate
-	header.Typeflag = tar.TypeReg
-	header.Name = fileName
-	header.Size = int64(len(fs.Contents))
-	header.Mode = int64(fs.Mode &^ umask)
-	if err := w.WriteHeader(&header); err != nil {
-		return nil
+	return ds.Mode &^ umask & os.ModePerm
+}
+
+// plan returns the current state of targetPath in fileSystem and the contents
+// that fs would write to it. It does not make any changes, so plans for
+// different targets can be computed concurrently.
+func (fs *FileState) plan(fileSystem afero.Fs, targetPath string, applyOptions ApplyOptions) *filePlan {
+	p := &filePlan{}
+	p.fi, p.statErr = fileSystem.Stat(targetPath)
+	switch {
+	case p.statErr == nil && p.fi.Mode().IsRegular():
+		p.remove, p.err = fs.isRemove()
+		if p.err != nil || p.remove {
+			return p
+		}
+		switch {
+		case fs.Create && p.fi.Size() > 0:
+			p.inSync = true
+			return p
+		case !fs.Create && !fs.Modify:
+			p.inSync, p.err = fs.inSync(fileSystem, targetPath, p.fi, applyOptions)
+			if p.err != nil || p.inSync {
+				return p
+			}
+		}
+		// Avoid reading and buffering the whole target unless its current
+		// contents are really needed.
+		if fs.Modify || (applyOptions.ReadCurrentContents && p.fi.Size() > 0) {
+			p.currentContents, p.err = afero.ReadFile(fileSystem, targetPath)
+			if p.err != nil {
+				return p
+			}
+		}
+		p.contents, p.err = fs.targetContents(targetPath, p.currentContents)
+	case p.statErr == nil || os.IsNotExist(p.statErr):
+		p.contents, p.err = fs.targetContents(targetPath, nil)
 	}
-	_, err := w.Write(fs.Contents)
-	return err
+	return p
 }
 
-// apply ensures that state of targetPath in fs matches fileState.
-func (fs *FileState) apply(fileSystem afero.Fs, targetPath string, umask os.FileMode, actuator Actuator) error {
-	fi, err := fileSystem.Stat(targetPath)
-	var currentContents []byte
+// inSync returns true if the regular file at targetPath in fileSystem, with
+// info fi, already has fs's contents. It checks applyOptions.State and the
+// size of the file before reading the file, in chunks.
+func (fs *FileState) inSync(fileSystem afero.Fs, targetPath string, fi os.FileInfo, applyOptions ApplyOptions) (bool, error) {
+	contents, err := fs.Contents()
+	if err != nil {
+		return false, err
+	}
+	if applyOptions.State != nil && !applyOptions.VerifyContents && applyOptions.State.inSync(targetPath, fi, contents) {
+		return true, nil
+	}
+	if fi.Size() != int64(len(contents)) {
+		return false, nil
+	}
+	equal, err := fileContentsEqual(fileSystem, targetPath, contents)
+	if err != nil || !equal {
+		return false, err
+	}
+	if applyOptions.State != nil {
+		applyOptions.State.record(targetPath, fi, contents)
+	}
+	return true, nil
+}
+
+// applyPlan makes the changes to targetPath needed by p.
+func (fs *FileState) applyPlan(p *filePlan, targetPath string, umask os.FileMode, actuator Actuator) error {
 	switch {
-	case err == nil && fi.Mode().IsRegular():
-		if len(fs.Contents) == 0 && !fs.Empty {
-			return actuator.RemoveAll(targetPath)
+	case p.statErr == nil && p.fi.Mode().IsRegular():
+		if p.err != nil {
+			return p.err
 		}
-		currentContents, err := afero.ReadFile(fileSystem, targetPath)
-		if err != nil {
-			return err
+		if p.remove {
+			return actuator.RemoveAll(targetPath)
 		}
-		if !bytes.Equal(currentContents, fs.Contents) {
-			break
+		if !p.inSync {
+			if len(p.contents) == 0 && !fs.Empty && !fs.Create {
+				return actuator.RemoveAll(targetPath)
+			}
+			if !bytes.Equal(p.currentContents, p.contents) {
+				return actuator.WriteFile(targetPath, p.contents, fs.targetMode(umask), p.currentContents)
+			}
 		}
-		if fi.Mode()&os.ModePerm != fs.Mode&^umask {
-			if err := actuator.Chmod(targetPath, fs.Mode&^umask); err != nil {
+		if p.fi.Mode()&os.ModePerm != fs.targetMode(umask) {
+			if err := actuator.Chmod(targetPath, fs.targetMode(umask)); err != nil {
 				return err
 			}
 		}
 		return nil
-	case err == nil:
+	case p.statErr != nil && !os.IsNotExist(p.statErr):
+		return p.statErr
+	}
+	// Check for errors before replacing whatever is at targetPath.
+	if p.err != nil {
+		return p.err
+	}
+	if p.statErr == nil {
 		if err := actuator.RemoveAll(targetPath); err != nil {
 			return err
 		}
-	case os.IsNotExist(err):
-	default:
-		return err
 	}
-	if len(fs.Contents) == 0 && !fs.Empty {
+	if len(p.contents) == 0 && !fs.Empty {
 		return nil
 	}
-	return actuator.WriteFile(targetPath, fs.Contents, fs.Mode&^umask, currentContents)
+	return actuator.WriteFile(targetPath, p.contents, fs.targetMode(umask), nil)
+}
+
+// isRemove returns true if fs removes its target, i.e. it is an empty file
+// that is not explicitly empty, created, or modified.
+func (fs *FileState) isRemove() (bool, error) {
+	if fs.Empty || fs.Create || fs.Modify {
+		return false, nil
+	}
+	contents, err := fs.Contents()
+	if err != nil {
+		return false, err
+	}
+	return len(contents) == 0, nil
+}
+
+// Contents returns fs's contents, reading and executing its source file the
+// first time that it is called.
+func (fs *FileState) Contents() ([]byte, error) {
+	return fs.contents.Contents()
+}
+
+// targetMode returns the permissions of the target file. umask is not applied
+// to modes set explicitly in the attributes file.
+func (fs *FileState) targetMode(umask os.FileMode) os.FileMode {
+	if fs.exactMode {
+		return fs.Mode & os.ModePerm
+	}
+	return fs.Mode &^ umask & os.ModePerm
+}
+
+// TargetContents returns the contents that fs would write to targetPath in
+// fileSystem.
+func (fs *FileState) TargetContents(fileSystem afero.Fs, targetPath string) ([]byte, error) {
+	if !fs.Create && !fs.Modify {
+		return fs.Contents()
+	}
+	currentContents, err := afero.ReadFile(fileSystem, targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return fs.targetContents(targetPath, currentContents)
+}
+
+// targetContents returns the contents that fs would write to targetPath given
+// its current contents.
+func (fs *FileState) targetContents(targetPath string, currentContents []byte) ([]byte, error) {
+	if fs.Create && len(currentContents) != 0 {
+		return currentContents, nil
+	}
+	script, err := fs.Contents()
+	if err != nil || !fs.Modify {
+		return script, err
+	}
+	contents, err := runModifyScript(script, currentContents)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: %s", fs.sourceName, targetPath)
+	}
+	return contents, nil
 }
 
 // SourceName implements Stater.SourceName.
@@ -210,7 +447,7 @@ func NewRootState(targetDir string, umask os.FileMode, sourceDir string, data ma
 }
 
 // Add adds a new target.
-func (rs *RootState) Add(fs afero.Fs, target string, fi os.FileInfo, addEmpty, addTemplate bool, actuator Actuator) error {
+func (rs *RootState) Add(fs afero.Fs, addOptions AddOptions, target string, fi os.FileInfo, actuator Actuator) error {
 	if !filepath.HasPrefix(target, rs.TargetDir) {
 		return errors.Errorf("%s: outside target directory", target)
 	}
@@ -227,15 +464,29 @@ func (rs *RootState) Add(fs afero.Fs, target string, fi os.FileInfo, addEmpty, a
 	}
 
 	// Add the parent directory, if needed.
+	if parentDirName := filepath.Dir(targetName); parentDirName != "." && rs.findDirState(parentDirName) == nil {
+		if err := rs.Add(fs, AddOptions{}, filepath.Join(rs.TargetDir, parentDirName), nil, actuator); err != nil {
+			return err
+		}
+	}
+
+	return rs.add(fs, addOptions, targetName, fi, func() ([]byte, error) {
+		return afero.ReadFile(fs, target)
+	}, actuator)
+}
+
+// add adds targetName, with info fi, whose parent directory must already have
+// been added. readContents returns the contents of a regular file.
+func (rs *RootState) add(fs afero.Fs, addOptions AddOptions, targetName string, fi os.FileInfo, readContents func() ([]byte, error), actuator Actuator) error {
 	dirSourceName := ""
 	dirs, files := rs.Dirs, rs.Files
 	if parentDirName := filepath.Dir(targetName); parentDirName != "." {
 		dirState := rs.findDirState(parentDirName)
 		if dirState == nil {
-			if err := rs.Add(fs, filepath.Join(rs.TargetDir, parentDirName), nil, false, false, actuator); err != nil {
-				return err
-			}
-			dirState = rs.findDirState(parentDirName)
+			return errors.Errorf("%s: parent directory not added", targetName)
+		}
+		if dirState.external {
+			return errors.Errorf("%s: parent directory managed by %s", targetName, dirState.sourceName)
 		}
 		dirSourceName = dirState.sourceName
 		dirs, files = dirState.Dirs, dirState.Files
@@ -250,28 +501,50 @@ func (rs *RootState) Add(fs afero.Fs, target string, fi os.FileInfo, addEmpty, a
 		if _, ok := dirs[name]; ok {
 			return errors.Errorf("%s: already added as a directory", targetName)
 		}
-		if fi.Size() == 0 && !addEmpty {
+		if fi.Size() == 0 && !addOptions.Empty {
 			return nil
 		}
-		sourceName := makeFileName(name, fi.Mode(), fi.Size() == 0, addTemplate)
+		sourceName := makeFileName(fileAttributes{
+			name:       name,
+			mode:       fi.Mode(),
+			isEmpty:    fi.Size() == 0,
+			isTemplate: addOptions.Template,
+		})
+		// If the source name cannot represent the file's permissions, ignoring
+		// those removed by the umask, then record them in the attributes file.
+		exactMode := parseFileName(sourceName).mode&^rs.Umask != fi.Mode()&os.ModePerm&^rs.Umask
+		if exactMode {
+			if err := rs.addAttribute(fs, targetName, fi.Mode(), actuator); err != nil {
+				return err
+			}
+		}
 		if dirSourceName != "" {
 			sourceName = filepath.Join(dirSourceName, sourceName)
 		}
-		contents, err := afero.ReadFile(fs, target)
+		contents, err := readContents()
 		if err != nil {
 			return err
 		}
-		if addTemplate {
-			contents = autoTemplate(contents, rs.Data)
+		if addOptions.Template {
+			autoTemplateOptions := addOptions.AutoTemplate
+			if autoTemplateOptions.Format == AutoTemplateFormatAuto {
+				autoTemplateOptions.Format = autoTemplateFormat(name)
+			}
+			var substitutions []Substitution
+			contents, substitutions = autoTemplate(contents, rs.Data, autoTemplateOptions)
+			if addOptions.Substitutions != nil {
+				addOptions.Substitutions(filepath.Join(rs.TargetDir, targetName), substitutions)
+			}
 		}
 		if err := actuator.WriteFile(filepath.Join(rs.SourceDir, sourceName), contents, 0666&^rs.Umask, nil); err != nil {
 			return err
 		}
 		files[name] = &FileState{
 			sourceName: sourceName,
+			exactMode:  exactMode,
 			Empty:      len(contents) == 0,
 			Mode:       fi.Mode(),
-			Contents:   contents,
+			contents:   newLazyContents(contents),
 		}
 	case fi.Mode().IsDir():
 		if _, ok := dirs[name]; ok {
@@ -281,6 +554,13 @@ func (rs *RootState) Add(fs afero.Fs, target string, fi os.FileInfo, addEmpty, a
 			return errors.Errorf("%s: already added as a file", targetName)
 		}
 		sourceName := makeDirName(name, fi.Mode())
+		_, sourceMode := parseDirName(sourceName)
+		exactMode := sourceMode&^rs.Umask != fi.Mode()&os.ModePerm&^rs.Umask
+		if exactMode {
+			if err := rs.addAttribute(fs, targetName, fi.Mode(), actuator); err != nil {
+				return err
+			}
+		}
 		if dirSourceName != "" {
 			sourceName = filepath.Join(dirSourceName, sourceName)
 		}
@@ -295,17 +575,24 @@ func (rs *RootState) Add(fs afero.Fs, target string, fi os.FileInfo, addEmpty, a
 				return err
 			}
 		}
-		dirs[name] = newDirState(sourceName, fi.Mode())
+		dirState := newDirState(sourceName, fi.Mode())
+		dirState.exactMode = exactMode
+		dirs[name] = dirState
 	default:
 		return errors.Errorf("%s: not a regular file or directory", targetName)
 	}
 	return nil
 }
 
-// AllStates returns a map from names to the *DirState or *FileState for that
-// name.
+// AllStates returns a map from names to the *DirState, *FileState, or
+// *RemoveState for that name. Patterns in the remove file are not included.
 func (rs *RootState) AllStates() map[string]Stater {
 	result := make(map[string]Stater)
+	for _, rms := range rs.Removes {
+		if !rms.Pattern {
+			result[rms.Name] = rms
+		}
+	}
 	for fileName, fileState := range rs.Files {
 		result[fileName] = fileState
 	}
@@ -316,60 +603,89 @@ func (rs *RootState) AllStates() map[string]Stater {
 	return result
 }
 
-// Archive writes rs to w.
-func (rs *RootState) Archive(w *tar.Writer, umask os.FileMode) error {
-	currentUser, err := user.Current()
-	if err != nil {
-		return err
+// Apply uses actuator to make rs.TargetDir in fs match rs, and then removes the
+// targets matched by rs.Removes that rs does not contain, restricted to
+// applyOptions.TargetNames if it is not empty. Directories that are made
+// writable so that their entries can be changed are made read-only again
+// afterwards. If rs.KeepGoing is true then errors, including those recorded
+// by Populate, are collected and returned together as a MultiError, otherwise
+// the first error is returned. If rs.Parallelism is greater than one then
+// source files are read and executed, and the current state of targets is
+// read and compared, concurrently, but actuator is always called in the same
+// order.
+func (rs *RootState) Apply(fs afero.Fs, applyOptions ApplyOptions, actuator Actuator) error {
+	var steps []*applyStep
+	for _, fileName := range sortedFileNames(rs.Files) {
+		steps = append(steps, &applyStep{targetPath: filepath.Join(rs.TargetDir, fileName), fileState: rs.Files[fileName]})
 	}
-	uid, err := strconv.Atoi(currentUser.Uid)
-	if err != nil {
-		return err
+	for _, dirName := range sortedDirNames(rs.Dirs) {
+		steps = rs.Dirs[dirName].appendApplySteps(steps, filepath.Join(rs.TargetDir, dirName))
 	}
-	gid, err := strconv.Atoi(currentUser.Gid)
-	if err != nil {
-		return err
+	if len(applyOptions.TargetNames) != 0 {
+		var selectedSteps []*applyStep
+		for _, step := range steps {
+			if applyOptions.includes(rs.TargetDir, step.targetPath, step.dirState != nil) {
+				selectedSteps = append(selectedSteps, step)
+			}
+		}
+		steps = selectedSteps
 	}
-	group, err := user.LookupGroupId(currentUser.Gid)
-	if err != nil {
-		return err
+	if rs.Parallelism > 1 {
+		forEachParallel(len(steps), rs.Parallelism, func(i int) {
+			if step := steps[i]; step.fileState != nil {
+				step.plan = step.fileState.plan(fs, step.targetPath, applyOptions)
+			}
+		})
 	}
-	now := time.Now()
-	headerTemplate := tar.Header{
-		Uid:        uid,
-		Gid:        gid,
-		Uname:      currentUser.Username,
-		Gname:      group.Name,
-		ModTime:    now,
-		AccessTime: now,
-		ChangeTime: now,
+	errs := append([]error(nil), rs.populateErrors...)
+	rd := newReadonlyDirs()
+	err := rs.applySteps(fs, applyOptions, steps, actuator, rd, &errs)
+	// Make directories read-only again even if applying their contents failed.
+	if restoreErr := rd.restore(actuator); err == nil {
+		err = rs.keepGoing(&errs, restoreErr)
 	}
-	for _, fileName := range sortedFileNames(rs.Files) {
-		if err := rs.Files[fileName].archive(w, fileName, &headerTemplate, umask); err != nil {
-			return err
-		}
+	if err != nil {
+		return err
 	}
-	for _, dirName := range sortedDirNames(rs.Dirs) {
-		if err := rs.Dirs[dirName].archive(w, dirName, &headerTemplate, umask); err != nil {
-			return err
-		}
+	if len(errs) != 0 {
+		return MultiError(errs)
 	}
 	return nil
 }
 
-// Apply ensures that targetDir in fs matches ds.
-func (rs *RootState) Apply(fs afero.Fs, actuator Actuator) error {
-	for _, fileName := range sortedFileNames(rs.Files) {
-		if err := rs.Files[fileName].apply(fs, filepath.Join(rs.TargetDir, fileName), rs.Umask, actuator); err != nil {
-			return err
+// applySteps applies steps and then removes targets with actuator, making the
+// read-only directories in rd writable when their entries are changed. Errors
+// are added to errs if rs.KeepGoing is true and returned otherwise.
+func (rs *RootState) applySteps(fs afero.Fs, applyOptions ApplyOptions, steps []*applyStep, actuator Actuator, rd *readonlyDirs, errs *[]error) error {
+	actuator = &readonlyDirsActuator{Actuator: actuator, rd: rd}
+	var failedDirs []string
+STEP:
+	for _, step := range steps {
+		// Skip the contents of directories that could not be applied.
+		for _, failedDir := range failedDirs {
+			if strings.HasPrefix(step.targetPath, failedDir+string(filepath.Separator)) {
+				continue STEP
+			}
 		}
-	}
-	for _, dirName := range sortedDirNames(rs.Dirs) {
-		if err := rs.Dirs[dirName].apply(fs, filepath.Join(rs.TargetDir, dirName), rs.Umask, actuator); err != nil {
+		if step.dirState != nil {
+			if err := step.dirState.apply(fs, step.targetPath, rs.Umask, actuator, rd); err != nil {
+				if err := rs.keepGoing(errs, err); err != nil {
+					return err
+				}
+				failedDirs = append(failedDirs, step.targetPath)
+			}
+			continue
+		}
+		// A plan computed in advance can fail if a parent directory had not
+		// yet been applied, in which case compute it again.
+		if step.plan == nil || (step.plan.statErr != nil && !os.IsNotExist(step.plan.statErr)) {
+			step.plan = step.fileState.plan(fs, step.targetPath, applyOptions)
+		}
+		if err := rs.keepGoing(errs, step.fileState.applyPlan(step.plan, step.targetPath, rs.Umask, actuator)); err != nil {
 			return err
 		}
 	}
-	return nil
+	return rs.applyRemoves(fs, applyOptions, actuator, errs)
 }
 
 // Get returns the state of the given target, or nil if no such target is found.
@@ -394,9 +710,20 @@ func (rs *RootState) Get(targetName string) Stater {
 }
 
 // Populate walks fs from the source directory creating a target directory
-// state.
+// state. Source files are not read until their contents are needed.
 func (rs *RootState) Populate(fs afero.Fs) error {
-	return afero.Walk(fs, rs.SourceDir, func(path string, fi os.FileInfo, err error) error {
+	rs.populateErrors = nil
+	rs.Warnings = nil
+	if err := rs.keepGoing(&rs.populateErrors, rs.populateRemoves(fs)); err != nil {
+		return err
+	}
+	if err := afero.Walk(fs, rs.SourceDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == rs.SourceDir && os.IsNotExist(err) {
+				return nil
+			}
+			return rs.keepGoing(&rs.populateErrors, err)
+		}
 		relPath, err := filepath.Rel(rs.SourceDir, path)
 		if err != nil {
 			return err
@@ -413,33 +740,39 @@ func (rs *RootState) Populate(fs afero.Fs) error {
 		}
 		switch {
 		case fi.Mode().IsRegular():
-			dirNames, fileName, mode, isEmpty, isTemplate := parseFilePath(relPath)
+			dirNames, fa := parseFilePath(relPath)
+			if fa.isRemove {
+				rs.Removes = append(rs.Removes, &RemoveState{
+					sourceName: relPath,
+					Name:       filepath.Join(append(dirNames, fa.name)...),
+				})
+				return nil
+			}
 			dirs, files := rs.Dirs, rs.Files
 			for _, dirName := range dirNames {
 				dirs, files = dirs[dirName].Dirs, dirs[dirName].Files
 			}
-			contents, err := afero.ReadFile(fs, path)
-			if err != nil {
-				return err
-			}
-			if isTemplate {
-				tmpl, err := template.New(path).Parse(string(contents))
-				if err != nil {
-					return errors.Wrap(err, path)
-				}
-				output := &bytes.Buffer{}
-				if err := tmpl.Execute(output, rs.Data); err != nil {
-					return errors.Wrap(err, path)
-				}
-				contents = output.Bytes()
-			}
-			files[fileName] = &FileState{
+			targetPath := filepath.Join(append(append([]string{rs.TargetDir}, dirNames...), fa.name)...)
+			files[fa.name] = &FileState{
 				sourceName: relPath,
-				Empty:      isEmpty,
-				Mode:       mode,
-				Contents:   contents,
+				Empty:      fa.isEmpty,
+				Create:     fa.isCreate,
+				Modify:     fa.isModify,
+				Mode:       fa.mode,
+				contents: newLazyContentsFunc(func() ([]byte, error) {
+					contents, err := afero.ReadFile(fs, path)
+					if err != nil || !fa.isTemplate {
+						return contents, err
+					}
+					return rs.executeTemplate(relPath, targetPath, contents)
+				}),
 			}
 		case fi.Mode().IsDir():
+			// Directories do not have the readonly_ prefix, so it is part of
+			// the directory's name, as it always has been.
+			if isReadonlyDirName(filepath.Base(relPath)) {
+				rs.Warnings = append(rs.Warnings, fmt.Sprintf("%s: directories do not have the readonly attribute, set their modes in %s instead", relPath, attributesFileName))
+			}
 			components := splitPathList(relPath)
 			dirNames, modes := parseDirNameComponents(components)
 			dirs := rs.Dirs
@@ -450,10 +783,16 @@ func (rs *RootState) Populate(fs afero.Fs) error {
 			mode := modes[len(modes)-1]
 			dirs[dirName] = newDirState(relPath, mode)
 		default:
-			return errors.Errorf("unsupported file type: %s", path)
+			return rs.keepGoing(&rs.populateErrors, errors.Errorf("unsupported file type: %s", path))
 		}
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+	if err := rs.keepGoing(&rs.populateErrors, rs.populateExternals(fs)); err != nil {
+		return err
+	}
+	return rs.keepGoing(&rs.populateErrors, rs.populateAttributes(fs))
 }
 
 func (rs *RootState) findDirState(dirName string) *DirState {
@@ -474,31 +813,55 @@ func makeDirName(name string, mode os.FileMode) string {
 	if mode&os.FileMode(077) == os.FileMode(0) {
 		dirName = privatePrefix
 	}
-	if strings.HasPrefix(name, ".") {
+	switch {
+	case strings.HasPrefix(name, "."):
 		dirName += dotPrefix + strings.TrimPrefix(name, ".")
-	} else {
+	case hasAnyPrefix(name, privatePrefix, readonlyPrefix, dotPrefix, literalPrefix):
+		dirName += literalPrefix + name
+	default:
 		dirName += name
 	}
+	// Escape suffixes so that directory names are distinct from file names.
+	if hasAnySuffix(dirName, templateSuffix, literalSuffix) {
+		dirName += literalSuffix
+	}
 	return dirName
 }
 
-func makeFileName(name string, mode os.FileMode, isEmpty bool, isTemplate bool) string {
+func makeFileName(fa fileAttributes) string {
 	fileName := ""
-	if mode&os.FileMode(077) == os.FileMode(0) {
-		fileName = privatePrefix
+	switch {
+	case fa.isCreate:
+		fileName = createPrefix
+	case fa.isModify:
+		fileName = modifyPrefix
+	case fa.isRemove:
+		fileName = removePrefix
+	}
+	if fa.mode&os.FileMode(077) == os.FileMode(0) {
+		fileName += privatePrefix
 	}
-	if isEmpty {
+	if fa.mode&os.FileMode(0222) == os.FileMode(0) {
+		fileName += readonlyPrefix
+	}
+	if fa.isEmpty {
 		fileName += emptyPrefix
 	}
-	if mode&os.FileMode(0111) != os.FileMode(0) {
+	if fa.mode&os.FileMode(0111) != os.FileMode(0) {
 		fileName += executablePrefix
 	}
-	if strings.HasPrefix(name, ".") {
-		fileName += dotPrefix + strings.TrimPrefix(name, ".")
-	} else {
-		fileName += name
+	switch {
+	case strings.HasPrefix(fa.name, "."):
+		fileName += dotPrefix + strings.TrimPrefix(fa.name, ".")
+	case hasAnyPrefix(fa.name, createPrefix, modifyPrefix, removePrefix, privatePrefix, readonlyPrefix, emptyPrefix, executablePrefix, dotPrefix, literalPrefix):
+		fileName += literalPrefix + fa.name
+	default:
+		fileName += fa.name
+	}
+	if strings.HasSuffix(fa.name, templateSuffix) || strings.HasSuffix(fa.name, literalSuffix) {
+		fileName += literalSuffix
 	}
-	if isTemplate {
+	if fa.isTemplate {
 		fileName += templateSuffix
 	}
 	return fileName
@@ -508,48 +871,103 @@ func makeFileName(name string, mode os.FileMode, isEmpty bool, isTemplate bool)
 // mode.
 func parseDirName(dirName string) (string, os.FileMode) {
 	name := dirName
+	// Only remove a .literal suffix that escapes another suffix, so that
+	// directories named before suffixes were escaped keep their names.
+	if trimmedName := strings.TrimSuffix(dirName, literalSuffix); trimmedName != dirName && hasAnySuffix(trimmedName, templateSuffix, literalSuffix) {
+		name = trimmedName
+	}
 	mode := os.FileMode(0777)
+	if strings.HasPrefix(name, literalPrefix) {
+		return strings.TrimPrefix(name, literalPrefix), mode
+	}
 	if strings.HasPrefix(name, privatePrefix) {
 		name = strings.TrimPrefix(name, privatePrefix)
 		mode &= 0700
 	}
-	if strings.HasPrefix(name, dotPrefix) {
+	switch {
+	case strings.HasPrefix(name, literalPrefix):
+		name = strings.TrimPrefix(name, literalPrefix)
+	case strings.HasPrefix(name, dotPrefix):
 		name = "." + strings.TrimPrefix(name, dotPrefix)
 	}
 	return name, mode
 }
 
-// parseFileName parses a single file name. It returns the target name, mode,
-// whether the contents should be interpreted as a template, and any error.
-func parseFileName(fileName string) (string, os.FileMode, bool, bool) {
+// isReadonlyDirName returns true if dirName, a single directory name, looks
+// like it has the readonly_ prefix, which directories do not have.
+func isReadonlyDirName(dirName string) bool {
+	if strings.HasPrefix(dirName, literalPrefix) {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimPrefix(dirName, privatePrefix), readonlyPrefix)
+}
+
+// parseFileName parses a single file name and returns its attributes.
+func parseFileName(fileName string) fileAttributes {
 	name := fileName
 	mode := os.FileMode(0666)
+	isCreate := false
+	isModify := false
+	isRemove := false
 	isPrivate := false
+	isReadonly := false
 	isEmpty := false
 	isTemplate := false
-	if strings.HasPrefix(name, privatePrefix) {
-		name = strings.TrimPrefix(name, privatePrefix)
-		isPrivate = true
+	// The literal_ prefix stops the parsing of any further prefixes.
+	isLiteral := false
+	trimPrefix := func(prefix string) bool {
+		if isLiteral {
+			return false
+		}
+		if strings.HasPrefix(name, literalPrefix) {
+			name = strings.TrimPrefix(name, literalPrefix)
+			isLiteral = true
+			return false
+		}
+		if !strings.HasPrefix(name, prefix) {
+			return false
+		}
+		name = strings.TrimPrefix(name, prefix)
+		return true
 	}
-	if strings.HasPrefix(name, emptyPrefix) {
-		name = strings.TrimPrefix(name, emptyPrefix)
-		isEmpty = true
+	switch {
+	case trimPrefix(createPrefix):
+		isCreate = true
+	case trimPrefix(modifyPrefix):
+		isModify = true
+	case trimPrefix(removePrefix):
+		isRemove = true
 	}
-	if strings.HasPrefix(name, executablePrefix) {
-		name = strings.TrimPrefix(name, executablePrefix)
+	isPrivate = trimPrefix(privatePrefix)
+	isReadonly = trimPrefix(readonlyPrefix)
+	isEmpty = trimPrefix(emptyPrefix)
+	if trimPrefix(executablePrefix) {
 		mode |= 0111
 	}
-	if strings.HasPrefix(name, dotPrefix) {
-		name = "." + strings.TrimPrefix(name, dotPrefix)
+	if trimPrefix(dotPrefix) {
+		name = "." + name
 	}
-	if strings.HasSuffix(name, templateSuffix) {
+	// The .literal suffix stops the parsing of any further suffixes.
+	if !strings.HasSuffix(name, literalSuffix) && strings.HasSuffix(name, templateSuffix) {
 		name = strings.TrimSuffix(name, templateSuffix)
 		isTemplate = true
 	}
+	name = strings.TrimSuffix(name, literalSuffix)
 	if isPrivate {
 		mode &= 0700
 	}
-	return name, mode, isEmpty, isTemplate
+	if isReadonly {
+		mode &^= 0222
+	}
+	return fileAttributes{
+		name:       name,
+		mode:       mode,
+		isCreate:   isCreate,
+		isEmpty:    isEmpty,
+		isModify:   isModify,
+		isRemove:   isRemove,
+		isTemplate: isTemplate,
+	}
 }
 
 // parseDirNameComponents parses multiple directory name components. It returns
@@ -566,16 +984,37 @@ func parseDirNameComponents(components []string) ([]string, []os.FileMode) {
 }
 
 // parseFilePath parses a single file path. It returns the target directory
-// names, the target filename, the target mode, whether the contents should be
-// interpreted as a template, and any error.
-func parseFilePath(path string) ([]string, string, os.FileMode, bool, bool) {
+// names and the file's attributes.
+func parseFilePath(path string) ([]string, fileAttributes) {
 	components := splitPathList(path)
 	dirNames, _ := parseDirNameComponents(components[0 : len(components)-1])
-	fileName, mode, isEmpty, isTemplate := parseFileName(components[len(components)-1])
-	return dirNames, fileName, mode, isEmpty, isTemplate
+	fa := parseFileName(components[len(components)-1])
+	return dirNames, fa
+}
+
+// TargetName returns the target name of sourceName, the name of a source
+// file relative to the source directory, or of a source directory if isDir is
+// true.
+func TargetName(sourceName string, isDir bool) string {
+	if isDir {
+		dirNames, _ := parseDirNameComponents(splitPathList(sourceName))
+		return filepath.Join(dirNames...)
+	}
+	dirNames, fa := parseFilePath(sourceName)
+	return filepath.Join(append(dirNames, fa.name)...)
 }
 
 // sortedDirNames returns a sorted slice of all directory names in ds.
+// lstat returns the os.FileInfo for name in fs without following symlinks, if
+// fs supports it.
+func lstat(fs afero.Fs, name string) (os.FileInfo, error) {
+	if lstater, ok := fs.(afero.Lstater); ok {
+		fi, _, err := lstater.LstatIfPossible(name)
+		return fi, err
+	}
+	return fs.Stat(name)
+}
+
 func sortedDirNames(dirs map[string]*DirState) []string {
 	dirNames := []string{}
 	for dirName := range dirs {
@@ -595,6 +1034,26 @@ func sortedFileNames(files map[string]*FileState) []string {
 	return fileNames
 }
 
+// hasAnyPrefix returns true if s begins with any of prefixes.
+func hasAnyPrefix(s string, prefixes ...string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnySuffix returns true if s ends with any of suffixes.
+func hasAnySuffix(s string, suffixes ...string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
 func splitPathList(path string) []string {
 	if strings.HasPrefix(path, string(filepath.Separator)) {
 		path = strings.TrimPrefix(path, string(filepath.Separator))
@@ -1,13 +1,24 @@
 package chezmoi
 
 import (
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/quick"
 
+	"github.com/absfs/afero"
 	"github.com/d4l3k/messagediff"
 	"github.com/twpayne/chezmoi/internal/absfstesting"
 )
 
+// memMapFsUmask is the umask for tests that apply directories created by
+// absfstesting.MakeMemMapFs, which have mode 0777. A zero umask means that
+// their permissions never need to be changed, which afero.MemMapFs cannot do
+// as its Chmod does not preserve os.ModeDir.
+const memMapFsUmask = os.FileMode(0)
+
 func TestDirName(t *testing.T) {
 	for _, tc := range []struct {
 		dirName string
@@ -18,6 +29,12 @@ func TestDirName(t *testing.T) {
 		{dirName: "dot_foo", name: ".foo", mode: os.FileMode(0777)},
 		{dirName: "private_foo", name: "foo", mode: os.FileMode(0700)},
 		{dirName: "private_dot_foo", name: ".foo", mode: os.FileMode(0700)},
+		{dirName: "literal_private_foo", name: "private_foo", mode: os.FileMode(0777)},
+		{dirName: "private_literal_dot_foo", name: "dot_foo", mode: os.FileMode(0700)},
+		{dirName: "literal_readonly_foo", name: "readonly_foo", mode: os.FileMode(0777)},
+		{dirName: "dot_foo.literal.literal", name: ".foo.literal", mode: os.FileMode(0777)},
+		{dirName: "dot_literal", name: ".literal", mode: os.FileMode(0777)},
+		{dirName: "literal_dot_foo.tmpl.literal", name: "dot_foo.tmpl", mode: os.FileMode(0777)},
 	} {
 		t.Run(tc.dirName, func(t *testing.T) {
 			if gotName, gotMode := parseDirName(tc.dirName); gotName != tc.name || gotMode != tc.mode {
@@ -32,32 +49,195 @@ func TestDirName(t *testing.T) {
 
 func TestFileName(t *testing.T) {
 	for _, tc := range []struct {
-		fileName   string
-		name       string
-		mode       os.FileMode
-		isEmpty    bool
-		isTemplate bool
+		fileName string
+		fa       fileAttributes
 	}{
-		{fileName: "foo", name: "foo", mode: os.FileMode(0666), isEmpty: false, isTemplate: false},
-		{fileName: "dot_foo", name: ".foo", mode: os.FileMode(0666), isEmpty: false, isTemplate: false},
-		{fileName: "private_foo", name: "foo", mode: os.FileMode(0600), isEmpty: false, isTemplate: false},
-		{fileName: "private_dot_foo", name: ".foo", mode: os.FileMode(0600), isEmpty: false, isTemplate: false},
-		{fileName: "empty_foo", name: "foo", mode: os.FileMode(0666), isEmpty: true, isTemplate: false},
-		{fileName: "executable_foo", name: "foo", mode: os.FileMode(0777), isEmpty: false, isTemplate: false},
-		{fileName: "foo.tmpl", name: "foo", mode: os.FileMode(0666), isEmpty: false, isTemplate: true},
-		{fileName: "private_executable_dot_foo.tmpl", name: ".foo", mode: os.FileMode(0700), isEmpty: false, isTemplate: true},
+		{fileName: "foo", fa: fileAttributes{name: "foo", mode: os.FileMode(0666)}},
+		{fileName: "dot_foo", fa: fileAttributes{name: ".foo", mode: os.FileMode(0666)}},
+		{fileName: "private_foo", fa: fileAttributes{name: "foo", mode: os.FileMode(0600)}},
+		{fileName: "private_dot_foo", fa: fileAttributes{name: ".foo", mode: os.FileMode(0600)}},
+		{fileName: "empty_foo", fa: fileAttributes{name: "foo", mode: os.FileMode(0666), isEmpty: true}},
+		{fileName: "executable_foo", fa: fileAttributes{name: "foo", mode: os.FileMode(0777)}},
+		{fileName: "foo.tmpl", fa: fileAttributes{name: "foo", mode: os.FileMode(0666), isTemplate: true}},
+		{fileName: "private_executable_dot_foo.tmpl", fa: fileAttributes{name: ".foo", mode: os.FileMode(0700), isTemplate: true}},
+		{fileName: "modify_dot_foo", fa: fileAttributes{name: ".foo", mode: os.FileMode(0666), isModify: true}},
+		{fileName: "create_dot_foo", fa: fileAttributes{name: ".foo", mode: os.FileMode(0666), isCreate: true}},
+		{fileName: "create_private_empty_foo", fa: fileAttributes{name: "foo", mode: os.FileMode(0600), isCreate: true, isEmpty: true}},
+		{fileName: "readonly_foo", fa: fileAttributes{name: "foo", mode: os.FileMode(0444)}},
+		{fileName: "private_readonly_executable_foo", fa: fileAttributes{name: "foo", mode: os.FileMode(0500)}},
+		{fileName: "literal_private_notes", fa: fileAttributes{name: "private_notes", mode: os.FileMode(0666)}},
+		{fileName: "executable_literal_dot_foo", fa: fileAttributes{name: "dot_foo", mode: os.FileMode(0777)}},
+		{fileName: "foo.tmpl.literal", fa: fileAttributes{name: "foo.tmpl", mode: os.FileMode(0666)}},
+		{fileName: "foo.literal.literal.tmpl", fa: fileAttributes{name: "foo.literal", mode: os.FileMode(0666), isTemplate: true}},
+		{fileName: "dot_tmpl.literal", fa: fileAttributes{name: ".tmpl", mode: os.FileMode(0666)}},
+		{fileName: "remove_dot_foo", fa: fileAttributes{name: ".foo", mode: os.FileMode(0666), isRemove: true}},
+		{fileName: "modify_private_dot_foo.tmpl", fa: fileAttributes{name: ".foo", mode: os.FileMode(0600), isModify: true, isTemplate: true}},
 	} {
 		t.Run(tc.fileName, func(t *testing.T) {
-			if gotName, gotMode, gotIsEmpty, gotIsTemplate := parseFileName(tc.fileName); gotName != tc.name || gotMode != tc.mode || gotIsEmpty != tc.isEmpty || gotIsTemplate != tc.isTemplate {
-				t.Errorf("parseFileName(%q) == %q, %v, %v, %v want %q, %v, %v, %v", tc.fileName, gotName, gotMode, gotIsEmpty, gotIsTemplate, tc.name, tc.mode, tc.isEmpty, tc.isTemplate)
+			if gotFA := parseFileName(tc.fileName); gotFA != tc.fa {
+				t.Errorf("parseFileName(%q) == %+v, want %+v", tc.fileName, gotFA, tc.fa)
 			}
-			if gotFileName := makeFileName(tc.name, tc.mode, tc.isEmpty, tc.isTemplate); gotFileName != tc.fileName {
-				t.Errorf("makeFileName(%q, %v, %v, %v) == %q, want %q", tc.name, tc.mode, tc.isEmpty, tc.isTemplate, gotFileName, tc.fileName)
+			if gotFileName := makeFileName(tc.fa); gotFileName != tc.fileName {
+				t.Errorf("makeFileName(%+v) == %q, want %q", tc.fa, gotFileName, tc.fileName)
 			}
 		})
 	}
 }
 
+func TestTargetName(t *testing.T) {
+	for _, tc := range []struct {
+		sourceName string
+		isDir      bool
+		want       string
+	}{
+		{sourceName: "dot_bashrc", want: ".bashrc"},
+		{sourceName: "private_dot_ssh/private_config", want: ".ssh/config"},
+		{sourceName: "private_dot_ssh", isDir: true, want: ".ssh"},
+		{sourceName: "dot_config/literal_dot_foo", isDir: true, want: ".config/dot_foo"},
+		{sourceName: "bin/executable_run.tmpl", want: "bin/run"},
+		{sourceName: "dot_config/create_private_dot_foo.tmpl.literal", want: ".config/.foo.tmpl"},
+		{sourceName: "remove_dot_vimrc", want: ".vimrc"},
+	} {
+		if got := TargetName(tc.sourceName, tc.isDir); got != tc.want {
+			t.Errorf("TargetName(%q, %v) == %q, want %q", tc.sourceName, tc.isDir, got, tc.want)
+		}
+	}
+}
+
+// randomName returns a random name built from fragments that are likely to
+// collide with attribute prefixes and suffixes.
+func randomName(r *rand.Rand) string {
+	fragments := []string{
+		createPrefix, modifyPrefix, removePrefix, privatePrefix, readonlyPrefix, emptyPrefix, executablePrefix, dotPrefix, literalPrefix,
+		templateSuffix, literalSuffix,
+		".", "_", "a", "b", "dot", "tmpl",
+	}
+	for {
+		name := ""
+		for i := 0; i < 1+r.Intn(6); i++ {
+			name += fragments[r.Intn(len(fragments))]
+		}
+		if name != "." && name != ".." {
+			return name
+		}
+	}
+}
+
+func TestParseUnescapedDirName(t *testing.T) {
+	// Directories whose names end in .literal but do not escape another
+	// suffix keep the names that they had before suffixes were escaped.
+	for dirName, want := range map[string]string{
+		"foo.literal":         "foo.literal",
+		"private_foo.literal": "foo.literal",
+		"dot_foo.tmpl":        ".foo.tmpl",
+	} {
+		if got, _ := parseDirName(dirName); got != want {
+			t.Errorf("parseDirName(%q) == %q, _, want %q, _", dirName, got, want)
+		}
+	}
+}
+
+func TestDirNameRoundTrip(t *testing.T) {
+	f := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		name := randomName(r)
+		mode := []os.FileMode{0777, 0700}[r.Intn(2)]
+		dirName := makeDirName(name, mode)
+		gotName, gotMode := parseDirName(dirName)
+		if gotName != name || gotMode != mode {
+			t.Logf("makeDirName(%q, %v) == %q, parseDirName(%q) == %q, %v", name, mode, dirName, dirName, gotName, gotMode)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileNameRoundTrip(t *testing.T) {
+	f := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		fa := fileAttributes{
+			name:       randomName(r),
+			mode:       []os.FileMode{0666, 0777, 0600, 0700, 0444, 0555, 0400, 0500}[r.Intn(8)],
+			isEmpty:    r.Intn(2) == 0,
+			isTemplate: r.Intn(2) == 0,
+		}
+		switch r.Intn(4) {
+		case 1:
+			fa.isCreate = true
+		case 2:
+			fa.isModify = true
+		case 3:
+			fa.isRemove = true
+		}
+		fileName := makeFileName(fa)
+		if gotFA := parseFileName(fileName); gotFA != fa {
+			t.Logf("makeFileName(%+v) == %q, parseFileName(%q) == %+v", fa, fileName, fileName, gotFA)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddPopulateRoundTrip(t *testing.T) {
+	f := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		dirName, fileName := randomName(r), randomName(r)
+		if dirName == fileName {
+			return true
+		}
+		fsMap := map[string]string{
+			"/home/user/.chezmoi/.keep":                   "",
+			"/home/user/" + fileName:                      "file",
+			"/home/user/" + dirName + "/" + randomName(r): "nested",
+		}
+		fs, err := absfstesting.MakeMemMapFs(fsMap)
+		if err != nil {
+			t.Fatalf("absfstesting.MakeMemMapFs(%v) == %v, %v, want !<nil>, <nil>", fsMap, fs, err)
+		}
+		rs := NewRootState("/home/user", 0, "/home/user/.chezmoi", nil)
+		actuator := NewFsActuator(fs, "/home/user")
+		for path := range fsMap {
+			if filepath.HasPrefix(path, "/home/user/.chezmoi/") {
+				continue
+			}
+			if err := rs.Add(fs, AddOptions{}, path, nil, actuator); err != nil {
+				t.Logf("rs.Add(_, _, %q, nil, _) == %v, want <nil>", path, err)
+				return false
+			}
+		}
+		populatedRS := NewRootState("/home/user", 0, "/home/user/.chezmoi", nil)
+		if err := populatedRS.Populate(fs); err != nil {
+			t.Logf("populatedRS.Populate(_) == %v, want <nil>", err)
+			return false
+		}
+		for path, contents := range fsMap {
+			if filepath.HasPrefix(path, "/home/user/.chezmoi/") {
+				continue
+			}
+			targetName := strings.TrimPrefix(path, "/home/user/")
+			fileState, ok := populatedRS.Get(targetName).(*FileState)
+			if !ok {
+				t.Logf("%s: not round-tripped, populatedRS.Get(%q) == %+v", path, targetName, populatedRS.Get(targetName))
+				return false
+			}
+			if gotContents, err := fileState.Contents(); err != nil || string(gotContents) != contents {
+				t.Logf("%s: not round-tripped, populatedRS.Get(%q) == %+v", path, targetName, populatedRS.Get(targetName))
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestRootStatePopulate(t *testing.T) {
 	for _, tc := range []struct {
 		name      string
@@ -81,7 +261,7 @@ func TestRootStatePopulate(t *testing.T) {
 					"foo": {
 						sourceName: "foo",
 						Mode:       os.FileMode(0666),
-						Contents:   []byte("bar"),
+						contents:   newLazyContents([]byte("bar")),
 					},
 				},
 			},
@@ -101,7 +281,7 @@ func TestRootStatePopulate(t *testing.T) {
 					".foo": {
 						sourceName: "dot_foo",
 						Mode:       os.FileMode(0666),
-						Contents:   []byte("bar"),
+						contents:   newLazyContents([]byte("bar")),
 					},
 				},
 			},
@@ -121,7 +301,7 @@ func TestRootStatePopulate(t *testing.T) {
 					"foo": {
 						sourceName: "private_foo",
 						Mode:       os.FileMode(0600),
-						Contents:   []byte("bar"),
+						contents:   newLazyContents([]byte("bar")),
 					},
 				},
 			},
@@ -145,7 +325,7 @@ func TestRootStatePopulate(t *testing.T) {
 							"bar": {
 								sourceName: "foo/bar",
 								Mode:       os.FileMode(0666),
-								Contents:   []byte("baz"),
+								contents:   newLazyContents([]byte("baz")),
 							},
 						},
 					},
@@ -172,7 +352,7 @@ func TestRootStatePopulate(t *testing.T) {
 							"bar": {
 								sourceName: "private_dot_foo/bar",
 								Mode:       os.FileMode(0666),
-								Contents:   []byte("baz"),
+								contents:   newLazyContents([]byte("baz")),
 							},
 						},
 					},
@@ -201,7 +381,28 @@ func TestRootStatePopulate(t *testing.T) {
 					".gitconfig": {
 						sourceName: "dot_gitconfig.tmpl",
 						Mode:       os.FileMode(0666),
-						Contents:   []byte("[user]\n\temail = user@example.com\n"),
+						contents:   newLazyContents([]byte("[user]\n\temail = user@example.com\n")),
+					},
+				},
+			},
+		},
+		{
+			name: "modify_file",
+			fs: map[string]string{
+				"/modify_dot_foo": "#!/bin/sh\nsed s/bar/baz/\n",
+			},
+			sourceDir: "/",
+			want: &RootState{
+				TargetDir: "/",
+				Umask:     os.FileMode(0),
+				SourceDir: "/",
+				Dirs:      map[string]*DirState{},
+				Files: map[string]*FileState{
+					".foo": {
+						sourceName: "modify_dot_foo",
+						Modify:     true,
+						Mode:       os.FileMode(0666),
+						contents:   newLazyContents([]byte("#!/bin/sh\nsed s/bar/baz/\n")),
 					},
 				},
 			},
@@ -216,6 +417,13 @@ func TestRootStatePopulate(t *testing.T) {
 			if err := rs.Populate(fs); err != nil {
 				t.Fatalf("rs.Populate(%+v) == %v, want <nil>", fs, err)
 			}
+			for targetName, state := range rs.AllStates() {
+				if fileState, ok := state.(*FileState); ok {
+					if _, err := fileState.Contents(); err != nil {
+						t.Fatalf("%s: fileState.Contents() == _, %v, want _, <nil>", targetName, err)
+					}
+				}
+			}
 			if diff, equal := messagediff.PrettyDiff(tc.want, rs); !equal {
 				t.Errorf("rs.Populate(%+v) diff:\n%s\n", fs, diff)
 			}
@@ -261,6 +469,82 @@ func TestEndToEnd(t *testing.T) {
 				"/home/user/.chezmoi/empty_foo":     "",
 			},
 		},
+		{
+			name: "modify",
+			fsMap: map[string]string{
+				"/home/user/.modify":                         "foo=1\nbar=2\n",
+				"/home/user/.chezmoi/modify_dot_modify.tmpl": "#!/bin/sh\nsed s/^bar=.*/bar={{ .bar }}/\n",
+				"/home/user/.chezmoi/modify_dot_absent":      "#!/bin/sh\necho created\n",
+				"/home/user/.chezmoi/modify_dot_unchanged":   "#!/bin/sh\ncat\n",
+				"/home/user/.unchanged":                      "unchanged\n",
+			},
+			sourceDir: "/home/user/.chezmoi",
+			data: map[string]interface{}{
+				"bar": "3",
+			},
+			targetDir: "/home/user",
+			umask:     os.FileMode(022),
+			wantFsMap: map[string]string{
+				"/home/user/.modify":                         "foo=1\nbar=3\n",
+				"/home/user/.absent":                         "created\n",
+				"/home/user/.unchanged":                      "unchanged\n",
+				"/home/user/.chezmoi/modify_dot_modify.tmpl": "#!/bin/sh\nsed s/^bar=.*/bar={{ .bar }}/\n",
+				"/home/user/.chezmoi/modify_dot_absent":      "#!/bin/sh\necho created\n",
+				"/home/user/.chezmoi/modify_dot_unchanged":   "#!/bin/sh\ncat\n",
+			},
+		},
+		{
+			name: "create",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/create_dot_absent":      "seed\n",
+				"/home/user/.chezmoi/create_dot_empty":       "seed\n",
+				"/home/user/.chezmoi/create_dot_existing":    "seed\n",
+				"/home/user/.chezmoi/create_dot_no_contents": "",
+				"/home/user/.empty":                          "",
+				"/home/user/.existing":                       "user contents\n",
+				"/home/user/.no_contents":                    "user contents\n",
+			},
+			sourceDir: "/home/user/.chezmoi",
+			targetDir: "/home/user",
+			umask:     os.FileMode(022),
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/create_dot_absent":      "seed\n",
+				"/home/user/.chezmoi/create_dot_empty":       "seed\n",
+				"/home/user/.chezmoi/create_dot_existing":    "seed\n",
+				"/home/user/.chezmoi/create_dot_no_contents": "",
+				"/home/user/.absent":                         "seed\n",
+				"/home/user/.empty":                          "seed\n",
+				"/home/user/.existing":                       "user contents\n",
+				"/home/user/.no_contents":                    "user contents\n",
+			},
+		},
+		{
+			name: "remove",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiremove":          "# comment\n.old*\n{{ if eq .os \"linux\" }}.linux_only{{ end }}\n",
+				"/home/user/.chezmoi/dot_config/remove_stale": "",
+				"/home/user/.chezmoi/dot_oldkeep":             "keep",
+				"/home/user/.config/stale":                    "stale",
+				"/home/user/.config/other":                    "other",
+				"/home/user/.linux_only":                      "linux",
+				"/home/user/.oldrc":                           "old",
+				"/home/user/.olddir/file":                     "old",
+				"/home/user/.oldkeep":                         "keep",
+			},
+			sourceDir: "/home/user/.chezmoi",
+			data: map[string]interface{}{
+				"os": "linux",
+			},
+			targetDir: "/home/user",
+			umask:     memMapFsUmask,
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiremove":          "# comment\n.old*\n{{ if eq .os \"linux\" }}.linux_only{{ end }}\n",
+				"/home/user/.chezmoi/dot_config/remove_stale": "",
+				"/home/user/.chezmoi/dot_oldkeep":             "keep",
+				"/home/user/.config/other":                    "other",
+				"/home/user/.oldkeep":                         "keep",
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			fs, err := absfstesting.MakeMemMapFs(tc.fsMap)
@@ -271,7 +555,7 @@ func TestEndToEnd(t *testing.T) {
 			if err := rs.Populate(fs); err != nil {
 				t.Fatalf("rs.Populate(%+v) == %v, want <nil>", fs, err)
 			}
-			if err := rs.Apply(fs, NewLoggingActuator(NewFsActuator(fs, tc.targetDir))); err != nil {
+			if err := rs.Apply(fs, ApplyOptions{}, NewLoggingActuator(NewFsActuator(fs, tc.targetDir))); err != nil {
 				t.Fatalf("rs.Apply(absfstesting.MakeMemMapFs(%v), _) == %v, want <nil>", tc.fsMap, err)
 			}
 			gotFsMap, err := absfstesting.MakeMapFs(fs)
@@ -284,3 +568,263 @@ func TestEndToEnd(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateFileInSync(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		mode         os.FileMode
+		wantActuated bool
+	}{
+		{name: "same_mode", mode: 0644, wantActuated: false},
+		{name: "different_mode", mode: 0600, wantActuated: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(map[string]string{
+				"/home/user/.chezmoi/create_dot_known_hosts": "seed\n",
+			})
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+			}
+			if err := afero.WriteFile(fs, "/home/user/.known_hosts", []byte("user contents\n"), tc.mode); err != nil {
+				t.Fatalf("afero.WriteFile(...) == %v, want <nil>", err)
+			}
+			rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+			if err := rs.Populate(fs); err != nil {
+				t.Fatalf("rs.Populate(%+v) == %v, want <nil>", fs, err)
+			}
+			anyActuator := NewAnyActuator(NewNullActuator())
+			if err := rs.Apply(fs, ApplyOptions{}, anyActuator); err != nil {
+				t.Fatalf("rs.Apply(_, _) == %v, want <nil>", err)
+			}
+			if gotActuated := anyActuator.Actuated(); gotActuated != tc.wantActuated {
+				t.Errorf("anyActuator.Actuated() == %v, want %v", gotActuated, tc.wantActuated)
+			}
+		})
+	}
+}
+
+func TestApplyTargetNames(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		targetNames []string
+		wantActions []string
+	}{
+		{
+			name:        "file",
+			targetNames: []string{".bashrc"},
+			wantActions: []string{
+				"write 644 /home/user/.bashrc \"bashrc\"",
+			},
+		},
+		{
+			name:        "nested_file",
+			targetNames: []string{".ssh/config"},
+			wantActions: []string{
+				"mkdir 755 /home/user/.ssh",
+				"write 644 /home/user/.ssh/config \"config\"",
+			},
+		},
+		{
+			name:        "dir",
+			targetNames: []string{".ssh"},
+			wantActions: []string{
+				"mkdir 755 /home/user/.ssh",
+				"write 644 /home/user/.ssh/config \"config\"",
+				"write 644 /home/user/.ssh/known_hosts \"known_hosts\"",
+			},
+		},
+		{
+			name:        "remove",
+			targetNames: []string{".old"},
+			wantActions: []string{
+				"rm -rf /home/user/.old",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(map[string]string{
+				"/home/user/.chezmoi/dot_bashrc":          "bashrc",
+				"/home/user/.chezmoi/dot_profile":         "profile",
+				"/home/user/.chezmoi/dot_ssh/config":      "config",
+				"/home/user/.chezmoi/dot_ssh/known_hosts": "known_hosts",
+				"/home/user/.chezmoi/remove_dot_old":      "",
+				"/home/user/.chezmoi/remove_dot_obsolete": "",
+				"/home/user/.old":                         "old",
+				"/home/user/.obsolete":                    "obsolete",
+			})
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+			}
+			rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+			if err := rs.Populate(fs); err != nil {
+				t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+			}
+			a := &recordingActuator{}
+			if err := rs.Apply(fs, ApplyOptions{TargetNames: tc.targetNames}, a); err != nil {
+				t.Fatalf("rs.Apply(_, _, _) == %v, want <nil>", err)
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.wantActions, a.actions); !equal {
+				t.Errorf("rs.Apply(_, %v, _) actions diff:\n%s\n", tc.targetNames, diff)
+			}
+		})
+	}
+}
+
+func TestPopulateReadonlyDir(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/readonly_dot_config/file": "contents",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	if rs.Get("readonly_dot_config/file") == nil {
+		t.Errorf("rs.Get(\"readonly_dot_config/file\") == nil, want !nil")
+	}
+	if len(rs.Warnings) != 1 {
+		t.Errorf("rs.Warnings == %v, want one warning", rs.Warnings)
+	}
+}
+
+func TestApplyReadonlyDir(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		dirMode     os.FileMode
+		contents    string
+		wantActions []string
+	}{
+		{
+			name:     "create",
+			contents: "new",
+			wantActions: []string{
+				"mkdir 755 /home/user/ro",
+				"write 644 /home/user/ro/file \"new\"",
+				"chmod 555 /home/user/ro",
+			},
+		},
+		{
+			name:     "unchanged",
+			dirMode:  0555,
+			contents: "old",
+		},
+		{
+			name:     "changed",
+			dirMode:  0555,
+			contents: "new",
+			wantActions: []string{
+				"chmod 755 /home/user/ro",
+				"write 644 /home/user/ro/file \"new\"",
+				"chmod 555 /home/user/ro",
+			},
+		},
+		{
+			name:     "made_readonly",
+			dirMode:  0755,
+			contents: "new",
+			wantActions: []string{
+				"write 644 /home/user/ro/file \"new\"",
+				"chmod 555 /home/user/ro",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(map[string]string{
+				"/home/user/.chezmoi/.chezmoiattributes": "ro 0555\n",
+				"/home/user/.chezmoi/ro/file":            tc.contents,
+			})
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+			}
+			if tc.dirMode != 0 {
+				if err := fs.Mkdir("/home/user/ro", tc.dirMode); err != nil {
+					t.Fatalf("fs.Mkdir(_, _) == %v, want <nil>", err)
+				}
+				if err := afero.WriteFile(fs, "/home/user/ro/file", []byte("old"), 0644); err != nil {
+					t.Fatalf("afero.WriteFile(_, _, _, _) == %v, want <nil>", err)
+				}
+			}
+			rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+			if err := rs.Populate(fs); err != nil {
+				t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+			}
+			a := &recordingActuator{}
+			if err := rs.Apply(fs, ApplyOptions{TargetNames: []string{"ro"}}, a); err != nil {
+				t.Fatalf("rs.Apply(_, _, _) == %v, want <nil>", err)
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.wantActions, a.actions); !equal {
+				t.Errorf("rs.Apply(_, _, _) actions diff:\n%s\n", diff)
+			}
+		})
+	}
+}
+
+// A currentContentsActuator records the current contents passed to WriteFile.
+type currentContentsActuator struct {
+	Actuator
+	currentContents map[string]string
+}
+
+func (a *currentContentsActuator) WriteFile(name string, contents []byte, mode os.FileMode, currentContents []byte) error {
+	a.currentContents[name] = string(currentContents)
+	return a.Actuator.WriteFile(name, contents, mode, currentContents)
+}
+
+func TestApplyReadCurrentContents(t *testing.T) {
+	for _, readCurrentContents := range []bool{false, true} {
+		fs, err := absfstesting.MakeMemMapFs(map[string]string{
+			"/home/user/.chezmoi/dot_bashrc":        "new bashrc",
+			"/home/user/.chezmoi/modify_dot_config": "#!/bin/sh\ncat\necho modified\n",
+			"/home/user/.bashrc":                    "old bashrc",
+			"/home/user/.config":                    "config\n",
+		})
+		if err != nil {
+			t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+		}
+		rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+		if err := rs.Populate(fs); err != nil {
+			t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+		}
+		a := &currentContentsActuator{
+			Actuator:        NewNullActuator(),
+			currentContents: make(map[string]string),
+		}
+		if err := rs.Apply(fs, ApplyOptions{ReadCurrentContents: readCurrentContents}, a); err != nil {
+			t.Fatalf("rs.Apply(_, _, _) == %v, want <nil>", err)
+		}
+		// Modify scripts always need the current contents.
+		want := map[string]string{
+			"/home/user/.bashrc": "",
+			"/home/user/.config": "config\n",
+		}
+		if readCurrentContents {
+			want["/home/user/.bashrc"] = "old bashrc"
+		}
+		if diff, equal := messagediff.PrettyDiff(want, a.currentContents); !equal {
+			t.Errorf("ReadCurrentContents %v diff:\n%s\n", readCurrentContents, diff)
+		}
+	}
+}
+
+func TestApplyErrorKeepsTarget(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/dot_config.tmpl": "{{ template \"missing\" }}",
+		"/home/user/.config/app/config.yaml":  "app: config\n",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	if err := rs.Apply(fs, ApplyOptions{}, NewFsActuator(fs, "/home/user")); err == nil {
+		t.Errorf("rs.Apply(_, _, _) == <nil>, want !<nil>")
+	}
+	// The directory that the file would replace is left alone.
+	if _, err := fs.Stat("/home/user/.config/app/config.yaml"); err != nil {
+		t.Errorf("fs.Stat(%q) == _, %v, want _, <nil>", "/home/user/.config/app/config.yaml", err)
+	}
+}
@@ -0,0 +1,143 @@
+package chezmoi
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"unicode/utf8"
+)
+
+// Dump entry types.
+const (
+	DumpTypeDir    = "dir"
+	DumpTypeFile   = "file"
+	DumpTypeRemove = "remove"
+)
+
+// DumpOptions are options to RootState.Dump.
+type DumpOptions struct {
+	// OmitContents, if true, omits the contents of files, for example because
+	// they contain secrets. Their hashes are still included.
+	OmitContents bool
+}
+
+// A DumpEntry is the machine-readable representation of a single target in
+// the target state.
+type DumpEntry struct {
+	// Path is the target's name relative to the target directory.
+	Path string `json:"path" yaml:"path"`
+	// Type is one of DumpTypeDir, DumpTypeFile, or DumpTypeRemove.
+	Type string `json:"type" yaml:"type"`
+	// Mode is the target's permissions in octal, after applying the umask.
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// SourceName is the name of the source file relative to the source
+	// directory.
+	SourceName string `json:"sourceName" yaml:"sourceName"`
+	// SourceDir is the source directory of the layer that provides the
+	// target. It is only set if the target state is layered.
+	SourceDir string `json:"sourceDir,omitempty" yaml:"sourceDir,omitempty"`
+	// Attributes are any of "create", "empty", "modify", "exact-mode", and
+	// "pattern", in that order.
+	Attributes []string `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+	// Contents are the file's contents, if they are valid UTF-8.
+	Contents *string `json:"contents,omitempty" yaml:"contents,omitempty"`
+	// ContentsBase64 are the file's contents, base64-encoded, if they are not
+	// valid UTF-8.
+	ContentsBase64 string `json:"contentsBase64,omitempty" yaml:"contentsBase64,omitempty"`
+	// ContentsSHA256 is the hex-encoded SHA256 hash of the file's contents.
+	ContentsSHA256 string `json:"contentsSHA256,omitempty" yaml:"contentsSHA256,omitempty"`
+}
+
+// Dump returns all of the targets in rs, including patterns in the remove
+// file, sorted by path. If targetNames is not empty then only those targets,
+// and their descendants, are included.
+func (rs *RootState) Dump(targetNames []string, dumpOptions DumpOptions) ([]*DumpEntry, error) {
+	var paths []string
+	states := make(map[string]Stater)
+	for path, state := range rs.AllStates() {
+		paths = append(paths, path)
+		states[path] = state
+	}
+	// AllStates does not include patterns in the remove file.
+	for _, rms := range rs.Removes {
+		if _, ok := states[rms.Name]; !ok && rms.Pattern {
+			paths = append(paths, rms.Name)
+			states[rms.Name] = rms
+		}
+	}
+	sort.Strings(paths)
+	var entries []*DumpEntry
+	for _, path := range paths {
+		if len(targetNames) != 0 && !hasAnyPathPrefix(path, targetNames) {
+			continue
+		}
+		entry := &DumpEntry{
+			Path:       path,
+			SourceName: states[path].SourceName(),
+		}
+		if len(rs.Layers) != 0 {
+			entry.SourceDir = rs.layerSourceDir(path, states[path])
+		}
+		switch state := states[path].(type) {
+		case *DirState:
+			entry.Type = DumpTypeDir
+			entry.Mode = fmt.Sprintf("%04o", state.targetMode(rs.Umask))
+			if state.exactMode {
+				entry.Attributes = append(entry.Attributes, "exact-mode")
+			}
+		case *FileState:
+			entry.Type = DumpTypeFile
+			entry.Mode = fmt.Sprintf("%04o", state.targetMode(rs.Umask))
+			for _, attribute := range []struct {
+				name  string
+				value bool
+			}{
+				{"create", state.Create},
+				{"empty", state.Empty},
+				{"modify", state.Modify},
+				{"exact-mode", state.exactMode},
+			} {
+				if attribute.value {
+					entry.Attributes = append(entry.Attributes, attribute.name)
+				}
+			}
+			contents, err := state.Contents()
+			if err != nil {
+				return nil, err
+			}
+			sum := sha256.Sum256(contents)
+			entry.ContentsSHA256 = hex.EncodeToString(sum[:])
+			switch {
+			case dumpOptions.OmitContents:
+			case utf8.Valid(contents):
+				s := string(contents)
+				entry.Contents = &s
+			default:
+				entry.ContentsBase64 = base64.StdEncoding.EncodeToString(contents)
+			}
+		case *RemoveState:
+			entry.Type = DumpTypeRemove
+			if state.Pattern {
+				entry.Attributes = append(entry.Attributes, "pattern")
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// hasAnyPathPrefix returns true if path is equal to or is a descendant of any
+// of prefixes.
+func hasAnyPathPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		prefix = filepath.Clean(prefix)
+		if path == prefix || filepath.HasPrefix(path, prefix+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package chezmoi
+
+import (
+	"testing"
+
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestDump(t *testing.T) {
+	stringPtr := func(s string) *string { return &s }
+	for _, tc := range []struct {
+		name        string
+		fsMap       map[string]string
+		targetNames []string
+		dumpOptions DumpOptions
+		want        []*DumpEntry
+	}{
+		{
+			name: "empty",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.keep": "",
+			},
+			want: nil,
+		},
+		{
+			name: "files",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/dot_bashrc":        "bar",
+				"/home/user/.chezmoi/dot_binary":        "\xff\xfe",
+				"/home/user/.chezmoi/dot_template.tmpl": "{{ .name }}",
+				"/home/user/.chezmoi/executable_run":    "#!/bin/sh\n",
+			},
+			want: []*DumpEntry{
+				{
+					Path:           ".bashrc",
+					Type:           DumpTypeFile,
+					Mode:           "0644",
+					SourceName:     "dot_bashrc",
+					Contents:       stringPtr("bar"),
+					ContentsSHA256: "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9",
+				},
+				{
+					Path:           ".binary",
+					Type:           DumpTypeFile,
+					Mode:           "0644",
+					SourceName:     "dot_binary",
+					ContentsBase64: "//4=",
+					ContentsSHA256: "b3d510ef04275ca8e698e5b3cbb0ece3949ef9252f0cdc839e9ee347409a2209",
+				},
+				{
+					Path:           ".template",
+					Type:           DumpTypeFile,
+					Mode:           "0644",
+					SourceName:     "dot_template.tmpl",
+					Contents:       stringPtr("John"),
+					ContentsSHA256: "a8cfcd74832004951b4408cdb0a5dbcd8c7e52d43f7fe244bf720582e05241da",
+				},
+				{
+					Path:           "run",
+					Type:           DumpTypeFile,
+					Mode:           "0755",
+					SourceName:     "executable_run",
+					Contents:       stringPtr("#!/bin/sh\n"),
+					ContentsSHA256: "a8076d3d28d21e02012b20eaf7dbf75409a6277134439025f282e368e3305abf",
+				},
+			},
+		},
+		{
+			name: "attributes_and_removes",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiremove":      ".cache/*\n",
+				"/home/user/.chezmoi/create_dot_profile":  "profile",
+				"/home/user/.chezmoi/empty_dot_hushlogin": "",
+				"/home/user/.chezmoi/remove_dot_old":      "",
+			},
+			dumpOptions: DumpOptions{
+				OmitContents: true,
+			},
+			want: []*DumpEntry{
+				{
+					Path:       ".cache/*",
+					Type:       DumpTypeRemove,
+					SourceName: ".chezmoiremove",
+					Attributes: []string{"pattern"},
+				},
+				{
+					Path:           ".hushlogin",
+					Type:           DumpTypeFile,
+					Mode:           "0644",
+					SourceName:     "empty_dot_hushlogin",
+					Attributes:     []string{"empty"},
+					ContentsSHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+				},
+				{
+					Path:       ".old",
+					Type:       DumpTypeRemove,
+					SourceName: "remove_dot_old",
+				},
+				{
+					Path:           ".profile",
+					Type:           DumpTypeFile,
+					Mode:           "0644",
+					SourceName:     "create_dot_profile",
+					Attributes:     []string{"create"},
+					ContentsSHA256: "1900eab6c028483d7126599ee6f50de0d27907b5c65fa90524580b4b0f9852b0",
+				},
+			},
+		},
+		{
+			name: "target_names",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/dot_bashrc":             "bar",
+				"/home/user/.chezmoi/private_dot_ssh/config": "Host *\n",
+			},
+			targetNames: []string{".ssh"},
+			want: []*DumpEntry{
+				{
+					Path:       ".ssh",
+					Type:       DumpTypeDir,
+					Mode:       "0700",
+					SourceName: "private_dot_ssh",
+				},
+				{
+					Path:           ".ssh/config",
+					Type:           DumpTypeFile,
+					Mode:           "0644",
+					SourceName:     "private_dot_ssh/config",
+					Contents:       stringPtr("Host *\n"),
+					ContentsSHA256: "f019feb3e520622efe7b429ad193a0ca090892027c6f4f42acb59871adb9a4bf",
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(tc.fsMap)
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(%v) == %v, %v, want !<nil>, <nil>", tc.fsMap, fs, err)
+			}
+			rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", map[string]interface{}{"name": "John"})
+			if err := rs.Populate(fs); err != nil {
+				t.Fatalf("rs.Populate(%+v) == %v, want <nil>", fs, err)
+			}
+			got, err := rs.Dump(tc.targetNames, tc.dumpOptions)
+			if err != nil {
+				t.Fatalf("rs.Dump(%v, %+v) == %v, %v, want !<nil>, <nil>", tc.targetNames, tc.dumpOptions, got, err)
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.want, got); !equal {
+				t.Errorf("rs.Dump(%v, %+v) diff:\n%s\n", tc.targetNames, tc.dumpOptions, diff)
+			}
+		})
+	}
+}
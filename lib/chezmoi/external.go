@@ -0,0 +1,537 @@
+package chezmoi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// External types.
+const (
+	ExternalTypeArchive = "archive"
+	ExternalTypeFile    = "file"
+	ExternalTypeGitRepo = "git-repo"
+)
+
+// externalHTTPTimeout is how long fetching an external's URL may take,
+// including reading its contents.
+const externalHTTPTimeout = 5 * time.Minute
+
+// externalFileNames are the names of the externals file in the source
+// directory, in order of preference.
+var externalFileNames = []string{
+	".chezmoiexternal.json",
+	".chezmoiexternal.toml",
+	".chezmoiexternal.yaml",
+}
+
+// An External describes a target that is populated from an archive, a single
+// file, or a git repository outside the source directory.
+type External struct {
+	// Type is one of ExternalTypeArchive, ExternalTypeFile, or
+	// ExternalTypeGitRepo.
+	Type string `json:"type" toml:"type" yaml:"type"`
+	// URL is an http, https, or file URL, or a path relative to the source
+	// directory. git-repo URLs may be any URL that git accepts, including
+	// scp-like URLs such as git@github.com:user/repo.git.
+	URL string `json:"url" toml:"url" yaml:"url"`
+	// Format is the archive format. If it is empty then it is determined from
+	// URL.
+	Format string `json:"format" toml:"format" yaml:"format"`
+	// SHA256 is the expected hex-encoded SHA256 hash of the archive or file.
+	SHA256 string `json:"sha256" toml:"sha256" yaml:"sha256"`
+	// StripComponents is the number of leading path components to remove
+	// from each archive entry's name.
+	StripComponents int `json:"stripComponents" toml:"stripComponents" yaml:"stripComponents"`
+	// Include, if not empty, are patterns of the only archive entries or
+	// repository files, and their descendants, that are included.
+	Include []string `json:"include" toml:"include" yaml:"include"`
+	// Exclude are patterns of archive entries or repository files, and their
+	// descendants, that are excluded.
+	Exclude []string `json:"exclude" toml:"exclude" yaml:"exclude"`
+	// RefreshPeriod is how long a cached download or clone is used before it
+	// is fetched again, for example "168h". If it is empty then it is never
+	// fetched again.
+	RefreshPeriod string `json:"refreshPeriod" toml:"refreshPeriod" yaml:"refreshPeriod"`
+	// Executable, if true, makes a file executable.
+	Executable bool `json:"executable" toml:"executable" yaml:"executable"`
+}
+
+// populateExternals adds the targets described in the externals file, if it
+// exists, to rs. The externals file is always treated as a template.
+func (rs *RootState) populateExternals(fs afero.Fs) error {
+	var externalFileName string
+	var contents []byte
+	for _, name := range externalFileNames {
+		var err error
+		contents, err = afero.ReadFile(fs, filepath.Join(rs.SourceDir, name))
+		if err == nil {
+			externalFileName = name
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if externalFileName == "" {
+		return nil
+	}
+	contents, err := rs.executeTemplate(externalFileName, "", contents)
+	if err != nil {
+		return err
+	}
+	externals := make(map[string]*External)
+	switch filepath.Ext(externalFileName) {
+	case ".json":
+		err = json.Unmarshal(contents, &externals)
+	case ".toml":
+		err = toml.Unmarshal(contents, &externals)
+	case ".yaml":
+		err = yaml.Unmarshal(contents, &externals)
+	}
+	if err != nil {
+		return errors.Wrap(err, externalFileName)
+	}
+	var targetNames []string
+	for targetName := range externals {
+		targetNames = append(targetNames, targetName)
+	}
+	sort.Strings(targetNames)
+	for _, targetName := range targetNames {
+		err := rs.populateExternal(fs, externalFileName, filepath.Clean(targetName), externals[targetName])
+		if err := rs.keepGoing(&rs.populateErrors, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// populateExternal adds the target targetName described by external, from
+// externalFileName, to rs.
+func (rs *RootState) populateExternal(fs afero.Fs, externalFileName, targetName string, external *External) error {
+	if filepath.IsAbs(targetName) || targetName == "." || strings.HasPrefix(targetName, "..") {
+		return errors.Errorf("%s: %s: invalid target", externalFileName, targetName)
+	}
+	if state := rs.Get(targetName); state != nil {
+		return errors.Errorf("%s: %s: already managed by %s", externalFileName, targetName, state.SourceName())
+	}
+	refreshPeriod := time.Duration(0)
+	if external.RefreshPeriod != "" {
+		var err error
+		refreshPeriod, err = time.ParseDuration(external.RefreshPeriod)
+		if err != nil {
+			return errors.Wrapf(err, "%s: %s", externalFileName, targetName)
+		}
+	}
+	for _, pattern := range append(append([]string(nil), external.Include...), external.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "%s: %s: %s", externalFileName, targetName, pattern)
+		}
+	}
+	dirs, files, err := rs.externalParentDir(fs, externalFileName, targetName)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(targetName)
+	switch external.Type {
+	case ExternalTypeArchive:
+		data, ok, err := rs.fetchExternal(fs, external, refreshPeriod, rs.FetchExternals)
+		if err != nil {
+			return errors.Wrapf(err, "%s: %s", externalFileName, targetName)
+		}
+		dirState := newExternalDirState(externalFileName, 0777)
+		dirs[name] = dirState
+		if !ok {
+			return nil
+		}
+		format := external.Format
+		if format == "" {
+			format = ArchiveFormatFromName(external.URL)
+		}
+		var entries []*importEntry
+		switch format {
+		case ArchiveFormatTar:
+			entries, err = readTarImportEntries(bytes.NewReader(data))
+		case ArchiveFormatTarGz:
+			entries, err = readTarGzImportEntries(bytes.NewReader(data))
+		case ArchiveFormatZip:
+			entries, err = readZipImportEntries(bytes.NewReader(data))
+		default:
+			err = errors.Errorf("%s: unknown archive format", format)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "%s: %s", externalFileName, targetName)
+		}
+		for _, entry := range entries {
+			entryName, err := stripComponents(entry.name, external.StripComponents)
+			if err != nil {
+				return errors.Wrapf(err, "%s: %s", externalFileName, targetName)
+			}
+			if entryName == "" || !external.include(entryName) {
+				continue
+			}
+			if entry.mode.IsDir() {
+				dirState.addExternalDir(externalFileName, entryName, entry.mode)
+			} else {
+				dirState.addExternalFile(externalFileName, entryName, entry.mode, newLazyContents(entry.contents))
+			}
+		}
+	case ExternalTypeFile:
+		mode := os.FileMode(0666)
+		if external.Executable {
+			mode = 0777
+		}
+		files[name] = &FileState{
+			sourceName: externalFileName,
+			external:   true,
+			Empty:      true,
+			Mode:       mode,
+			// The file is only fetched when its contents are needed.
+			contents: newLazyContentsFunc(func() ([]byte, error) {
+				data, _, err := rs.fetchExternal(fs, external, refreshPeriod, true)
+				if err != nil {
+					return nil, errors.Wrapf(err, "%s: %s", externalFileName, targetName)
+				}
+				return data, nil
+			}),
+		}
+	case ExternalTypeGitRepo:
+		repoDir, err := rs.fetchExternalGitRepo(fs, external, refreshPeriod)
+		if err != nil {
+			return errors.Wrapf(err, "%s: %s", externalFileName, targetName)
+		}
+		dirState := newExternalDirState(externalFileName, 0777)
+		dirs[name] = dirState
+		if repoDir == "" {
+			return nil
+		}
+		if err := afero.Walk(fs, repoDir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			entryName, err := filepath.Rel(repoDir, path)
+			if err != nil {
+				return err
+			}
+			switch {
+			case entryName == ".":
+				return nil
+			case entryName == ".git":
+				return filepath.SkipDir
+			case !external.include(entryName):
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			case fi.Mode().IsRegular():
+				dirState.addExternalFile(externalFileName, entryName, fi.Mode(), newLazyContentsFunc(func() ([]byte, error) {
+					return afero.ReadFile(fs, path)
+				}))
+			case fi.IsDir():
+				dirState.addExternalDir(externalFileName, entryName, fi.Mode())
+			default:
+				return errors.Errorf("%s: not a regular file or directory", path)
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "%s: %s", externalFileName, targetName)
+		}
+	default:
+		return errors.Errorf("%s: %s: unknown type %q", externalFileName, targetName, external.Type)
+	}
+	return nil
+}
+
+// externalParentDir returns the directories and files of the parent directory
+// of targetName, adding any missing parent directories. Missing parent
+// directories that already exist in the target directory are added with their
+// current permissions so that applying them does not change them.
+func (rs *RootState) externalParentDir(fs afero.Fs, externalFileName, targetName string) (map[string]*DirState, map[string]*FileState, error) {
+	dirs, files := rs.Dirs, rs.Files
+	parentDirName := filepath.Dir(targetName)
+	if parentDirName == "." {
+		return dirs, files, nil
+	}
+	components := splitPathList(parentDirName)
+	for i, component := range components {
+		if _, ok := files[component]; ok {
+			return nil, nil, errors.Errorf("%s: %s: %s is a file", externalFileName, targetName, filepath.Join(components[:i+1]...))
+		}
+		dirState, ok := dirs[component]
+		if !ok {
+			dirState = newExternalDirState(externalFileName, 0777)
+			if fi, err := fs.Stat(filepath.Join(rs.TargetDir, filepath.Join(components[:i+1]...))); err == nil && fi.IsDir() {
+				dirState.Mode = os.ModeDir | fi.Mode()&os.ModePerm
+				dirState.exactMode = true
+			}
+			dirs[component] = dirState
+		}
+		dirs, files = dirState.Dirs, dirState.Files
+	}
+	return dirs, files, nil
+}
+
+// fetchExternal returns the contents of external's URL and verifies its
+// checksum. Remote URLs are cached in rs.CacheDir, if set, and fetched again
+// if the cached copy is older than refreshPeriod. If fetching again fails then
+// the stale cached copy is used. If fetch is false then remote URLs are never
+// fetched, and ok is false if there is no cached copy.
+func (rs *RootState) fetchExternal(fs afero.Fs, external *External, refreshPeriod time.Duration, fetch bool) (data []byte, ok bool, err error) {
+	u, err := url.Parse(external.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		data, err := afero.ReadFile(fs, rs.externalLocalPath(external.URL))
+		if err != nil {
+			return nil, false, err
+		}
+		return data, true, external.verify(data)
+	}
+
+	cachePath := ""
+	var cachedData []byte
+	if rs.CacheDir != "" {
+		cachePath = rs.externalCachePath(external.URL)
+		if fi, err := fs.Stat(cachePath); err == nil {
+			cachedData, err = afero.ReadFile(fs, cachePath)
+			if err != nil {
+				return nil, false, err
+			}
+			if !fetch || !isStale(fi, refreshPeriod) {
+				return cachedData, true, external.verify(cachedData)
+			}
+		}
+	}
+	if !fetch {
+		return nil, false, nil
+	}
+	data, err = httpGet(external.URL)
+	if err != nil {
+		if cachedData != nil {
+			return cachedData, true, external.verify(cachedData)
+		}
+		return nil, false, err
+	}
+	// Only cache data that has the expected checksum.
+	if err := external.verify(data); err != nil {
+		return nil, false, err
+	}
+	if cachePath != "" {
+		if err := fs.MkdirAll(filepath.Dir(cachePath), 0777); err != nil {
+			return nil, false, err
+		}
+		if err := afero.WriteFile(fs, cachePath, data, 0666); err != nil {
+			return nil, false, err
+		}
+	}
+	return data, true, nil
+}
+
+// fetchExternalGitRepo clones external's repository into rs.CacheDir, or
+// pulls it if the clone is older than refreshPeriod, and returns the
+// directory of the clone. If pulling fails then the existing clone is used.
+// If rs.FetchExternals is false then the repository is neither cloned nor
+// pulled, and the returned directory is empty if it has not been cloned yet.
+// git runs on the real filesystem, so fs must be an *afero.OsFs.
+func (rs *RootState) fetchExternalGitRepo(fs afero.Fs, external *External, refreshPeriod time.Duration) (string, error) {
+	if _, ok := fs.(*afero.OsFs); !ok {
+		return "", errors.New("git-repo requires the real filesystem")
+	}
+	if rs.CacheDir == "" {
+		return "", errors.New("git-repo requires a cache directory")
+	}
+	if external.SHA256 != "" || external.StripComponents != 0 {
+		return "", errors.New("sha256 and stripComponents are not supported for git-repo")
+	}
+	repoURL := external.URL
+	cloneArgs := []string{"clone", "--quiet"}
+	if isRemoteGitURL(repoURL) {
+		// Shallow clones are only supported for remote repositories.
+		cloneArgs = append(cloneArgs, "--depth", "1")
+	} else {
+		repoURL = rs.externalLocalPath(repoURL)
+	}
+	repoDir := rs.externalCachePath(repoURL)
+	fi, err := os.Stat(repoDir)
+	switch {
+	case os.IsNotExist(err) && !rs.FetchExternals:
+		return "", nil
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(filepath.Dir(repoDir), 0777); err != nil {
+			return "", err
+		}
+		if err := runGit(append(cloneArgs, repoURL, repoDir)...); err != nil {
+			return "", err
+		}
+	case err != nil:
+		return "", err
+	case rs.FetchExternals && isStale(fi, refreshPeriod):
+		if err := runGit("-C", repoDir, "pull", "--quiet", "--ff-only"); err != nil {
+			return repoDir, nil
+		}
+		now := time.Now()
+		if err := os.Chtimes(repoDir, now, now); err != nil {
+			return "", err
+		}
+	}
+	return repoDir, nil
+}
+
+// externalCachePath returns the path in rs.CacheDir at which the contents of
+// rawurl are cached.
+func (rs *RootState) externalCachePath(rawurl string) string {
+	sum := sha256.Sum256([]byte(rawurl))
+	return filepath.Join(rs.CacheDir, "external", hex.EncodeToString(sum[:]))
+}
+
+// externalLocalPath returns the local path of rawurl, which is a file URL or
+// a path relative to the source directory.
+func (rs *RootState) externalLocalPath(rawurl string) string {
+	if u, err := url.Parse(rawurl); err == nil && u.Scheme == "file" {
+		return u.Path
+	}
+	if filepath.IsAbs(rawurl) {
+		return rawurl
+	}
+	return filepath.Join(rs.SourceDir, rawurl)
+}
+
+// isRemoteGitURL returns true if rawurl is a URL or uses git's scp-like
+// syntax, for example git@github.com:user/repo.git, and false if it is a local
+// path.
+func isRemoteGitURL(rawurl string) bool {
+	if u, err := url.Parse(rawurl); err == nil && u.Scheme != "" {
+		return true
+	}
+	// git treats anything with a colon before the first slash as scp-like.
+	i := strings.IndexByte(rawurl, ':')
+	return i > 0 && !strings.Contains(rawurl[:i], "/") && filepath.VolumeName(rawurl) == ""
+}
+
+// include returns true if the archive entry or repository file name should be
+// included.
+func (e *External) include(name string) bool {
+	if len(e.Include) != 0 && !matchAnyPathPattern(name, e.Include) {
+		return false
+	}
+	return !matchAnyPathPattern(name, e.Exclude)
+}
+
+// verify returns an error if e has a checksum and data does not match it.
+func (e *External) verify(data []byte) error {
+	if e.SHA256 == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, e.SHA256) {
+		return errors.Errorf("%s: checksum mismatch: got %s, want %s", e.URL, got, e.SHA256)
+	}
+	return nil
+}
+
+// IsExternal returns true if state is populated from an externals file rather
+// than from its own source file or directory. The source name of such a state
+// is the name of the externals file.
+func IsExternal(state Stater) bool {
+	switch state := state.(type) {
+	case *DirState:
+		return state.external
+	case *FileState:
+		return state.external
+	default:
+		return false
+	}
+}
+
+// newExternalDirState returns a new DirState for a directory populated from
+// externalFileName.
+func newExternalDirState(externalFileName string, mode os.FileMode) *DirState {
+	ds := newDirState(externalFileName, os.ModeDir|mode)
+	ds.external = true
+	return ds
+}
+
+// addExternalDir adds the directory name, relative to ds, with mode.
+func (ds *DirState) addExternalDir(externalFileName, name string, mode os.FileMode) {
+	dirs := ds.externalParentDirs(externalFileName, name)
+	base := filepath.Base(name)
+	if dirState, ok := dirs[base]; ok {
+		dirState.Mode = os.ModeDir | mode&os.ModePerm
+		return
+	}
+	dirs[base] = newExternalDirState(externalFileName, mode&os.ModePerm)
+}
+
+// addExternalFile adds the file name, relative to ds, with mode and contents.
+func (ds *DirState) addExternalFile(externalFileName, name string, mode os.FileMode, contents *lazyContents) {
+	ds.externalParentDirs(externalFileName, name)
+	parent := ds
+	if parentDirName := filepath.Dir(name); parentDirName != "." {
+		for _, component := range splitPathList(parentDirName) {
+			parent = parent.Dirs[component]
+		}
+	}
+	parent.Files[filepath.Base(name)] = &FileState{
+		sourceName: externalFileName,
+		external:   true,
+		Empty:      true,
+		Mode:       mode & os.ModePerm,
+		contents:   contents,
+	}
+}
+
+// externalParentDirs returns the subdirectories of name's parent directory,
+// relative to ds, adding any missing directories.
+func (ds *DirState) externalParentDirs(externalFileName, name string) map[string]*DirState {
+	dirs := ds.Dirs
+	if parentDirName := filepath.Dir(name); parentDirName != "." {
+		for _, component := range splitPathList(parentDirName) {
+			dirState, ok := dirs[component]
+			if !ok {
+				dirState = newExternalDirState(externalFileName, 0777)
+				dirs[component] = dirState
+			}
+			dirs = dirState.Dirs
+		}
+	}
+	return dirs
+}
+
+// isStale returns true if fi was last modified more than refreshPeriod ago.
+// If refreshPeriod is zero then fi is never stale.
+func isStale(fi os.FileInfo, refreshPeriod time.Duration) bool {
+	return refreshPeriod != 0 && time.Since(fi.ModTime()) > refreshPeriod
+}
+
+// httpGet returns the body of rawurl, which must be fetched with status OK
+// within externalHTTPTimeout.
+func httpGet(rawurl string) ([]byte, error) {
+	client := &http.Client{Timeout: externalHTTPTimeout}
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: %s", rawurl, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func runGit(args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,405 @@
+package chezmoi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/absfs/afero"
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func makeTestTarGz(entries []testArchiveEntry) ([]byte, error) {
+	data, err := makeTestTar(entries)
+	if err != nil {
+		return nil, err
+	}
+	b := &bytes.Buffer{}
+	w := gzip.NewWriter(b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// dumpPaths returns the paths, types, and modes of the entries in rs.
+func dumpPaths(rs *RootState) ([]string, error) {
+	entries, err := rs.Dump(nil, DumpOptions{OmitContents: true})
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, entry.Path+" "+entry.Type+" "+entry.Mode)
+	}
+	return paths, nil
+}
+
+func TestPopulateExternals(t *testing.T) {
+	archive, err := makeTestTarGz([]testArchiveEntry{
+		{name: "oh-my-zsh-master/", mode: 0755},
+		{name: "oh-my-zsh-master/oh-my-zsh.sh", mode: 0644, contents: "# oh-my-zsh\n"},
+		{name: "oh-my-zsh-master/tools/", mode: 0755},
+		{name: "oh-my-zsh-master/tools/upgrade.sh", mode: 0755, contents: "#!/bin/sh\n"},
+		{name: "oh-my-zsh-master/cache/", mode: 0755},
+		{name: "oh-my-zsh-master/cache/.keep", mode: 0644},
+	})
+	if err != nil {
+		t.Fatalf("makeTestTarGz(_) == _, %v, want _, <nil>", err)
+	}
+	for _, tc := range []struct {
+		name      string
+		fsMap     map[string]string
+		wantPaths []string
+		wantErr   bool
+	}{
+		{
+			name: "yaml_archive",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiexternal.yaml": ".oh-my-zsh:\n  type: archive\n  url: .oh-my-zsh.tar.gz\n  stripComponents: 1\n  exclude: [cache]\n",
+				"/home/user/.chezmoi/.oh-my-zsh.tar.gz":     string(archive),
+			},
+			wantPaths: []string{
+				".oh-my-zsh dir 0755",
+				".oh-my-zsh/oh-my-zsh.sh file 0644",
+				".oh-my-zsh/tools dir 0755",
+				".oh-my-zsh/tools/upgrade.sh file 0755",
+			},
+		},
+		{
+			name: "toml_archive_include",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiexternal.toml": "[\".oh-my-zsh\"]\ntype = \"archive\"\nurl = \"file:///archives/oh-my-zsh.tgz\"\nstripComponents = 1\ninclude = [\"tools\"]\n",
+				"/archives/oh-my-zsh.tgz":                   string(archive),
+			},
+			wantPaths: []string{
+				".oh-my-zsh dir 0755",
+				".oh-my-zsh/tools dir 0755",
+				".oh-my-zsh/tools/upgrade.sh file 0755",
+			},
+		},
+		{
+			name: "json_file_template",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiexternal.json": `{".local/bin/{{ .name }}": {"type": "file", "url": "/downloads/tool", "executable": true, "sha256": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}}`,
+				"/home/user/.local/.keep":                   "",
+				"/downloads/tool":                           "test",
+			},
+			wantPaths: []string{
+				".local dir 0777",
+				".local/bin dir 0755",
+				".local/bin/tool file 0755",
+			},
+		},
+		{
+			name: "checksum_mismatch",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiexternal.yaml": ".tool:\n  type: file\n  url: /downloads/tool\n  sha256: 0000\n",
+				"/downloads/tool": "test",
+			},
+			wantErr: true,
+		},
+		{
+			name: "already_managed",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiexternal.yaml": ".bashrc:\n  type: file\n  url: /downloads/bashrc\n",
+				"/home/user/.chezmoi/dot_bashrc":            "bar",
+				"/downloads/bashrc":                         "baz",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown_type",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiexternal.yaml": ".tool:\n  type: symlink\n  url: /downloads/tool\n",
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(tc.fsMap)
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(%v) == %v, %v, want !<nil>, <nil>", tc.fsMap, fs, err)
+			}
+			rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", map[string]interface{}{"name": "tool"})
+			err = rs.Populate(fs)
+			if err == nil && tc.wantErr {
+				// Files are only fetched when their contents are needed.
+				_, err = rs.Dump(nil, DumpOptions{})
+			}
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("rs.Populate(_) and rs.Dump(_, _) == <nil>, want !<nil>")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+			}
+			gotPaths, err := dumpPaths(rs)
+			if err != nil {
+				t.Fatalf("dumpPaths(_) == %v, %v, want !<nil>, <nil>", gotPaths, err)
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.wantPaths, gotPaths); !equal {
+				t.Errorf("rs.Populate(_) diff:\n%s\n", diff)
+			}
+		})
+	}
+}
+
+func TestPopulateExternalsCache(t *testing.T) {
+	requests := 0
+	unavailable := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("contents"))
+	}))
+	defer server.Close()
+
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/.chezmoiexternal.yaml": ".file:\n  type: file\n  url: " + server.URL + "/file\n  refreshPeriod: 1h\n",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	populate := func() {
+		rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+		rs.CacheDir = "/home/user/.chezmoi.cache"
+		if err := rs.Populate(fs); err != nil {
+			t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+		}
+		if contents, err := rs.Files[".file"].Contents(); err != nil || string(contents) != "contents" {
+			t.Errorf("rs.Files[\".file\"].Contents() == %q, %v, want \"contents\", <nil>", contents, err)
+		}
+	}
+
+	populate()
+	populate()
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+
+	cachePath := filepath.Join("/home/user/.chezmoi.cache", "external")
+	cacheFileInfos, err := afero.ReadDir(fs, cachePath)
+	if err != nil || len(cacheFileInfos) != 1 {
+		t.Fatalf("afero.ReadDir(_, %q) == %v, %v, want one file, <nil>", cachePath, cacheFileInfos, err)
+	}
+	makeStale := func() {
+		old := time.Now().Add(-2 * time.Hour)
+		if err := fs.Chtimes(filepath.Join(cachePath, cacheFileInfos[0].Name()), old, old); err != nil {
+			t.Fatalf("fs.Chtimes(_, _, _) == %v, want <nil>", err)
+		}
+	}
+	makeStale()
+	populate()
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+
+	// A stale cached copy is used if fetching again fails.
+	makeStale()
+	unavailable = true
+	populate()
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+}
+
+func TestIsRemoteGitURL(t *testing.T) {
+	for rawurl, want := range map[string]bool{
+		"git@github.com:user/repo.git":     true,
+		"github.com:user/repo.git":         true,
+		"https://github.com/user/repo.git": true,
+		"ssh://git@github.com/user/repo":   true,
+		"file:///home/user/repo":           true,
+		"repo":                             false,
+		"../repo":                          false,
+		"/home/user/repo":                  false,
+		"./dir:with/colon":                 false,
+	} {
+		if got := isRemoteGitURL(rawurl); got != want {
+			t.Errorf("isRemoteGitURL(%q) == %v, want %v", rawurl, got, want)
+		}
+	}
+}
+
+func TestPopulateExternalsFetch(t *testing.T) {
+	archive, err := makeTestTarGz([]testArchiveEntry{
+		{name: "dir/", mode: 0755},
+		{name: "dir/file", mode: 0644, contents: "contents"},
+	})
+	if err != nil {
+		t.Fatalf("makeTestTarGz(_) == _, %v, want _, <nil>", err)
+	}
+	archiveRequests, fileRequests := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/archive.tar.gz":
+			archiveRequests++
+			w.Write(archive)
+		default:
+			fileRequests++
+			w.Write([]byte("contents"))
+		}
+	}))
+	defer server.Close()
+
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/.chezmoiexternal.yaml": ".archive:\n  type: archive\n  url: " + server.URL + "/archive.tar.gz\n" +
+			".file:\n  type: file\n  url: " + server.URL + "/file\n",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	populate := func(fetchExternals bool, wantPaths []string) {
+		rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+		rs.CacheDir = "/home/user/.chezmoi.cache"
+		rs.FetchExternals = fetchExternals
+		if err := rs.Populate(fs); err != nil {
+			t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+		}
+		// Files are only fetched when their contents are needed.
+		if fileRequests != 0 {
+			t.Errorf("got %d file requests, want 0", fileRequests)
+		}
+		gotPaths, err := dumpPaths(rs)
+		if err != nil {
+			t.Fatalf("dumpPaths(_) == %v, %v, want !<nil>, <nil>", gotPaths, err)
+		}
+		if diff, equal := messagediff.PrettyDiff(wantPaths, gotPaths); !equal {
+			t.Errorf("rs.Populate(_) diff:\n%s\n", diff)
+		}
+		fileRequests = 0
+	}
+
+	// Without fetching, the archive is not downloaded and is empty.
+	populate(false, []string{
+		".archive dir 0755",
+		".file file 0644",
+	})
+	if archiveRequests != 0 {
+		t.Errorf("got %d archive requests, want 0", archiveRequests)
+	}
+
+	wantPaths := []string{
+		".archive dir 0755",
+		".archive/dir dir 0755",
+		".archive/dir/file file 0644",
+		".file file 0644",
+	}
+	populate(true, wantPaths)
+	if archiveRequests != 1 {
+		t.Errorf("got %d archive requests, want 1", archiveRequests)
+	}
+
+	// Without fetching, the cached archive is used.
+	populate(false, wantPaths)
+	if archiveRequests != 1 {
+		t.Errorf("got %d archive requests, want 1", archiveRequests)
+	}
+}
+
+func TestPopulateExternalGitRepoRequiresOsFs(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/.chezmoiexternal.yaml": ".vim/pack/test:\n  type: git-repo\n  url: https://example.com/repo.git\n",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	rs.CacheDir = "/home/user/.chezmoi.cache"
+	if err := rs.Populate(fs); err == nil {
+		t.Errorf("rs.Populate(_) == <nil>, want !<nil>")
+	}
+}
+
+func TestPopulateExternalGitRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	tempDir, err := ioutil.TempDir("", "chezmoi")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(_, _) == %v, %v, want !<nil>, <nil>", tempDir, err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	repoDir := filepath.Join(tempDir, "repo")
+	if err := os.MkdirAll(filepath.Join(repoDir, "plugin"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repoDir, "plugin", "plugin.vim"), []byte("\" plugin\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet", repoDir},
+		{"-C", repoDir, "add", "."},
+		{"-C", repoDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "initial"},
+	} {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, output)
+		}
+	}
+
+	sourceDir := filepath.Join(tempDir, "source")
+	if err := os.MkdirAll(sourceDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sourceDir, ".chezmoiexternal.yaml"), []byte(".vim/pack/test:\n  type: git-repo\n  url: "+repoDir+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	populate := func(fetchExternals bool, wantPaths []string) {
+		rs := NewRootState(filepath.Join(tempDir, "home"), 022, sourceDir, nil)
+		rs.CacheDir = filepath.Join(tempDir, "cache")
+		rs.FetchExternals = fetchExternals
+		if err := rs.Populate(afero.NewOsFs()); err != nil {
+			t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+		}
+		gotPaths, err := dumpPaths(rs)
+		if err != nil {
+			t.Fatalf("dumpPaths(_) == %v, %v, want !<nil>, <nil>", gotPaths, err)
+		}
+		if diff, equal := messagediff.PrettyDiff(wantPaths, gotPaths); !equal {
+			t.Errorf("rs.Populate(_) diff:\n%s\n", diff)
+		}
+	}
+
+	// Without fetching, the repository is not cloned.
+	populate(false, []string{
+		".vim dir 0755",
+		".vim/pack dir 0755",
+		".vim/pack/test dir 0755",
+	})
+
+	wantPaths := []string{
+		".vim dir 0755",
+		".vim/pack dir 0755",
+		".vim/pack/test dir 0755",
+		".vim/pack/test/plugin dir 0755",
+		".vim/pack/test/plugin/plugin.vim file 0644",
+	}
+	populate(true, wantPaths)
+
+	// If pulling a stale clone fails then the existing clone is used.
+	if err := ioutil.WriteFile(filepath.Join(sourceDir, ".chezmoiexternal.yaml"), []byte(".vim/pack/test:\n  type: git-repo\n  url: "+repoDir+"\n  refreshPeriod: 1ns\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(repoDir); err != nil {
+		t.Fatal(err)
+	}
+	populate(true, wantPaths)
+}
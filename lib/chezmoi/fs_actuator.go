@@ -5,6 +5,7 @@ import (
 
 	"github.com/absfs/afero"
 	"github.com/google/renameio"
+	"github.com/pkg/errors"
 )
 
 // An FsActuator makes changes to an afero.Fs.
@@ -26,6 +27,14 @@ func NewFsActuator(fs afero.Fs, targetDir string) *FsActuator {
 	}
 }
 
+// Symlink implements Symlinker.Symlink.
+func (a *FsActuator) Symlink(oldname, newname string) error {
+	if _, ok := a.Fs.(*afero.OsFs); ok {
+		return os.Symlink(oldname, newname)
+	}
+	return errors.Errorf("%s: symlinks not supported", newname)
+}
+
 // WriteFile implements Actuator.WriteFile.
 func (a *FsActuator) WriteFile(name string, contents []byte, mode os.FileMode, currentContents []byte) error {
 	// Special case: if writing to the real filesystem, use github.com/google/renameio
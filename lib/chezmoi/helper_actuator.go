@@ -0,0 +1,63 @@
+package chezmoi
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// A HelperActuator makes changes by running commands through a helper
+// command, for example sudo, so that it can change targets that the current
+// user cannot write.
+type HelperActuator struct {
+	helper []string
+}
+
+// NewHelperActuator returns a new HelperActuator that prefixes all commands
+// with helper.
+func NewHelperActuator(helper []string) *HelperActuator {
+	return &HelperActuator{
+		helper: helper,
+	}
+}
+
+// Chmod implements Actuator.Chmod.
+func (a *HelperActuator) Chmod(name string, mode os.FileMode) error {
+	return a.run(nil, "chmod", fmt.Sprintf("%o", mode), name)
+}
+
+// Mkdir implements Actuator.Mkdir.
+func (a *HelperActuator) Mkdir(name string, mode os.FileMode) error {
+	return a.run(nil, "mkdir", "-m", fmt.Sprintf("%o", mode), name)
+}
+
+// RemoveAll implements Actuator.RemoveAll.
+func (a *HelperActuator) RemoveAll(name string) error {
+	return a.run(nil, "rm", "-rf", name)
+}
+
+// Rename implements Actuator.Rename.
+func (a *HelperActuator) Rename(oldpath, newpath string) error {
+	return a.run(nil, "mv", oldpath, newpath)
+}
+
+// Symlink implements Symlinker.Symlink.
+func (a *HelperActuator) Symlink(oldname, newname string) error {
+	return a.run(nil, "ln", "-s", oldname, newname)
+}
+
+// WriteFile implements Actuator.WriteFile.
+func (a *HelperActuator) WriteFile(name string, contents []byte, mode os.FileMode, currentContents []byte) error {
+	return a.run(contents, "install", "-m", fmt.Sprintf("%o", mode), "/dev/stdin", name)
+}
+
+// run runs argv through a's helper with stdin as its standard input.
+func (a *HelperActuator) run(stdin []byte, argv ...string) error {
+	argv = append(append([]string{}, a.helper...), argv...)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,141 @@
+package chezmoi
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/d4l3k/messagediff"
+)
+
+// newFakeHelper returns a helper command that appends its arguments and
+// standard input to logPath, one line each, instead of running them.
+func newFakeHelper(logPath string) []string {
+	return []string{"sh", "-c", `echo "$@" >> "$0"; cat >> "$0"; echo >> "$0"`, logPath}
+}
+
+func TestHelperActuator(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	tempDir, err := ioutil.TempDir("", "chezmoi")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(_, _) == %v, %v, want !<nil>, <nil>", tempDir, err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, tc := range []struct {
+		name    string
+		f       func(*HelperActuator) error
+		wantLog string
+	}{
+		{
+			name:    "chmod",
+			f:       func(a *HelperActuator) error { return a.Chmod("/etc/hosts", 0644) },
+			wantLog: "chmod 644 /etc/hosts\n\n",
+		},
+		{
+			name:    "mkdir",
+			f:       func(a *HelperActuator) error { return a.Mkdir("/etc/app", 0755) },
+			wantLog: "mkdir -m 755 /etc/app\n\n",
+		},
+		{
+			name:    "remove_all",
+			f:       func(a *HelperActuator) error { return a.RemoveAll("/etc/app") },
+			wantLog: "rm -rf /etc/app\n\n",
+		},
+		{
+			name:    "rename",
+			f:       func(a *HelperActuator) error { return a.Rename("/etc/hosts", "/etc/hosts.old") },
+			wantLog: "mv /etc/hosts /etc/hosts.old\n\n",
+		},
+		{
+			name:    "symlink",
+			f:       func(a *HelperActuator) error { return a.Symlink("hosts.old", "/etc/hosts") },
+			wantLog: "ln -s hosts.old /etc/hosts\n\n",
+		},
+		{
+			name: "write_file",
+			f: func(a *HelperActuator) error {
+				return a.WriteFile("/etc/hosts", []byte("127.0.0.1 localhost"), 0600, nil)
+			},
+			wantLog: "install -m 600 /dev/stdin /etc/hosts\n127.0.0.1 localhost\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logPath := filepath.Join(tempDir, tc.name+".log")
+			if err := tc.f(NewHelperActuator(newFakeHelper(logPath))); err != nil {
+				t.Fatalf("got %v, want <nil>", err)
+			}
+			gotLog, err := ioutil.ReadFile(logPath)
+			if err != nil {
+				t.Fatalf("ioutil.ReadFile(%q) == %q, %v, want _, <nil>", logPath, gotLog, err)
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.wantLog, string(gotLog)); !equal {
+				t.Errorf("log diff:\n%s\n", diff)
+			}
+		})
+	}
+}
+
+func TestHelperActuatorError(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	a := NewHelperActuator([]string{"sh", "-c", "exit 3", "helper"})
+	for name, f := range map[string]func() error{
+		"chmod":      func() error { return a.Chmod("/etc/hosts", 0644) },
+		"mkdir":      func() error { return a.Mkdir("/etc/app", 0755) },
+		"remove_all": func() error { return a.RemoveAll("/etc/app") },
+		"rename":     func() error { return a.Rename("/etc/hosts", "/etc/hosts.old") },
+		"symlink":    func() error { return a.Symlink("hosts.old", "/etc/hosts") },
+		"write_file": func() error { return a.WriteFile("/etc/hosts", nil, 0644, nil) },
+	} {
+		err := f()
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+			t.Errorf("%s: got %v, want exit status 3", name, err)
+		}
+	}
+	if err := NewHelperActuator([]string{"chezmoi-no-such-helper"}).Chmod("/etc/hosts", 0644); err == nil {
+		t.Errorf("missing helper: got <nil>, want !<nil>")
+	}
+}
+
+func TestHelperActuatorChanges(t *testing.T) {
+	for _, name := range []string{"env", "chmod", "install", "mkdir", "mv", "rm"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+	}
+	tempDir, err := ioutil.TempDir("", "chezmoi")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(_, _) == %v, %v, want !<nil>, <nil>", tempDir, err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// env runs the commands directly, like sudo would for a user allowed to
+	// run them.
+	a := NewHelperActuator([]string{"env"})
+	dir := filepath.Join(tempDir, "dir")
+	for _, f := range []func() error{
+		func() error { return a.Mkdir(dir, 0755) },
+		func() error { return a.WriteFile(filepath.Join(dir, "old"), []byte("contents"), 0600, nil) },
+		func() error { return a.Rename(filepath.Join(dir, "old"), filepath.Join(dir, "new")) },
+		func() error { return a.Chmod(filepath.Join(dir, "new"), 0640) },
+		func() error { return a.WriteFile(filepath.Join(dir, "removed"), nil, 0644, nil) },
+		func() error { return a.RemoveAll(filepath.Join(dir, "removed")) },
+	} {
+		if err := f(); err != nil {
+			t.Fatalf("got %v, want <nil>", err)
+		}
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil || len(infos) != 1 || infos[0].Name() != "new" || infos[0].Mode()&os.ModePerm != 0640 {
+		t.Fatalf("ioutil.ReadDir(%q) == %v, %v, want [new with mode 0640], <nil>", dir, infos, err)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(dir, "new")); err != nil || string(contents) != "contents" {
+		t.Errorf("ioutil.ReadFile(_) == %q, %v, want %q, <nil>", contents, err, "contents")
+	}
+}
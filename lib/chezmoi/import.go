@@ -0,0 +1,305 @@
+package chezmoi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+)
+
+// ImportOptions are options to RootState.Import.
+type ImportOptions struct {
+	// Format is one of ArchiveFormatTar, ArchiveFormatTarGz, or
+	// ArchiveFormatZip. If it is empty then ArchiveFormatTar is used.
+	Format string
+	// StripComponents is the number of leading path components to remove
+	// from each entry's name. Entries with no remaining components are
+	// ignored.
+	StripComponents int
+	// Destination is the directory in the target directory into which
+	// entries are imported. If it is empty then the target directory is used.
+	Destination string
+	// Exact, if true, adds patterns to the remove file so that targets in
+	// imported directories that are not in the archive are removed.
+	Exact bool
+}
+
+// An importEntry is a single entry read from an archive.
+type importEntry struct {
+	name     string
+	mode     os.FileMode
+	contents []byte
+}
+
+// An importFileInfo is the os.FileInfo of an importEntry.
+type importFileInfo struct {
+	name string
+	mode os.FileMode
+	size int64
+}
+
+// Import adds the files and directories in the archive read from r to rs.
+// Each entry's name is converted to a source name in the same way as Add.
+// Targets that have already been added are not changed.
+func (rs *RootState) Import(fs afero.Fs, r io.Reader, importOptions ImportOptions, actuator Actuator) error {
+	destination := importOptions.Destination
+	if destination == "" {
+		destination = rs.TargetDir
+	}
+	if destination != rs.TargetDir && !filepath.HasPrefix(destination, rs.TargetDir+string(os.PathSeparator)) {
+		return errors.Errorf("%s: outside target directory", destination)
+	}
+	destinationName, err := filepath.Rel(rs.TargetDir, destination)
+	if err != nil {
+		return err
+	}
+
+	var entries []*importEntry
+	switch importOptions.Format {
+	case "", ArchiveFormatTar:
+		entries, err = readTarImportEntries(r)
+	case ArchiveFormatTarGz:
+		entries, err = readTarGzImportEntries(r)
+	case ArchiveFormatZip:
+		entries, err = readZipImportEntries(r)
+	default:
+		return errors.Errorf("%s: unknown archive format", importOptions.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name, err := stripComponents(entry.name, importOptions.StripComponents)
+		if err != nil {
+			return err
+		}
+		if name != "" {
+			name = filepath.Join(destinationName, name)
+		}
+		names = append(names, name)
+	}
+
+	// Directories that are not the parent of any other entry are empty.
+	// Directories that contain entries are made exact if
+	// importOptions.Exact is true.
+	nonEmptyDirNames := make(map[string]bool)
+	for _, name := range names {
+		for dirName := filepath.Dir(name); dirName != "." && !nonEmptyDirNames[dirName]; dirName = filepath.Dir(dirName) {
+			nonEmptyDirNames[dirName] = true
+		}
+	}
+
+	exactDirNames := make(map[string]bool)
+	for i, entry := range entries {
+		name := names[i]
+		if name == "" {
+			continue
+		}
+		if err := rs.importParentDirs(fs, name, actuator); err != nil {
+			return err
+		}
+		fi := &importFileInfo{
+			name: filepath.Base(name),
+			mode: entry.mode,
+			size: int64(len(entry.contents)),
+		}
+		contents := entry.contents
+		if err := rs.add(fs, AddOptions{Empty: true}, name, fi, func() ([]byte, error) {
+			return contents, nil
+		}, actuator); err != nil {
+			return err
+		}
+		if !entry.mode.IsDir() || nonEmptyDirNames[name] {
+			continue
+		}
+		// Add a .keep file so that the directory is managed by git, as Add
+		// does.
+		if err := actuator.WriteFile(filepath.Join(rs.SourceDir, rs.findDirState(name).sourceName, ".keep"), nil, 0666&^rs.Umask, nil); err != nil {
+			return err
+		}
+		exactDirNames[name] = true
+	}
+
+	if !importOptions.Exact {
+		return nil
+	}
+	for dirName := range nonEmptyDirNames {
+		// Only directories inside the destination are made exact, and never
+		// the target directory itself.
+		if dirName == destinationName || filepath.HasPrefix(dirName, destinationName+string(os.PathSeparator)) || destinationName == "." {
+			exactDirNames[dirName] = true
+		}
+	}
+	var sortedExactDirNames []string
+	for dirName := range exactDirNames {
+		sortedExactDirNames = append(sortedExactDirNames, dirName)
+	}
+	sort.Strings(sortedExactDirNames)
+	return rs.addRemovePatterns(fs, sortedExactDirNames, actuator)
+}
+
+// importParentDirs adds the parent directories of targetName, if needed. Parent
+// directories that already exist in the target directory are added with their
+// current permissions.
+func (rs *RootState) importParentDirs(fs afero.Fs, targetName string, actuator Actuator) error {
+	parentDirName := filepath.Dir(targetName)
+	if parentDirName == "." || rs.findDirState(parentDirName) != nil {
+		return nil
+	}
+	parentDir := filepath.Join(rs.TargetDir, parentDirName)
+	if fi, err := fs.Stat(parentDir); err == nil && fi.IsDir() {
+		return rs.Add(fs, AddOptions{}, parentDir, fi, actuator)
+	}
+	if err := rs.importParentDirs(fs, parentDirName, actuator); err != nil {
+		return err
+	}
+	return rs.add(fs, AddOptions{}, parentDirName, &importFileInfo{
+		name: filepath.Base(parentDirName),
+		mode: os.ModeDir | 0777&^rs.Umask,
+	}, nil, actuator)
+}
+
+// addRemovePatterns appends patterns matching the contents of each of
+// dirNames to the remove file, unless they are already present.
+func (rs *RootState) addRemovePatterns(fs afero.Fs, dirNames []string, actuator Actuator) error {
+	path := filepath.Join(rs.SourceDir, removeFileName)
+	contents, err := afero.ReadFile(fs, path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// The remove file is a template, so patterns must be quoted.
+	td, _, _, err := parseTemplateDirectives(contents)
+	if err != nil {
+		return errors.Wrap(err, removeFileName)
+	}
+	existingPatterns := make(map[string]bool)
+	for _, line := range strings.Split(string(contents), "\n") {
+		existingPatterns[strings.TrimSpace(line)] = true
+	}
+	newContents := append([]byte(nil), contents...)
+	if len(newContents) != 0 && !bytes.HasSuffix(newContents, []byte("\n")) {
+		newContents = append(newContents, '\n')
+	}
+	for _, dirName := range dirNames {
+		pattern := td.quote(filepath.Join(escapeGlob(dirName), "*"))
+		if existingPatterns[pattern] {
+			continue
+		}
+		existingPatterns[pattern] = true
+		newContents = append(newContents, []byte(pattern+"\n")...)
+	}
+	if bytes.Equal(newContents, contents) {
+		return nil
+	}
+	return actuator.WriteFile(path, newContents, 0666&^rs.Umask, contents)
+}
+
+// stripComponents returns name, a slash-separated archive entry name, with
+// its first n components removed and converted to a relative target name. It
+// returns an error if name is absolute or refers to a parent directory.
+func stripComponents(name string, n int) (string, error) {
+	name = path.Clean(name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", errors.Errorf("%s: invalid archive entry name", name)
+	}
+	if name == "." {
+		return "", nil
+	}
+	components := strings.Split(name, "/")
+	if n >= len(components) {
+		return "", nil
+	}
+	return filepath.Join(components[n:]...), nil
+}
+
+func readTarImportEntries(r io.Reader) ([]*importEntry, error) {
+	var entries []*importEntry
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entry := &importEntry{
+			name: header.Name,
+			mode: os.FileMode(header.Mode) & os.ModePerm,
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.mode |= os.ModeDir
+		case tar.TypeReg, tar.TypeRegA:
+			entry.contents, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("%s: not a regular file or directory", header.Name)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func readTarGzImportEntries(r io.Reader) ([]*importEntry, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return readTarImportEntries(gr)
+}
+
+func readZipImportEntries(r io.Reader) ([]*importEntry, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*importEntry
+	for _, f := range zr.File {
+		entry := &importEntry{
+			name: f.Name,
+			mode: f.Mode() & (os.ModeDir | os.ModePerm),
+		}
+		switch {
+		case f.Mode().IsDir():
+		case f.Mode().IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			entry.contents, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("%s: not a regular file or directory", f.Name)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (fi *importFileInfo) Name() string       { return fi.name }
+func (fi *importFileInfo) Size() int64        { return fi.size }
+func (fi *importFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *importFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *importFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *importFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,254 @@
+package chezmoi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+// A testArchiveEntry is an entry in an archive created by a test. Names ending
+// in a slash are directories.
+type testArchiveEntry struct {
+	name     string
+	mode     os.FileMode
+	contents string
+}
+
+func makeTestTar(entries []testArchiveEntry) ([]byte, error) {
+	b := &bytes.Buffer{}
+	w := tar.NewWriter(b)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     entry.name,
+			Mode:     int64(entry.mode),
+			Size:     int64(len(entry.contents)),
+		}
+		if entry.name[len(entry.name)-1] == '/' {
+			header.Typeflag = tar.TypeDir
+		}
+		if err := w.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(entry.contents)); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func makeTestZip(entries []testArchiveEntry) ([]byte, error) {
+	b := &bytes.Buffer{}
+	w := zip.NewWriter(b)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name}
+		if entry.name[len(entry.name)-1] == '/' {
+			header.SetMode(os.ModeDir | entry.mode)
+		} else {
+			header.SetMode(entry.mode)
+		}
+		fw, err := w.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write([]byte(entry.contents)); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func TestImport(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		fsMap         map[string]string
+		entries       []testArchiveEntry
+		importOptions ImportOptions
+		wantErr       bool
+		wantFsMap     map[string]string
+	}{
+		{
+			name: "tar",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.keep": "",
+			},
+			entries: []testArchiveEntry{
+				{name: "dotfiles/", mode: 0755},
+				{name: "dotfiles/.bashrc", mode: 0644, contents: "bar"},
+				{name: "dotfiles/.hushlogin", mode: 0644},
+				{name: "dotfiles/.ssh/", mode: 0700},
+				{name: "dotfiles/.ssh/config", mode: 0600, contents: "Host *\n"},
+				{name: "dotfiles/.vim/", mode: 0755},
+				{name: "dotfiles/bin/run", mode: 0755, contents: "#!/bin/sh\n"},
+			},
+			importOptions: ImportOptions{
+				StripComponents: 1,
+			},
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/.keep":                          "",
+				"/home/user/.chezmoi/dot_bashrc":                     "bar",
+				"/home/user/.chezmoi/empty_dot_hushlogin":            "",
+				"/home/user/.chezmoi/private_dot_ssh/private_config": "Host *\n",
+				"/home/user/.chezmoi/dot_vim/.keep":                  "",
+				"/home/user/.chezmoi/bin/executable_run":             "#!/bin/sh\n",
+			},
+		},
+		{
+			name: "zip_destination_exact",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiremove": "# comment\n.config/app/*",
+				"/home/user/.config/other":           "other",
+			},
+			entries: []testArchiveEntry{
+				{name: "config.toml", mode: 0644, contents: "a = 1\n"},
+				{name: "themes/dark.toml", mode: 0644, contents: "b = 2\n"},
+				{name: "cache/", mode: 0755},
+			},
+			importOptions: ImportOptions{
+				Format:      ArchiveFormatZip,
+				Destination: "/home/user/.config/app",
+				Exact:       true,
+			},
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiremove":                  "# comment\n.config/app/*\n.config/app/cache/*\n.config/app/themes/*\n",
+				"/home/user/.chezmoi/dot_config/app/config.toml":      "a = 1\n",
+				"/home/user/.chezmoi/dot_config/app/themes/dark.toml": "b = 2\n",
+				"/home/user/.chezmoi/dot_config/app/cache/.keep":      "",
+				"/home/user/.config/other":                            "other",
+			},
+		},
+		{
+			name: "exact_template_delimiters",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.keep": "",
+			},
+			entries: []testArchiveEntry{
+				{name: "{{ .x }}/", mode: 0755},
+			},
+			importOptions: ImportOptions{
+				Destination: "/home/user/.config",
+				Exact:       true,
+			},
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/.keep":                     "",
+				"/home/user/.chezmoi/.chezmoiremove":            ".config/*\n{{ \".config/{{ .x }}/*\" }}\n",
+				"/home/user/.chezmoi/dot_config/{{ .x }}/.keep": "",
+			},
+		},
+		{
+			name: "parent_directory",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.keep": "",
+			},
+			entries: []testArchiveEntry{
+				{name: "../.bashrc", mode: 0644, contents: "bar"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "outside_target_directory",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.keep": "",
+			},
+			importOptions: ImportOptions{
+				Destination: "/etc",
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(tc.fsMap)
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(%v) == %v, %v, want !<nil>, <nil>", tc.fsMap, fs, err)
+			}
+			var data []byte
+			if tc.importOptions.Format == ArchiveFormatZip {
+				data, err = makeTestZip(tc.entries)
+			} else {
+				data, err = makeTestTar(tc.entries)
+			}
+			if err != nil {
+				t.Fatalf("making archive: %v", err)
+			}
+			rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+			if err := rs.Populate(fs); err != nil {
+				t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+			}
+			err = rs.Import(fs, bytes.NewReader(data), tc.importOptions, NewFsActuator(fs, "/home/user"))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("rs.Import(_, _, %+v, _) == <nil>, want !<nil>", tc.importOptions)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rs.Import(_, _, %+v, _) == %v, want <nil>", tc.importOptions, err)
+			}
+			gotFsMap, err := absfstesting.MakeMapFs(fs)
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMapFs(_) == %v, %v, want !<nil>, <nil>", gotFsMap, err)
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.wantFsMap, gotFsMap); !equal {
+				t.Errorf("rs.Import(_, _, %+v, _) diff:\n%s\n", tc.importOptions, diff)
+			}
+			// The imported source directory must still be valid.
+			newRS := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+			if err := newRS.Populate(fs); err != nil {
+				t.Errorf("newRS.Populate(_) == %v, want <nil>", err)
+			}
+		})
+	}
+}
+
+func TestArchiveImportRoundTrip(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/dot_bashrc":                     "bar",
+		"/home/user/.chezmoi/empty_dot_hushlogin":            "",
+		"/home/user/.chezmoi/private_dot_ssh/private_config": "Host *\n",
+		"/home/user/.chezmoi/dot_vim/.keep":                  "",
+		"/home/user/.chezmoi/bin/executable_run":             "#!/bin/sh\n",
+		"/home/user/.imported/.keep":                         "",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	b := &bytes.Buffer{}
+	if err := rs.Archive(fs, b, 022, ArchiveOptions{}); err != nil {
+		t.Fatalf("rs.Archive(_, _, 022, _) == %v, want <nil>", err)
+	}
+	want, err := rs.Dump(nil, DumpOptions{})
+	if err != nil {
+		t.Fatalf("rs.Dump(nil, _) == %v, %v, want !<nil>, <nil>", want, err)
+	}
+
+	importedRS := NewRootState("/home/user", 022, "/home/user/.imported", nil)
+	if err := importedRS.Import(fs, b, ImportOptions{}, NewFsActuator(fs, "/home/user")); err != nil {
+		t.Fatalf("importedRS.Import(_, _, _, _) == %v, want <nil>", err)
+	}
+	populatedRS := NewRootState("/home/user", 022, "/home/user/.imported", nil)
+	if err := populatedRS.Populate(fs); err != nil {
+		t.Fatalf("populatedRS.Populate(_) == %v, want <nil>", err)
+	}
+	got, err := populatedRS.Dump(nil, DumpOptions{})
+	if err != nil {
+		t.Fatalf("populatedRS.Dump(nil, _) == %v, %v, want !<nil>, <nil>", got, err)
+	}
+	if diff, equal := messagediff.PrettyDiff(want, got); !equal {
+		t.Errorf("round trip diff:\n%s\n", diff)
+	}
+}
@@ -0,0 +1,150 @@
+package chezmoi
+
+import (
+	"path/filepath"
+)
+
+// A Provider is a layer that provides a target.
+type Provider struct {
+	// Layer is the index of the layer in RootState.Layers, or zero if the
+	// RootState is not layered.
+	Layer int
+	// SourceDir is the layer's source directory.
+	SourceDir string
+	// State is the layer's state for the target.
+	State Stater
+}
+
+// MergeLayers returns a new RootState whose targets are the targets of
+// layers, which must already be populated, in increasing order of precedence.
+// Each target is taken from the highest layer that provides it. Directories
+// provided by several layers are merged, with their attributes taken from the
+// highest layer. A file in a remove file in a higher layer removes the target
+// from all lower layers. The source directory and options of the returned
+// RootState are those of the highest layer.
+func MergeLayers(layers []*RootState) *RootState {
+	top := layers[len(layers)-1]
+	rs := NewRootState(top.TargetDir, top.Umask, top.SourceDir, top.Data)
+	rs.TemplateOptions = top.TemplateOptions
+	rs.Parallelism = top.Parallelism
+	rs.KeepGoing = top.KeepGoing
+	rs.CacheDir = top.CacheDir
+	rs.FetchExternals = top.FetchExternals
+	rs.Layers = layers
+	for _, layer := range layers {
+		rs.populateErrors = append(rs.populateErrors, layer.populateErrors...)
+		rs.Warnings = append(rs.Warnings, layer.Warnings...)
+		for _, rms := range layer.Removes {
+			if !rms.Pattern {
+				rs.deleteTarget(rms.Name)
+			}
+			rs.Removes = append(rs.Removes, rms)
+		}
+		mergeStates(rs.Dirs, rs.Files, layer.Dirs, layer.Files)
+	}
+	return rs
+}
+
+// Providers returns the layers that provide targetName, in decreasing order
+// of precedence, so the first provider is the one whose state is used. If rs
+// is not layered then rs itself is the only possible provider.
+func (rs *RootState) Providers(targetName string) []Provider {
+	layers := rs.Layers
+	if len(layers) == 0 {
+		layers = []*RootState{rs}
+	}
+	var providers []Provider
+	for i := len(layers) - 1; i >= 0; i-- {
+		if state := layers[i].find(targetName); state != nil {
+			providers = append(providers, Provider{
+				Layer:     i,
+				SourceDir: layers[i].SourceDir,
+				State:     state,
+			})
+		}
+	}
+	return providers
+}
+
+// layerSourceDir returns the source directory of the layer that provides
+// state, the state of targetName in rs, or the empty string if rs is not
+// layered.
+func (rs *RootState) layerSourceDir(targetName string, state Stater) string {
+	if rms, ok := state.(*RemoveState); ok && rms.Pattern {
+		for _, layer := range rs.Layers {
+			for _, layerRMS := range layer.Removes {
+				if layerRMS == rms {
+					return layer.SourceDir
+				}
+			}
+		}
+		return ""
+	}
+	if providers := rs.Providers(targetName); len(rs.Layers) != 0 && len(providers) != 0 {
+		return providers[0].SourceDir
+	}
+	return ""
+}
+
+// deleteTarget removes targetName, and all of its descendants, from rs.
+func (rs *RootState) deleteTarget(targetName string) {
+	dirs, files := rs.Dirs, rs.Files
+	components := splitPathList(targetName)
+	for i := 0; i < len(components)-1; i++ {
+		dirState, ok := dirs[components[i]]
+		if !ok {
+			return
+		}
+		dirs, files = dirState.Dirs, dirState.Files
+	}
+	name := components[len(components)-1]
+	delete(dirs, name)
+	delete(files, name)
+}
+
+// find returns the state of targetName in rs, including targets that are
+// removed but not patterns in the remove file, or nil if there is no such
+// target.
+func (rs *RootState) find(targetName string) Stater {
+	if state := rs.Get(filepath.Clean(targetName)); state != nil {
+		return state
+	}
+	for _, rms := range rs.Removes {
+		if !rms.Pattern && rms.Name == targetName {
+			return rms
+		}
+	}
+	return nil
+}
+
+// mergeStates merges srcDirs and srcFiles into dstDirs and dstFiles. States
+// in src replace states with the same name in dst, except that directories
+// that are in both are merged. Directories in src are copied so that merging
+// later layers does not modify them.
+func mergeStates(dstDirs map[string]*DirState, dstFiles map[string]*FileState, srcDirs map[string]*DirState, srcFiles map[string]*FileState) {
+	for name, fileState := range srcFiles {
+		delete(dstDirs, name)
+		dstFiles[name] = fileState
+	}
+	for name, srcDirState := range srcDirs {
+		delete(dstFiles, name)
+		dirState := &DirState{
+			sourceName: srcDirState.sourceName,
+			exactMode:  srcDirState.exactMode,
+			external:   srcDirState.external,
+			Mode:       srcDirState.Mode,
+			Dirs:       make(map[string]*DirState),
+			Files:      make(map[string]*FileState),
+		}
+		if dstDirState, ok := dstDirs[name]; ok {
+			for subDirName, subDirState := range dstDirState.Dirs {
+				dirState.Dirs[subDirName] = subDirState
+			}
+			for fileName, fileState := range dstDirState.Files {
+				dirState.Files[fileName] = fileState
+			}
+		}
+		mergeStates(dirState.Dirs, dirState.Files, srcDirState.Dirs, srcDirState.Files)
+		dstDirs[name] = dirState
+	}
+}
@@ -0,0 +1,158 @@
+package chezmoi
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestMergeLayers(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		fsMap       map[string]string
+		sourceDirs  []string
+		wantEntries []string
+	}{
+		{
+			name: "override",
+			fsMap: map[string]string{
+				"/team/dot_bashrc":                "team",
+				"/team/dot_profile":               "team",
+				"/home/user/.chezmoi/dot_bashrc":  "user",
+				"/home/user/.chezmoi/dot_inputrc": "user",
+			},
+			sourceDirs: []string{"/team", "/home/user/.chezmoi"},
+			wantEntries: []string{
+				".bashrc file /home/user/.chezmoi/dot_bashrc",
+				".inputrc file /home/user/.chezmoi/dot_inputrc",
+				".profile file /team/dot_profile",
+			},
+		},
+		{
+			name: "merge_dirs",
+			fsMap: map[string]string{
+				"/team/dot_config/a":                       "team",
+				"/team/dot_config/b":                       "team",
+				"/home/user/.chezmoi/private_dot_config/b": "user",
+				"/home/user/.chezmoi/private_dot_config/c": "user",
+			},
+			sourceDirs: []string{"/team", "/home/user/.chezmoi"},
+			wantEntries: []string{
+				".config dir /home/user/.chezmoi/private_dot_config",
+				".config/a file /team/dot_config/a",
+				".config/b file /home/user/.chezmoi/private_dot_config/b",
+				".config/c file /home/user/.chezmoi/private_dot_config/c",
+			},
+		},
+		{
+			name: "file_replaces_dir",
+			fsMap: map[string]string{
+				"/team/dot_vim/vimrc":         "team",
+				"/home/user/.chezmoi/dot_vim": "user",
+			},
+			sourceDirs: []string{"/team", "/home/user/.chezmoi"},
+			wantEntries: []string{
+				".vim file /home/user/.chezmoi/dot_vim",
+			},
+		},
+		{
+			name: "remove",
+			fsMap: map[string]string{
+				"/team/dot_bashrc":                      "team",
+				"/team/dot_config/a":                    "team",
+				"/home/user/.chezmoi/remove_dot_bashrc": "",
+				"/home/user/.chezmoi/.chezmoiremove":    ".cache/*",
+			},
+			sourceDirs: []string{"/team", "/home/user/.chezmoi"},
+			wantEntries: []string{
+				".bashrc remove /home/user/.chezmoi/remove_dot_bashrc",
+				".cache/* remove /home/user/.chezmoi/.chezmoiremove",
+				".config dir /team/dot_config",
+				".config/a file /team/dot_config/a",
+			},
+		},
+		{
+			name: "three_layers",
+			fsMap: map[string]string{
+				"/company/dot_gitconfig":            "company",
+				"/team/dot_gitconfig":               "team",
+				"/team/dot_bashrc":                  "team",
+				"/home/user/.chezmoi/dot_gitconfig": "user",
+			},
+			sourceDirs: []string{"/company", "/team", "/home/user/.chezmoi"},
+			wantEntries: []string{
+				".bashrc file /team/dot_bashrc",
+				".gitconfig file /home/user/.chezmoi/dot_gitconfig",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(tc.fsMap)
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(%v) == %v, %v, want !<nil>, <nil>", tc.fsMap, fs, err)
+			}
+			var layers []*RootState
+			for _, sourceDir := range tc.sourceDirs {
+				layer := NewRootState("/home/user", 022, sourceDir, nil)
+				if err := layer.Populate(fs); err != nil {
+					t.Fatalf("layer.Populate(_) == %v, want <nil>", err)
+				}
+				layers = append(layers, layer)
+			}
+			rs := MergeLayers(layers)
+			entries, err := rs.Dump(nil, DumpOptions{OmitContents: true})
+			if err != nil {
+				t.Fatalf("rs.Dump(nil, _) == %v, %v, want !<nil>, <nil>", entries, err)
+			}
+			var gotEntries []string
+			for _, entry := range entries {
+				gotEntries = append(gotEntries, entry.Path+" "+entry.Type+" "+filepath.Join(entry.SourceDir, entry.SourceName))
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.wantEntries, gotEntries); !equal {
+				t.Errorf("MergeLayers(_) diff:\n%s\n", diff)
+			}
+			// Merging must not modify the layers themselves.
+			if len(layers[0].Dirs)+len(layers[0].Files) == 0 {
+				t.Errorf("MergeLayers(_) modified layers[0]")
+			}
+		})
+	}
+}
+
+func TestProviders(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/team/dot_bashrc":                     "team",
+		"/team/dot_profile":                    "team",
+		"/home/user/.chezmoi/dot_bashrc":       "user",
+		"/home/user/.chezmoi/remove_dot_login": "",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	var layers []*RootState
+	for _, sourceDir := range []string{"/team", "/home/user/.chezmoi"} {
+		layer := NewRootState("/home/user", 022, sourceDir, nil)
+		if err := layer.Populate(fs); err != nil {
+			t.Fatalf("layer.Populate(_) == %v, want <nil>", err)
+		}
+		layers = append(layers, layer)
+	}
+	rs := MergeLayers(layers)
+	for targetName, want := range map[string][]string{
+		".bashrc":  {"1 /home/user/.chezmoi/dot_bashrc", "0 /team/dot_bashrc"},
+		".profile": {"0 /team/dot_profile"},
+		".login":   {"1 /home/user/.chezmoi/remove_dot_login"},
+		".zshrc":   nil,
+	} {
+		var got []string
+		for _, provider := range rs.Providers(targetName) {
+			got = append(got, strconv.Itoa(provider.Layer)+" "+filepath.Join(provider.SourceDir, provider.State.SourceName()))
+		}
+		if diff, equal := messagediff.PrettyDiff(want, got); !equal {
+			t.Errorf("rs.Providers(%q) diff:\n%s\n", targetName, diff)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package chezmoi
+
+import "sync"
+
+// lazyContents are contents that are computed when they are first needed and
+// then memoised. They are safe for concurrent use.
+type lazyContents struct {
+	once         sync.Once
+	contentsFunc func() ([]byte, error)
+	contents     []byte
+	err          error
+}
+
+// newLazyContents returns a new lazyContents with the already-known contents.
+func newLazyContents(contents []byte) *lazyContents {
+	lc := &lazyContents{
+		contents: contents,
+	}
+	lc.once.Do(func() {})
+	return lc
+}
+
+// newLazyContentsFunc returns a new lazyContents whose contents are computed
+// by contentsFunc.
+func newLazyContentsFunc(contentsFunc func() ([]byte, error)) *lazyContents {
+	return &lazyContents{
+		contentsFunc: contentsFunc,
+	}
+}
+
+// Contents returns lc's contents, computing them if needed.
+func (lc *lazyContents) Contents() ([]byte, error) {
+	lc.once.Do(func() {
+		lc.contents, lc.err = lc.contentsFunc()
+		lc.contentsFunc = nil
+	})
+	return lc.contents, lc.err
+}
@@ -0,0 +1,51 @@
+package chezmoi
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestLazyContents(t *testing.T) {
+	calls := 0
+	lc := newLazyContentsFunc(func() ([]byte, error) {
+		calls++
+		return []byte("contents"), nil
+	})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if contents, err := lc.Contents(); err != nil || string(contents) != "contents" {
+				t.Errorf("lc.Contents() == %q, %v, want %q, <nil>", contents, err, "contents")
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("calls == %d, want 1", calls)
+	}
+}
+
+func TestPopulateLazy(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/dot_bashrc.tmpl": "# {{ .name }}\n",
+		"/home/user/.chezmoi/dot_broken.tmpl": "{{ .name",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", map[string]interface{}{"name": "John Smith"})
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	if contents, err := rs.Get(".bashrc").(*FileState).Contents(); err != nil || string(contents) != "# John Smith\n" {
+		t.Errorf("rs.Get(%q).Contents() == %q, %v, want %q, <nil>", ".bashrc", contents, err, "# John Smith\n")
+	}
+	_, err = rs.Get(".broken").(*FileState).Contents()
+	if te, ok := err.(*TemplateError); !ok || te.SourceName != "dot_broken.tmpl" {
+		t.Errorf("rs.Get(%q).Contents() == _, %v, want error in %s", ".broken", err, "dot_broken.tmpl")
+	}
+}
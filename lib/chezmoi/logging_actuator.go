@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
@@ -58,6 +59,35 @@ func (a *LoggingActuator) RemoveAll(name string) error {
 	return err
 }
 
+// Rename implements Actuator.Rename.
+func (a *LoggingActuator) Rename(oldpath, newpath string) error {
+	action := fmt.Sprintf("mv %s %s", oldpath, newpath)
+	err := a.a.Rename(oldpath, newpath)
+	if err == nil {
+		log.Print(action)
+	} else {
+		log.Printf("%s: %v", action, err)
+	}
+	return err
+}
+
+// Symlink implements Symlinker.Symlink.
+func (a *LoggingActuator) Symlink(oldname, newname string) error {
+	action := fmt.Sprintf("ln -s %s %s", oldname, newname)
+	var err error
+	if s, ok := a.a.(Symlinker); ok {
+		err = s.Symlink(oldname, newname)
+	} else {
+		err = errors.Errorf("%s: symlinks not supported", newname)
+	}
+	if err == nil {
+		log.Print(action)
+	} else {
+		log.Printf("%s: %v", action, err)
+	}
+	return err
+}
+
 // WriteFile implements Actuator.WriteFile.
 func (a *LoggingActuator) WriteFile(name string, contents []byte, mode os.FileMode, currentContents []byte) error {
 	action := fmt.Sprintf("install -m %o /dev/null %s", mode, name)
@@ -0,0 +1,35 @@
+package chezmoi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// runModifyScript runs script with currentContents on its standard input and
+// returns its standard output. The script is written to a temporary file so
+// that it can be executed by the operating system, even if the source
+// directory is not on the real filesystem.
+func runModifyScript(script, currentContents []byte) ([]byte, error) {
+	f, err := ioutil.TempFile("", "chezmoi-modify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(script); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Chmod(0700); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(f.Name())
+	cmd.Stdin = bytes.NewReader(currentContents)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
@@ -0,0 +1,121 @@
+package chezmoi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+)
+
+// Move moves the target oldTargetName to newTargetName by renaming its source
+// file or directory with actuator, keeping its attributes. Parent directories
+// of newTargetName that are not already in rs are added, using the
+// permissions of existing target directories. Modes set in the attributes file
+// for the moved targets are moved to their new names.
+func (rs *RootState) Move(fs afero.Fs, oldTargetName, newTargetName string, actuator Actuator) error {
+	oldTargetName = filepath.Clean(oldTargetName)
+	newTargetName = filepath.Clean(newTargetName)
+	state := rs.Get(oldTargetName)
+	if state == nil {
+		return errors.Errorf("%s: not found", oldTargetName)
+	}
+	if IsExternal(state) {
+		return errors.Errorf("%s: managed by %s", oldTargetName, state.SourceName())
+	}
+	if rs.Get(newTargetName) != nil {
+		return errors.Errorf("%s: already exists", newTargetName)
+	}
+	if filepath.HasPrefix(newTargetName, oldTargetName+string(os.PathSeparator)) {
+		return errors.Errorf("%s: cannot move to a subdirectory of itself, %s", oldTargetName, newTargetName)
+	}
+
+	// The externals file refers to its targets by name, so they cannot be
+	// moved with their parent directories.
+	oldStates := map[string]Stater{oldTargetName: state}
+	if dirState, ok := state.(*DirState); ok {
+		dirState.allStates(oldStates, oldTargetName)
+	}
+	for targetName, state := range oldStates {
+		if IsExternal(state) {
+			return errors.Errorf("%s: contains %s, managed by %s", oldTargetName, targetName, state.SourceName())
+		}
+	}
+
+	if err := rs.importParentDirs(fs, newTargetName, actuator); err != nil {
+		return err
+	}
+	newDirSourceName := ""
+	newDirs, newFiles := rs.Dirs, rs.Files
+	if parentDirName := filepath.Dir(newTargetName); parentDirName != "." {
+		dirState := rs.findDirState(parentDirName)
+		if dirState.external {
+			return errors.Errorf("%s: parent directory managed by %s", newTargetName, dirState.sourceName)
+		}
+		newDirSourceName = dirState.sourceName
+		newDirs, newFiles = dirState.Dirs, dirState.Files
+	}
+	oldDirs, oldFiles := rs.Dirs, rs.Files
+	if parentDirName := filepath.Dir(oldTargetName); parentDirName != "." {
+		dirState := rs.findDirState(parentDirName)
+		oldDirs, oldFiles = dirState.Dirs, dirState.Files
+	}
+
+	oldSourceName := state.SourceName()
+	name := filepath.Base(newTargetName)
+	var newSourceName string
+	switch state.(type) {
+	case *DirState:
+		_, mode := parseDirName(filepath.Base(oldSourceName))
+		newSourceName = filepath.Join(newDirSourceName, makeDirName(name, mode))
+	case *FileState:
+		fa := parseFileName(filepath.Base(oldSourceName))
+		fa.name = name
+		newSourceName = filepath.Join(newDirSourceName, makeFileName(fa))
+	}
+	if err := actuator.Rename(filepath.Join(rs.SourceDir, oldSourceName), filepath.Join(rs.SourceDir, newSourceName)); err != nil {
+		return err
+	}
+
+	oldName := filepath.Base(oldTargetName)
+	switch state := state.(type) {
+	case *DirState:
+		delete(oldDirs, oldName)
+		newDirs[name] = state
+		state.setSourceName(newSourceName)
+	case *FileState:
+		delete(oldFiles, oldName)
+		newFiles[name] = state
+		state.sourceName = newSourceName
+	}
+
+	// Move the attributes of exactly the moved targets so that no stale modes
+	// remain for the old target names.
+	lines := make(map[string]string)
+	for oldStateName, state := range oldStates {
+		var mode os.FileMode
+		switch state := state.(type) {
+		case *DirState:
+			if !state.exactMode {
+				continue
+			}
+			mode = state.Mode
+		case *FileState:
+			if !state.exactMode {
+				continue
+			}
+			mode = state.Mode
+		}
+		newStateName := newTargetName + strings.TrimPrefix(oldStateName, oldTargetName)
+		if _, ok := lines[attributePattern(oldStateName)]; !ok {
+			lines[attributePattern(oldStateName)] = ""
+		}
+		lines[attributePattern(newStateName)] = fmt.Sprintf("%s %04o", attributePattern(newStateName), mode&os.ModePerm)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return rs.rewriteAttributes(fs, lines, actuator)
+}
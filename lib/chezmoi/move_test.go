@@ -0,0 +1,201 @@
+package chezmoi
+
+import (
+	"testing"
+
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestMove(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		fsMap         map[string]string
+		oldTargetName string
+		newTargetName string
+		wantErr       bool
+		wantFsMap     map[string]string
+	}{
+		{
+			name: "rename",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/private_executable_dot_run.tmpl": "run",
+			},
+			oldTargetName: ".run",
+			newTargetName: "run",
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/private_executable_run.tmpl": "run",
+			},
+		},
+		{
+			name: "new_parent_dirs",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/dot_vimrc": "set nocp\n",
+				"/home/user/.config/.keep":      "",
+			},
+			oldTargetName: ".vimrc",
+			newTargetName: ".config/nvim/init.vim",
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/dot_config/nvim/init.vim": "set nocp\n",
+				"/home/user/.config/.keep":                     "",
+			},
+		},
+		{
+			name: "exact_mode",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiattributes": ".foo 0640\n",
+				"/home/user/.chezmoi/dot_foo":            "foo",
+			},
+			oldTargetName: ".foo",
+			newTargetName: ".bar",
+			wantFsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiattributes": ".bar 0640\n",
+				"/home/user/.chezmoi/dot_bar":            "foo",
+			},
+		},
+		{
+			name: "contains_external",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiexternal.yaml": ".local/bin/tool:\n  type: file\n  url: /tmp/tool\n",
+				"/home/user/.chezmoi/dot_local/dot_profile": "",
+				"/tmp/tool": "#!/bin/sh\n",
+			},
+			oldTargetName: ".local",
+			newTargetName: ".local2",
+			wantErr:       true,
+		},
+		{
+			name: "already_exists",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/dot_foo": "foo",
+				"/home/user/.chezmoi/dot_bar": "bar",
+			},
+			oldTargetName: ".foo",
+			newTargetName: ".bar",
+			wantErr:       true,
+		},
+		{
+			name: "external",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/.chezmoiexternal.yaml": ".local/bin/tool:\n  type: file\n  url: /tmp/tool\n",
+				"/tmp/tool": "#!/bin/sh\n",
+			},
+			oldTargetName: ".local/bin/tool",
+			newTargetName: ".tool",
+			wantErr:       true,
+		},
+		{
+			name: "not_found",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/dot_foo": "foo",
+			},
+			oldTargetName: ".bar",
+			newTargetName: ".baz",
+			wantErr:       true,
+		},
+		{
+			name: "into_itself",
+			fsMap: map[string]string{
+				"/home/user/.chezmoi/dot_vim/vimrc": "",
+			},
+			oldTargetName: ".vim",
+			newTargetName: ".vim/vim",
+			wantErr:       true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(tc.fsMap)
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(%v) == %v, %v, want !<nil>, <nil>", tc.fsMap, fs, err)
+			}
+			rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+			if err := rs.Populate(fs); err != nil {
+				t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+			}
+			err = rs.Move(fs, tc.oldTargetName, tc.newTargetName, NewFsActuator(fs, "/home/user"))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("rs.Move(_, %q, %q, _) == <nil>, want !<nil>", tc.oldTargetName, tc.newTargetName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rs.Move(_, %q, %q, _) == %v, want <nil>", tc.oldTargetName, tc.newTargetName, err)
+			}
+			gotFsMap, err := absfstesting.MakeMapFs(fs)
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMapFs(_) == %v, %v, want !<nil>, <nil>", gotFsMap, err)
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.wantFsMap, gotFsMap); !equal {
+				t.Errorf("rs.Move(_, %q, %q, _) diff:\n%s\n", tc.oldTargetName, tc.newTargetName, diff)
+			}
+			if rs.Get(tc.oldTargetName) != nil || rs.Get(tc.newTargetName) == nil {
+				t.Errorf("rs.Move(_, %q, %q, _) did not update rs", tc.oldTargetName, tc.newTargetName)
+			}
+		})
+	}
+}
+
+func TestMoveDir(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/private_dot_ssh/config":          "Host *\n",
+		"/home/user/.chezmoi/private_dot_ssh/keys/private_id": "key",
+		"/home/user/.chezmoi/dot_config/.keep":                "",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	a := &recordingActuator{}
+	if err := rs.Move(fs, ".ssh", ".config/ssh", a); err != nil {
+		t.Fatalf("rs.Move(_, \".ssh\", \".config/ssh\", _) == %v, want <nil>", err)
+	}
+	wantActions := []string{"mv /home/user/.chezmoi/private_dot_ssh /home/user/.chezmoi/dot_config/private_ssh"}
+	if diff, equal := messagediff.PrettyDiff(wantActions, a.actions); !equal {
+		t.Errorf("rs.Move(_, \".ssh\", \".config/ssh\", _) actions diff:\n%s\n", diff)
+	}
+	wantSourceNames := map[string]string{
+		".config":             "dot_config",
+		".config/ssh":         "dot_config/private_ssh",
+		".config/ssh/config":  "dot_config/private_ssh/config",
+		".config/ssh/keys":    "dot_config/private_ssh/keys",
+		".config/ssh/keys/id": "dot_config/private_ssh/keys/private_id",
+	}
+	gotSourceNames := make(map[string]string)
+	for targetName, state := range rs.AllStates() {
+		gotSourceNames[targetName] = state.SourceName()
+	}
+	if diff, equal := messagediff.PrettyDiff(wantSourceNames, gotSourceNames); !equal {
+		t.Errorf("rs.Move(_, \".ssh\", \".config/ssh\", _) source names diff:\n%s\n", diff)
+	}
+}
+
+func TestMoveDirAttributes(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/.chezmoiattributes":  "# keys\n.ssh/keys 0750\n.ssh/keys/* 0600\n",
+		"/home/user/.chezmoi/dot_ssh/keys/id":     "key",
+		"/home/user/.chezmoi/dot_ssh/keys/id.pub": "pub",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	a := &recordingActuator{}
+	if err := rs.Move(fs, ".ssh/keys", ".ssh/ids", a); err != nil {
+		t.Fatalf("rs.Move(_, \".ssh/keys\", \".ssh/ids\", _) == %v, want <nil>", err)
+	}
+	// Only the attributes for exactly the moved targets are moved.
+	wantActions := []string{
+		"mv /home/user/.chezmoi/dot_ssh/keys /home/user/.chezmoi/dot_ssh/ids",
+		"write 644 /home/user/.chezmoi/.chezmoiattributes \"# keys\\n.ssh/keys/* 0600\\n.ssh/ids 0750\\n.ssh/ids/id 0600\\n.ssh/ids/id.pub 0600\\n\"",
+	}
+	if diff, equal := messagediff.PrettyDiff(wantActions, a.actions); !equal {
+		t.Errorf("rs.Move(_, \".ssh/keys\", \".ssh/ids\", _) actions diff:\n%s\n", diff)
+	}
+}
@@ -0,0 +1,32 @@
+package chezmoi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A MultiError is a list of errors.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	b := &strings.Builder{}
+	if len(e) == 1 {
+		b.WriteString("1 error:")
+	} else {
+		fmt.Fprintf(b, "%d errors:", len(e))
+	}
+	for _, err := range e {
+		fmt.Fprintf(b, "\n\t%s", strings.Replace(err.Error(), "\n", "\n\t", -1))
+	}
+	return b.String()
+}
+
+// keepGoing returns err, unless rs.KeepGoing is true, in which case it
+// appends err to errs and returns nil.
+func (rs *RootState) keepGoing(errs *[]error, err error) error {
+	if err == nil || !rs.KeepGoing {
+		return err
+	}
+	*errs = append(*errs, err)
+	return nil
+}
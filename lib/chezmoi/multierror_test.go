@@ -0,0 +1,79 @@
+package chezmoi
+
+import (
+	"os"
+	"testing"
+
+	"github.com/d4l3k/messagediff"
+	"github.com/pkg/errors"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+// A failingActuator wraps an Actuator and fails to make directories called
+// name.
+type failingActuator struct {
+	Actuator
+	name string
+}
+
+func (a *failingActuator) Mkdir(name string, mode os.FileMode) error {
+	if name == a.name {
+		return errors.Errorf("%s: mkdir failed", name)
+	}
+	return a.Actuator.Mkdir(name, mode)
+}
+
+func TestMultiError(t *testing.T) {
+	err := MultiError{errors.New("foo"), errors.New("bar\nbaz")}
+	want := "2 errors:\n\tfoo\n\tbar\n\tbaz"
+	if got := err.Error(); got != want {
+		t.Errorf("err.Error() == %q, want %q", got, want)
+	}
+}
+
+func TestApplyKeepGoing(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/a.tmpl": "{{ .a",
+		"/home/user/.chezmoi/b":      "b",
+		"/home/user/.chezmoi/c/d":    "d",
+		"/home/user/.chezmoi/e/f":    "f",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 0, "/home/user/.chezmoi", nil)
+	rs.KeepGoing = true
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	err = rs.Apply(fs, ApplyOptions{}, &failingActuator{Actuator: NewFsActuator(fs, "/home/user"), name: "/home/user/c"})
+	multiErr, ok := err.(MultiError)
+	if !ok || len(multiErr) != 2 {
+		t.Fatalf("rs.Apply(_, _, _) == %v, want MultiError with 2 errors", err)
+	}
+	if te, ok := multiErr[0].(*TemplateError); !ok || te.SourceName != "a.tmpl" {
+		t.Errorf("multiErr[0] == %v, want error in a.tmpl", multiErr[0])
+	}
+	gotFsMap, err := absfstesting.MakeMapFs(fs)
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMapFs(%v) == %v, %v, want !<nil>, <nil>", fs, gotFsMap, err)
+	}
+	wantFsMap := map[string]string{
+		"/home/user/.chezmoi/a.tmpl": "{{ .a",
+		"/home/user/.chezmoi/b":      "b",
+		"/home/user/.chezmoi/c/d":    "d",
+		"/home/user/.chezmoi/e/f":    "f",
+		"/home/user/b":               "b",
+		"/home/user/e/f":             "f",
+	}
+	if diff, equal := messagediff.PrettyDiff(wantFsMap, gotFsMap); !equal {
+		t.Errorf("%s\n", diff)
+	}
+
+	rs.KeepGoing = false
+	if err := rs.Apply(fs, ApplyOptions{}, NewFsActuator(fs, "/home/user")); err == nil {
+		t.Errorf("rs.Apply(_, _, _) == <nil>, want !<nil>")
+	} else if _, ok := err.(MultiError); ok {
+		t.Errorf("rs.Apply(_, _, _) == %v, want first error only", err)
+	}
+}
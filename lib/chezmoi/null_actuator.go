@@ -25,6 +25,16 @@ func (a *NullActuator) RemoveAll(string) error {
 	return nil
 }
 
+// Rename implements Actuator.Rename.
+func (a *NullActuator) Rename(string, string) error {
+	return nil
+}
+
+// Symlink implements Symlinker.Symlink.
+func (a *NullActuator) Symlink(string, string) error {
+	return nil
+}
+
 // WriteFile implements Actuator.WriteFile.
 func (a *NullActuator) WriteFile(string, []byte, os.FileMode, []byte) error {
 	return nil
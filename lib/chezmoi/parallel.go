@@ -0,0 +1,31 @@
+package chezmoi
+
+import "sync"
+
+// forEachParallel calls f for each i in [0, n) using at most parallelism
+// goroutines, and returns when all calls have returned. If parallelism is less
+// than two then f is called serially, in order.
+func forEachParallel(n, parallelism int, f func(int)) {
+	if parallelism < 2 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < parallelism && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
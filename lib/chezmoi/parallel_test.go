@@ -0,0 +1,129 @@
+package chezmoi
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/absfs/afero"
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+// A recordingActuator records the actions that it is asked to make, without
+// making them.
+type recordingActuator struct {
+	actions []string
+}
+
+func (a *recordingActuator) Chmod(name string, mode os.FileMode) error {
+	a.actions = append(a.actions, fmt.Sprintf("chmod %o %s", mode, name))
+	return nil
+}
+
+func (a *recordingActuator) Mkdir(name string, mode os.FileMode) error {
+	a.actions = append(a.actions, fmt.Sprintf("mkdir %o %s", mode, name))
+	return nil
+}
+
+func (a *recordingActuator) RemoveAll(name string) error {
+	a.actions = append(a.actions, fmt.Sprintf("rm -rf %s", name))
+	return nil
+}
+
+func (a *recordingActuator) Rename(oldpath, newpath string) error {
+	a.actions = append(a.actions, fmt.Sprintf("mv %s %s", oldpath, newpath))
+	return nil
+}
+
+func (a *recordingActuator) WriteFile(name string, contents []byte, mode os.FileMode, currentContents []byte) error {
+	a.actions = append(a.actions, fmt.Sprintf("write %o %s %q", mode, name, contents))
+	return nil
+}
+
+// makeLargeMemMapFs returns a filesystem with n source files, spread across
+// directories, half of which are templates, and targets for half of them.
+func makeLargeMemMapFs(n int) (afero.Fs, error) {
+	fsMap := make(map[string]string)
+	for i := 0; i < n; i++ {
+		dir := fmt.Sprintf("dir%d/subdir%d", i%10, i%7)
+		if i%2 == 0 {
+			fsMap[fmt.Sprintf("/home/user/.chezmoi/%s/file%d.tmpl", dir, i)] = fmt.Sprintf("{{ .name }} %d\n", i)
+		} else {
+			fsMap[fmt.Sprintf("/home/user/.chezmoi/%s/file%d", dir, i)] = fmt.Sprintf("file %d\n", i)
+		}
+		if i%4 < 2 {
+			fsMap[fmt.Sprintf("/home/user/%s/file%d", dir, i)] = fmt.Sprintf("file %d\n", i)
+		}
+	}
+	return absfstesting.MakeMemMapFs(fsMap)
+}
+
+func TestApplyParallel(t *testing.T) {
+	fs, err := makeLargeMemMapFs(200)
+	if err != nil {
+		t.Fatalf("makeLargeMemMapFs(200) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	var want []string
+	for _, parallelism := range []int{1, 2, 8} {
+		rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", map[string]interface{}{"name": "John Smith"})
+		rs.Parallelism = parallelism
+		if err := rs.Populate(fs); err != nil {
+			t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+		}
+		a := &recordingActuator{}
+		if err := rs.Apply(fs, ApplyOptions{}, a); err != nil {
+			t.Fatalf("rs.Apply(_, _, _) == %v, want <nil>", err)
+		}
+		if want == nil {
+			want = a.actions
+			continue
+		}
+		if diff, equal := messagediff.PrettyDiff(want, a.actions); !equal {
+			t.Errorf("parallelism %d: actions diff:\n%s\n", parallelism, diff)
+		}
+	}
+}
+
+func TestApplyParallelError(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/a.tmpl": "{{ .a",
+		"/home/user/.chezmoi/b.tmpl": "{{ .b",
+		"/home/user/.chezmoi/c.tmpl": "{{ .c",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	for i := 0; i < 10; i++ {
+		rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+		rs.Parallelism = 3
+		if err := rs.Populate(fs); err != nil {
+			t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+		}
+		err := rs.Apply(fs, ApplyOptions{}, NewNullActuator())
+		if te, ok := err.(*TemplateError); !ok || te.SourceName != "a.tmpl" {
+			t.Fatalf("rs.Apply(_, _, _) == %v, want error in a.tmpl", err)
+		}
+	}
+}
+
+func benchmarkApply(b *testing.B, parallelism int) {
+	fs, err := makeLargeMemMapFs(2000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", map[string]interface{}{"name": "John Smith"})
+	rs.Parallelism = parallelism
+	if err := rs.Populate(fs); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := rs.Apply(fs, ApplyOptions{}, NewNullActuator()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkApplySerial(b *testing.B)   { benchmarkApply(b, 1) }
+func BenchmarkApplyParallel(b *testing.B) { benchmarkApply(b, 8) }
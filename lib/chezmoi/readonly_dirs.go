@@ -0,0 +1,115 @@
+package chezmoi
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// writableDirMode is the permissions that a directory's owner needs to create
+// and remove entries in it.
+const writableDirMode = 0700
+
+// isWritableDirMode returns true if mode allows a directory's owner to create
+// and remove entries in it.
+func isWritableDirMode(mode os.FileMode) bool {
+	return mode&writableDirMode == writableDirMode
+}
+
+// A readonlyDirs records the target directories whose permissions do not
+// allow their owner to change their entries. Such directories are made
+// writable while their contents are applied and made read-only again
+// afterwards, see restore.
+type readonlyDirs struct {
+	// modes are the target modes of read-only directories.
+	modes map[string]os.FileMode
+	// pending are the directories whose modes must be set by restore, in the
+	// order that they were applied.
+	pending   []string
+	isPending map[string]bool
+}
+
+// newReadonlyDirs returns a new, empty readonlyDirs.
+func newReadonlyDirs() *readonlyDirs {
+	return &readonlyDirs{
+		modes:     make(map[string]os.FileMode),
+		isPending: make(map[string]bool),
+	}
+}
+
+// postpone records that the mode of dir must be set by restore.
+func (rd *readonlyDirs) postpone(dir string) {
+	if rd.isPending[dir] {
+		return
+	}
+	rd.pending = append(rd.pending, dir)
+	rd.isPending[dir] = true
+}
+
+// unlock makes dir writable with actuator, if it is a read-only directory
+// that has not already been made writable.
+func (rd *readonlyDirs) unlock(actuator Actuator, dir string) error {
+	mode, ok := rd.modes[dir]
+	if !ok || rd.isPending[dir] {
+		return nil
+	}
+	if err := actuator.Chmod(dir, mode|writableDirMode); err != nil {
+		return err
+	}
+	rd.postpone(dir)
+	return nil
+}
+
+// restore sets the modes of all directories that were made writable, or
+// whose modes were deferred, with actuator.
+func (rd *readonlyDirs) restore(actuator Actuator) error {
+	for i := len(rd.pending) - 1; i >= 0; i-- {
+		if err := actuator.Chmod(rd.pending[i], rd.modes[rd.pending[i]]); err != nil {
+			return err
+		}
+	}
+	rd.pending = nil
+	rd.isPending = make(map[string]bool)
+	return nil
+}
+
+// A readonlyDirsActuator makes read-only directories writable before
+// changing their entries.
+type readonlyDirsActuator struct {
+	Actuator
+	rd *readonlyDirs
+}
+
+// Mkdir implements Actuator.Mkdir.
+func (a *readonlyDirsActuator) Mkdir(name string, mode os.FileMode) error {
+	if err := a.rd.unlock(a.Actuator, filepath.Dir(name)); err != nil {
+		return err
+	}
+	return a.Actuator.Mkdir(name, mode)
+}
+
+// RemoveAll implements Actuator.RemoveAll.
+func (a *readonlyDirsActuator) RemoveAll(name string) error {
+	if err := a.rd.unlock(a.Actuator, filepath.Dir(name)); err != nil {
+		return err
+	}
+	return a.Actuator.RemoveAll(name)
+}
+
+// Rename implements Actuator.Rename.
+func (a *readonlyDirsActuator) Rename(oldpath, newpath string) error {
+	if err := a.rd.unlock(a.Actuator, filepath.Dir(oldpath)); err != nil {
+		return err
+	}
+	if err := a.rd.unlock(a.Actuator, filepath.Dir(newpath)); err != nil {
+		return err
+	}
+	return a.Actuator.Rename(oldpath, newpath)
+}
+
+// WriteFile implements Actuator.WriteFile.
+func (a *readonlyDirsActuator) WriteFile(name string, contents []byte, mode os.FileMode, currentContents []byte) error {
+	if err := a.rd.unlock(a.Actuator, filepath.Dir(name)); err != nil {
+		return err
+	}
+	return a.Actuator.WriteFile(name, contents, mode, currentContents)
+}
@@ -0,0 +1,146 @@
+package chezmoi
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+)
+
+// removeFileName is the name of the file in the source directory that lists
+// targets that should be removed.
+const removeFileName = ".chezmoiremove"
+
+// A RemoveState represents a target that should not exist. If Pattern is true
+// then Name is a glob pattern matching targets that should not exist.
+type RemoveState struct {
+	sourceName string
+	Name       string
+	Pattern    bool
+}
+
+// SourceName implements Stater.SourceName.
+func (rms *RemoveState) SourceName() string {
+	return rms.sourceName
+}
+
+// targetPaths returns the paths of the existing targets in targetDir in fs
+// that rms would remove.
+func (rms *RemoveState) targetPaths(fs afero.Fs, targetDir string) ([]string, error) {
+	if rms.Pattern {
+		return afero.Glob(fs, filepath.Join(targetDir, rms.Name))
+	}
+	targetPath := filepath.Join(targetDir, rms.Name)
+	// Symlinks themselves are removed, even if they are dangling.
+	switch _, err := lstat(fs, targetPath); {
+	case err == nil:
+		return []string{targetPath}, nil
+	case os.IsNotExist(err):
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// populateRemoves reads the patterns in the remove file in the source
+// directory, if it exists. The remove file is always treated as a template.
+// Blank lines and lines beginning with # are ignored.
+func (rs *RootState) populateRemoves(fs afero.Fs) error {
+	contents, err := afero.ReadFile(fs, filepath.Join(rs.SourceDir, removeFileName))
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	contents, err = rs.executeTemplate(removeFileName, "", contents)
+	if err != nil {
+		return err
+	}
+	s := bufio.NewScanner(bytes.NewReader(contents))
+	for s.Scan() {
+		pattern := strings.TrimSpace(s.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "%s: %s", removeFileName, pattern)
+		}
+		name := filepath.Clean(pattern)
+		if filepath.IsAbs(name) || !isInside(name) {
+			return errors.Errorf("%s: %s: not inside the target directory", removeFileName, pattern)
+		}
+		rs.Removes = append(rs.Removes, &RemoveState{
+			sourceName: removeFileName,
+			Name:       name,
+			Pattern:    true,
+		})
+	}
+	return s.Err()
+}
+
+// applyRemoves removes all existing targets that should not exist, except
+// those that are also managed by rs. If rs.KeepGoing is true then errors are
+// appended to errs.
+func (rs *RootState) applyRemoves(fs afero.Fs, applyOptions ApplyOptions, actuator Actuator, errs *[]error) error {
+	targetPathSet := make(map[string]bool)
+	for _, rms := range rs.Removes {
+		targetPaths, err := rms.targetPaths(fs, rs.TargetDir)
+		if err != nil {
+			if err := rs.keepGoing(errs, err); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, targetPath := range targetPaths {
+			if applyOptions.includes(rs.TargetDir, targetPath, false) {
+				targetPathSet[targetPath] = true
+			}
+		}
+	}
+	targetPaths := []string{}
+	for targetPath := range targetPathSet {
+		targetName, err := filepath.Rel(rs.TargetDir, targetPath)
+		if err != nil {
+			return err
+		}
+		// Never remove the target directory itself or anything outside it.
+		if !isInside(targetName) {
+			if err := rs.keepGoing(errs, errors.Errorf("%s: not inside %s", targetPath, rs.TargetDir)); err != nil {
+				return err
+			}
+			continue
+		}
+		if rs.Get(targetName) != nil {
+			continue
+		}
+		targetPaths = append(targetPaths, targetPath)
+	}
+	sort.Strings(targetPaths)
+	for _, targetPath := range targetPaths {
+		if applyOptions.ConfirmRemove != nil {
+			ok, err := applyOptions.ConfirmRemove(targetPath)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if err := rs.keepGoing(errs, actuator.RemoveAll(targetPath)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isInside returns true if the relative path name, which must be clean, names
+// something strictly inside the directory that it is relative to.
+func isInside(name string) bool {
+	return name != "." && name != ".." && !strings.HasPrefix(name, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,146 @@
+package chezmoi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/absfs/afero"
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestApplyRemovesConfirm(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/remove_dot_bar": "",
+		"/home/user/.chezmoi/remove_dot_foo": "",
+		"/home/user/.chezmoi/remove_dot_baz": "",
+		"/home/user/.bar":                    "bar",
+		"/home/user/.foo":                    "foo",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(%+v) == %v, want <nil>", fs, err)
+	}
+	var gotPrompts []string
+	applyOptions := ApplyOptions{
+		ConfirmRemove: func(targetPath string) (bool, error) {
+			gotPrompts = append(gotPrompts, targetPath)
+			return targetPath == "/home/user/.foo", nil
+		},
+	}
+	if err := rs.Apply(fs, applyOptions, NewFsActuator(fs, "/home/user")); err != nil {
+		t.Fatalf("rs.Apply(_, _, _) == %v, want <nil>", err)
+	}
+	wantPrompts := []string{"/home/user/.bar", "/home/user/.foo"}
+	if diff, equal := messagediff.PrettyDiff(wantPrompts, gotPrompts); !equal {
+		t.Errorf("prompts diff:\n%s\n", diff)
+	}
+	gotFsMap, err := absfstesting.MakeMapFs(fs)
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMapFs(%v) == %v, %v, want !<nil>, <nil>", fs, gotFsMap, err)
+	}
+	wantFsMap := map[string]string{
+		"/home/user/.chezmoi/remove_dot_bar": "",
+		"/home/user/.chezmoi/remove_dot_foo": "",
+		"/home/user/.chezmoi/remove_dot_baz": "",
+		"/home/user/.bar":                    "bar",
+	}
+	if diff, equal := messagediff.PrettyDiff(wantFsMap, gotFsMap); !equal {
+		t.Errorf("%s\n", diff)
+	}
+}
+
+func TestPopulateRemovesOutsideTargetDir(t *testing.T) {
+	for _, pattern := range []string{".", "/", "..", "../x", "*/..", "/home/user/.bashrc"} {
+		t.Run(pattern, func(t *testing.T) {
+			fs, err := absfstesting.MakeMemMapFs(map[string]string{
+				"/home/user/.chezmoi/.chezmoiremove": pattern + "\n",
+			})
+			if err != nil {
+				t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+			}
+			rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+			if err := rs.Populate(fs); err == nil {
+				t.Errorf("rs.Populate(_) == <nil>, want !<nil>")
+			}
+		})
+	}
+}
+
+func TestApplyRemovesOutsideTargetDir(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.bashrc": "bashrc",
+		"/home/other/.x":     "x",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+	rs.Removes = []*RemoveState{
+		{sourceName: removeFileName, Name: ".", Pattern: true},
+		{sourceName: removeFileName, Name: "../other/*", Pattern: true},
+	}
+	a := &recordingActuator{}
+	if err := rs.Apply(fs, ApplyOptions{}, a); err == nil {
+		t.Errorf("rs.Apply(_, _, _) == <nil>, want !<nil>")
+	}
+	if len(a.actions) != 0 {
+		t.Errorf("rs.Apply(_, _, _) actions == %v, want none", a.actions)
+	}
+}
+
+func TestApplyRemovesSymlinks(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "chezmoi")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(_, _) == %v, %v, want !<nil>, <nil>", tempDir, err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	targetDir := filepath.Join(tempDir, "home")
+	for _, dir := range []string{sourceDir, filepath.Join(targetDir, "dir")} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"remove_dot_dangling", "remove_dot_dirlink"} {
+		if err := ioutil.WriteFile(filepath.Join(sourceDir, name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirFile := filepath.Join(targetDir, "dir", "file")
+	if err := ioutil.WriteFile(dirFile, []byte("contents"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for linkname, name := range map[string]string{
+		"missing": ".dangling",
+		"dir":     ".dirlink",
+	} {
+		if err := os.Symlink(linkname, filepath.Join(targetDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := afero.NewOsFs()
+	rs := NewRootState(targetDir, 022, sourceDir, nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	if err := rs.Apply(fs, ApplyOptions{}, NewFsActuator(fs, targetDir)); err != nil {
+		t.Fatalf("rs.Apply(_, _, _) == %v, want <nil>", err)
+	}
+	for _, name := range []string{".dangling", ".dirlink"} {
+		if _, err := os.Lstat(filepath.Join(targetDir, name)); !os.IsNotExist(err) {
+			t.Errorf("os.Lstat(%q) == _, %v, want _, !<nil>", filepath.Join(targetDir, name), err)
+		}
+	}
+	// Only the symlink to the directory is removed, not the directory.
+	if _, err := os.Stat(dirFile); err != nil {
+		t.Errorf("os.Stat(%q) == _, %v, want _, <nil>", dirFile, err)
+	}
+}
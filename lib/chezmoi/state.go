@@ -0,0 +1,185 @@
+package chezmoi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/absfs/afero"
+)
+
+// A Fingerprint identifies the state of a target file without reading it.
+type Fingerprint struct {
+	Size    int64
+	ModTime time.Time
+	Inode   uint64
+	SHA256  string
+}
+
+// A StateStore records the fingerprints of target files that were found to
+// match their target contents, so that they do not need to be read again
+// while they are unchanged. It is safe for concurrent use.
+type StateStore struct {
+	mu           sync.Mutex
+	Fingerprints map[string]Fingerprint
+}
+
+// NewStateStore returns a new, empty StateStore.
+func NewStateStore() *StateStore {
+	return &StateStore{
+		Fingerprints: make(map[string]Fingerprint),
+	}
+}
+
+// LoadStateStore loads the StateStore at path in fs. If path does not exist
+// then it returns an empty StateStore.
+func LoadStateStore(fs afero.Fs, path string) (*StateStore, error) {
+	s := NewStateStore()
+	data, err := afero.ReadFile(fs, path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Fingerprints == nil {
+		s.Fingerprints = make(map[string]Fingerprint)
+	}
+	return s, nil
+}
+
+// Save saves s to path in fs.
+func (s *StateStore) Save(fs afero.Fs, path string) error {
+	s.mu.Lock()
+	data, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, path, data, 0600)
+}
+
+// SaveWithActuator saves s to path with actuator, so that the change is made
+// or reported like any other. fs is used to read the current contents of
+// path.
+func (s *StateStore) SaveWithActuator(fs afero.Fs, path string, actuator Actuator) error {
+	s.mu.Lock()
+	data, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	currentContents, err := afero.ReadFile(fs, path)
+	switch {
+	case os.IsNotExist(err):
+		if _, err := fs.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+			if err := actuator.Mkdir(filepath.Dir(path), 0700); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+	return actuator.WriteFile(path, data, 0600, currentContents)
+}
+
+// Rename moves the fingerprints of oldPath, and of all of its descendants, to
+// newPath. If newPath is empty then they are removed. It returns true if any
+// fingerprints were changed.
+func (s *StateStore) Rename(oldPath, newPath string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	renamed := make(map[string]Fingerprint)
+	for path, fp := range s.Fingerprints {
+		switch {
+		case path == oldPath:
+			renamed[newPath] = fp
+		case filepath.HasPrefix(path, oldPath+string(os.PathSeparator)):
+			renamed[filepath.Join(newPath, path[len(oldPath)+1:])] = fp
+		default:
+			continue
+		}
+		delete(s.Fingerprints, path)
+	}
+	if newPath != "" {
+		for path, fp := range renamed {
+			s.Fingerprints[path] = fp
+		}
+	}
+	return len(renamed) != 0
+}
+
+// inSync returns true if targetPath, with file info fi, was previously
+// recorded as having contents.
+func (s *StateStore) inSync(targetPath string, fi os.FileInfo, contents []byte) bool {
+	s.mu.Lock()
+	fp, ok := s.Fingerprints[targetPath]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	want := newFingerprint(fi, contents)
+	return fp.Size == want.Size && fp.ModTime.Equal(want.ModTime) && fp.Inode == want.Inode && fp.SHA256 == want.SHA256
+}
+
+// record records that targetPath, with file info fi, has contents.
+func (s *StateStore) record(targetPath string, fi os.FileInfo, contents []byte) {
+	fp := newFingerprint(fi, contents)
+	s.mu.Lock()
+	s.Fingerprints[targetPath] = fp
+	s.mu.Unlock()
+}
+
+func newFingerprint(fi os.FileInfo, contents []byte) Fingerprint {
+	var inode uint64
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		inode = uint64(stat.Ino)
+	}
+	sum := sha256.Sum256(contents)
+	return Fingerprint{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Inode:   inode,
+		SHA256:  hex.EncodeToString(sum[:]),
+	}
+}
+
+// fileContentsEqual returns true if the contents of name in fs are equal to
+// contents. It reads name in chunks, so large files are not read into memory.
+func fileContentsEqual(fs afero.Fs, name string, contents []byte) (bool, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > len(contents) || !bytes.Equal(buf[:n], contents[:n]) {
+			return false, nil
+		}
+		contents = contents[n:]
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return len(contents) == 0, nil
+		default:
+			return false, err
+		}
+	}
+}
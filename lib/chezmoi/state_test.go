@@ -0,0 +1,174 @@
+package chezmoi
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/absfs/afero"
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestFileContentsEqual(t *testing.T) {
+	big := make([]byte, 100*1024)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	bigChanged := append([]byte{}, big...)
+	bigChanged[len(bigChanged)-1]++
+	for _, tc := range []struct {
+		name     string
+		current  []byte
+		contents []byte
+		want     bool
+	}{
+		{name: "empty", current: nil, contents: nil, want: true},
+		{name: "equal", current: []byte("foo"), contents: []byte("foo"), want: true},
+		{name: "different", current: []byte("foo"), contents: []byte("bar"), want: false},
+		{name: "shorter", current: []byte("fo"), contents: []byte("foo"), want: false},
+		{name: "longer", current: []byte("fooo"), contents: []byte("foo"), want: false},
+		{name: "big_equal", current: big, contents: big, want: true},
+		{name: "big_different", current: big, contents: bigChanged, want: false},
+		{name: "big_shorter", current: big[:len(big)-1], contents: big, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			if err := afero.WriteFile(fs, "/file", tc.current, 0666); err != nil {
+				t.Fatalf("afero.WriteFile(...) == %v, want <nil>", err)
+			}
+			if got, err := fileContentsEqual(fs, "/file", tc.contents); err != nil || got != tc.want {
+				t.Errorf("fileContentsEqual(_, %q, _) == %v, %v, want %v, <nil>", "/file", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi/dot_foo": "bar",
+		"/home/user/.foo":             "bar",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	rs := NewRootState("/home/user", 0, "/home/user/.chezmoi", nil)
+	if err := rs.Populate(fs); err != nil {
+		t.Fatalf("rs.Populate(_) == %v, want <nil>", err)
+	}
+	state := NewStateStore()
+	if err := rs.Apply(fs, ApplyOptions{State: state}, NewNullActuator()); err != nil {
+		t.Fatalf("rs.Apply(_, _, _) == %v, want <nil>", err)
+	}
+	if err := state.Save(fs, "/home/user/.chezmoi.state.json"); err != nil {
+		t.Fatalf("state.Save(_, _) == %v, want <nil>", err)
+	}
+	state, err = LoadStateStore(fs, "/home/user/.chezmoi.state.json")
+	if err != nil {
+		t.Fatalf("LoadStateStore(_, _) == _, %v, want _, <nil>", err)
+	}
+	if _, ok := state.Fingerprints["/home/user/.foo"]; !ok {
+		t.Fatalf("state.Fingerprints[%q] not found", "/home/user/.foo")
+	}
+
+	// Change the target without changing its fingerprint.
+	fi, err := fs.Stat("/home/user/.foo")
+	if err != nil {
+		t.Fatalf("fs.Stat(_) == _, %v, want _, <nil>", err)
+	}
+	modTime := fi.ModTime()
+	if err := afero.WriteFile(fs, "/home/user/.foo", []byte("baz"), 0666); err != nil {
+		t.Fatalf("afero.WriteFile(...) == %v, want <nil>", err)
+	}
+	if err := fs.Chtimes("/home/user/.foo", modTime, modTime); err != nil {
+		t.Fatalf("fs.Chtimes(...) == %v, want <nil>", err)
+	}
+	for _, tc := range []struct {
+		name           string
+		verifyContents bool
+		want           []string
+	}{
+		{name: "fingerprint", verifyContents: false, want: nil},
+		{name: "verify_contents", verifyContents: true, want: []string{`write 666 /home/user/.foo "bar"`}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &recordingActuator{}
+			if err := rs.Apply(fs, ApplyOptions{State: state, VerifyContents: tc.verifyContents}, a); err != nil {
+				t.Fatalf("rs.Apply(_, _, _) == %v, want <nil>", err)
+			}
+			if diff, equal := messagediff.PrettyDiff(tc.want, a.actions); !equal {
+				t.Errorf("actions diff:\n%s\n", diff)
+			}
+		})
+	}
+}
+
+func TestStateStoreRename(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		oldPath     string
+		newPath     string
+		wantChanged bool
+		wantPaths   []string
+	}{
+		{
+			name:        "dir",
+			oldPath:     "/home/user/.ssh",
+			newPath:     "/home/user/.config/ssh",
+			wantChanged: true,
+			wantPaths:   []string{"/home/user/.bashrc", "/home/user/.config/ssh/config", "/home/user/.config/ssh/keys/id", "/home/user/.sshrc"},
+		},
+		{
+			name:        "remove",
+			oldPath:     "/home/user/.bashrc",
+			wantChanged: true,
+			wantPaths:   []string{"/home/user/.ssh/config", "/home/user/.ssh/keys/id", "/home/user/.sshrc"},
+		},
+		{
+			name:      "unchanged",
+			oldPath:   "/home/user/.zshrc",
+			newPath:   "/home/user/.zshenv",
+			wantPaths: []string{"/home/user/.bashrc", "/home/user/.ssh/config", "/home/user/.ssh/keys/id", "/home/user/.sshrc"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewStateStore()
+			for _, path := range []string{"/home/user/.bashrc", "/home/user/.ssh/config", "/home/user/.ssh/keys/id", "/home/user/.sshrc"} {
+				s.Fingerprints[path] = Fingerprint{SHA256: path}
+			}
+			if gotChanged := s.Rename(tc.oldPath, tc.newPath); gotChanged != tc.wantChanged {
+				t.Errorf("s.Rename(%q, %q) == %v, want %v", tc.oldPath, tc.newPath, gotChanged, tc.wantChanged)
+			}
+			var gotPaths []string
+			for path := range s.Fingerprints {
+				gotPaths = append(gotPaths, path)
+			}
+			sort.Strings(gotPaths)
+			if diff, equal := messagediff.PrettyDiff(tc.wantPaths, gotPaths); !equal {
+				t.Errorf("s.Rename(%q, %q) diff:\n%s\n", tc.oldPath, tc.newPath, diff)
+			}
+		})
+	}
+}
+
+func TestStateStoreSaveWithActuator(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.chezmoi.state.json": `{"Fingerprints":{}}`,
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	s := NewStateStore()
+	s.Fingerprints["/home/user/.bashrc"] = Fingerprint{Size: 1}
+	a := &recordingActuator{}
+	if err := s.SaveWithActuator(fs, "/home/user/.chezmoi.state.json", a); err != nil {
+		t.Fatalf("s.SaveWithActuator(_, _, _) == %v, want <nil>", err)
+	}
+	if len(a.actions) != 1 || !strings.HasPrefix(a.actions[0], "write 600 /home/user/.chezmoi.state.json ") {
+		t.Errorf("s.SaveWithActuator(_, _, _) actions == %v, want one write", a.actions)
+	}
+	// The actuator, not s, writes the file.
+	if contents, err := afero.ReadFile(fs, "/home/user/.chezmoi.state.json"); err != nil || string(contents) != `{"Fingerprints":{}}` {
+		t.Errorf("afero.ReadFile(_, _) == %q, %v, want unchanged, <nil>", contents, err)
+	}
+}
@@ -0,0 +1,216 @@
+package chezmoi
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	templateErrorLocationRegexp  = regexp.MustCompile(`(?s)\A(\d+)(?::(\d+))?: (.*)\z`)
+	templateErrorExecutingRegexp = regexp.MustCompile(`(?s)\Aexecuting ".*?" at <(.*?)>: (.*)\z`)
+	templateMissingKeyRegexp     = regexp.MustCompile(`\Amap has no entry for key "(.*)"\z`)
+	templateFieldChainRegexp     = regexp.MustCompile(`\A\$?(\.[^\s.()]+)+\z`)
+	templateDirectiveRegexp      = regexp.MustCompile(`\A\s*(?:[#;%"'!]+|//+|--+|<!--|/\*+|\(\*)?\s*` + regexp.QuoteMeta(templateDirectivePrefix))
+)
+
+// A TemplateError is an error parsing or executing a template. It records the
+// location of the error in the source file, the offending source line, and
+// the target that the template would produce.
+type TemplateError struct {
+	SourceName string
+	TargetPath string
+	Line       int // 1-based, 0 if unknown
+	Column     int // 1-based, 0 if unknown
+	SourceLine string
+	MissingKey string
+	Msg        string
+	Err        error
+}
+
+// templateDirectivePrefix introduces per-file template directives at the start
+// of the first line of a template, optionally after a comment marker.
+const templateDirectivePrefix = "chezmoi:template:"
+
+// templateDirectives are the per-file template directives.
+type templateDirectives struct {
+	leftDelimiter  string
+	rightDelimiter string
+	options        []string
+}
+
+// parseTemplateDirectives parses any template directives on the first line of
+// contents. It returns the directives, contents with the directive line
+// removed, and the number of lines removed.
+func parseTemplateDirectives(contents []byte) (*templateDirectives, []byte, int, error) {
+	td := &templateDirectives{}
+	firstLine := contents
+	rest := []byte(nil)
+	if i := bytes.IndexByte(contents, '\n'); i != -1 {
+		firstLine, rest = contents[:i], contents[i+1:]
+	}
+	loc := templateDirectiveRegexp.FindIndex(firstLine)
+	if loc == nil {
+		return td, contents, 0, nil
+	}
+	// Fields without an = sign are ignored so that the directive can be
+	// wrapped in the target file's comment syntax, e.g. <!-- ... -->.
+	for _, field := range strings.Fields(string(firstLine[loc[1]:])) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "left-delimiter":
+			td.leftDelimiter = value
+		case "right-delimiter":
+			td.rightDelimiter = value
+		case "missing-key":
+			if !IsValidMissingKey(value) {
+				return nil, nil, 0, errors.Errorf("%s: invalid missing-key", value)
+			}
+			td.options = append(td.options, "missingkey="+value)
+		default:
+			return nil, nil, 0, errors.Errorf("%s: unknown template directive", key)
+		}
+	}
+	return td, rest, 1, nil
+}
+
+// quote returns s quoted so that executing it as a template with td's
+// delimiters produces s.
+func (td *templateDirectives) quote(s string) string {
+	leftDelimiter, rightDelimiter := td.leftDelimiter, td.rightDelimiter
+	if leftDelimiter == "" {
+		leftDelimiter = "{{"
+	}
+	if rightDelimiter == "" {
+		rightDelimiter = "}}"
+	}
+	if !strings.Contains(s, leftDelimiter) && !strings.Contains(s, rightDelimiter) {
+		return s
+	}
+	return leftDelimiter + " " + strconv.Quote(s) + " " + rightDelimiter
+}
+
+// IsValidMissingKey returns true if value is a valid value for
+// text/template's missingkey option.
+func IsValidMissingKey(value string) bool {
+	switch value {
+	case "default", "invalid", "zero", "error":
+		return true
+	default:
+		return false
+	}
+}
+
+// newTemplateError returns a new TemplateError for err, which was returned by
+// text/template when parsing or executing contents. lineOffset is the number
+// of lines removed from the start of contents before parsing.
+func newTemplateError(sourceName, targetPath string, contents []byte, lineOffset int, err error) *TemplateError {
+	te := &TemplateError{
+		SourceName: sourceName,
+		TargetPath: targetPath,
+		Msg:        err.Error(),
+		Err:        err,
+	}
+	// text/template errors are of the form "template: name:line: msg" or
+	// "template: name:line:col: executing "name" at <node>: msg", where col
+	// is 0-based.
+	location := strings.TrimPrefix(te.Msg, "template: "+sourceName+":")
+	if location == te.Msg {
+		return te
+	}
+	m := templateErrorLocationRegexp.FindStringSubmatch(location)
+	if m == nil {
+		return te
+	}
+	te.Line, _ = strconv.Atoi(m[1])
+	te.Line += lineOffset
+	if m[2] != "" {
+		column, _ := strconv.Atoi(m[2])
+		te.Column = column + 1
+	}
+	te.Msg = m[3]
+	node := ""
+	if m := templateErrorExecutingRegexp.FindStringSubmatch(te.Msg); m != nil {
+		node, te.Msg = m[1], m[2]
+	}
+	if m := templateMissingKeyRegexp.FindStringSubmatch(te.Msg); m != nil {
+		if templateFieldChainRegexp.MatchString(node) {
+			te.MissingKey = node
+		} else {
+			te.MissingKey = m[1]
+		}
+	}
+	if lines := strings.Split(string(contents), "\n"); 1 <= te.Line && te.Line <= len(lines) {
+		te.SourceLine = lines[te.Line-1]
+	}
+	return te
+}
+
+func (te *TemplateError) Error() string {
+	b := &strings.Builder{}
+	b.WriteString(te.SourceName)
+	if te.Line != 0 {
+		fmt.Fprintf(b, ":%d", te.Line)
+		if te.Column != 0 {
+			fmt.Fprintf(b, ":%d", te.Column)
+		}
+	}
+	fmt.Fprintf(b, ": %s", te.Msg)
+	var details []string
+	if te.MissingKey != "" {
+		details = append(details, "missing key "+te.MissingKey)
+	}
+	if te.TargetPath != "" {
+		details = append(details, "target "+te.TargetPath)
+	}
+	if len(details) != 0 {
+		fmt.Fprintf(b, " (%s)", strings.Join(details, ", "))
+	}
+	if te.SourceLine != "" {
+		fmt.Fprintf(b, "\n\t%s", te.SourceLine)
+		if te.Column != 0 && te.Column <= len(te.SourceLine)+1 {
+			// Preserve tabs so that the caret lines up with the source line.
+			caret := strings.Map(func(r rune) rune {
+				if r == '\t' {
+					return r
+				}
+				return ' '
+			}, te.SourceLine[:te.Column-1])
+			fmt.Fprintf(b, "\n\t%s^", caret)
+		}
+	}
+	return b.String()
+}
+
+// executeTemplate parses and executes contents, the contents of the template
+// sourceName that produces the target at targetPath, with rs's data and
+// template options. Any per-file template directives override rs's template
+// options.
+func (rs *RootState) executeTemplate(sourceName, targetPath string, contents []byte) ([]byte, error) {
+	td, text, lineOffset, err := parseTemplateDirectives(contents)
+	if err != nil {
+		return nil, errors.Wrap(err, sourceName)
+	}
+	tmpl, err := template.New(sourceName).
+		Delims(td.leftDelimiter, td.rightDelimiter).
+		Option(rs.TemplateOptions...).
+		Option(td.options...).
+		Parse(string(text))
+	if err != nil {
+		return nil, newTemplateError(sourceName, targetPath, contents, lineOffset, err)
+	}
+	output := &bytes.Buffer{}
+	if err := tmpl.Execute(output, rs.Data); err != nil {
+		return nil, newTemplateError(sourceName, targetPath, contents, lineOffset, err)
+	}
+	return output.Bytes(), nil
+}
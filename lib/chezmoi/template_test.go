@@ -0,0 +1,165 @@
+package chezmoi
+
+import "testing"
+
+func TestTemplateError(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		contents        string
+		templateOptions []string
+		data            map[string]interface{}
+		wantErrStr      string
+	}{
+		{
+			name:            "missing_key",
+			contents:        "[user]\n\temail = {{ .email }}\n",
+			templateOptions: []string{"missingkey=error"},
+			data:            map[string]interface{}{},
+			wantErrStr:      "dot_gitconfig.tmpl:2:13: map has no entry for key \"email\" (missing key .email, target /home/user/.gitconfig)\n\t\temail = {{ .email }}\n\t\t           ^",
+		},
+		{
+			name:            "missing_nested_key",
+			contents:        "email = {{ .personal.email }}\n",
+			templateOptions: []string{"missingkey=error"},
+			data: map[string]interface{}{
+				"personal": map[string]interface{}{},
+			},
+			wantErrStr: "dot_gitconfig.tmpl:1:21: map has no entry for key \"email\" (missing key .personal.email, target /home/user/.gitconfig)\n\temail = {{ .personal.email }}\n\t                    ^",
+		},
+		{
+			name:       "parse_error",
+			contents:   "[user]\n{{ if }}\n",
+			wantErrStr: "dot_gitconfig.tmpl:2: missing value for if (target /home/user/.gitconfig)\n\t{{ if }}",
+		},
+		{
+			name:       "execute_error",
+			contents:   "{{ index .list 1 }}",
+			data:       map[string]interface{}{"list": []string{}},
+			wantErrStr: "dot_gitconfig.tmpl:1:4: error calling index: index out of range: 1 (target /home/user/.gitconfig)\n\t{{ index .list 1 }}\n\t   ^",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := NewRootState("/home/user", 0, "/home/user/.chezmoi", tc.data)
+			rs.TemplateOptions = tc.templateOptions
+			_, err := rs.executeTemplate("dot_gitconfig.tmpl", "/home/user/.gitconfig", []byte(tc.contents))
+			if err == nil {
+				t.Fatalf("rs.executeTemplate(...) == _, <nil>, want _, !<nil>")
+			}
+			if _, ok := err.(*TemplateError); !ok {
+				t.Errorf("rs.executeTemplate(...) returned a %T, want a *TemplateError", err)
+			}
+			if gotErrStr := err.Error(); gotErrStr != tc.wantErrStr {
+				t.Errorf("rs.executeTemplate(...) == _, %q, want _, %q", gotErrStr, tc.wantErrStr)
+			}
+		})
+	}
+}
+
+func TestTemplateDirectives(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		contents        string
+		templateOptions []string
+		data            map[string]interface{}
+		want            string
+		wantErrStr      string
+	}{
+		{
+			name:     "no_directives",
+			contents: "email = {{ .email }}\n",
+			data:     map[string]interface{}{"email": "user@example.com"},
+			want:     "email = user@example.com\n",
+		},
+		{
+			name:     "delimiters",
+			contents: "# chezmoi:template:left-delimiter=[[ right-delimiter=]]\nemail = [[ .email ]]\nvalue: {{ .Values.foo }}\n",
+			data:     map[string]interface{}{"email": "user@example.com"},
+			want:     "email = user@example.com\nvalue: {{ .Values.foo }}\n",
+		},
+		{
+			name:     "delimiters_in_comment",
+			contents: "<!-- chezmoi:template:left-delimiter=<< right-delimiter=>> -->\n<p><< .name >></p>\n",
+			data:     map[string]interface{}{"name": "John Smith"},
+			want:     "<p>John Smith</p>\n",
+		},
+		{
+			name:            "missing_key_overrides_global_option",
+			contents:        "# chezmoi:template:missing-key=zero\nemail = {{ .email }}\n",
+			templateOptions: []string{"missingkey=error"},
+			data:            map[string]interface{}{},
+			want:            "email = <no value>\n",
+		},
+		{
+			name:            "error_line_includes_directive",
+			contents:        "# chezmoi:template:left-delimiter=[[ right-delimiter=]]\n[user]\n\temail = [[ .email ]]\n",
+			templateOptions: []string{"missingkey=error"},
+			data:            map[string]interface{}{},
+			wantErrStr:      "dot_gitconfig.tmpl:3:13: map has no entry for key \"email\" (missing key .email, target /home/user/.gitconfig)\n\t\temail = [[ .email ]]\n\t\t           ^",
+		},
+		{
+			name:     "directive_in_text",
+			contents: "See chezmoi:template:left-delimiter=[[ for details, {{ .name }}\n",
+			data:     map[string]interface{}{"name": "John Smith"},
+			want:     "See chezmoi:template:left-delimiter=[[ for details, John Smith\n",
+		},
+		{
+			name:     "directive_after_slashes",
+			contents: "// chezmoi:template:left-delimiter=[[ right-delimiter=]]\nname = [[ .name ]]\n",
+			data:     map[string]interface{}{"name": "John Smith"},
+			want:     "name = John Smith\n",
+		},
+		{
+			name:     "directive_on_later_line",
+			contents: "name = {{ .name }}\n# chezmoi:template:left-delimiter=[[\n",
+			data:     map[string]interface{}{"name": "John Smith"},
+			want:     "name = John Smith\n# chezmoi:template:left-delimiter=[[\n",
+		},
+		{
+			name:       "invalid_missing_key",
+			contents:   "# chezmoi:template:missing-key=maybe\n",
+			wantErrStr: "dot_gitconfig.tmpl: maybe: invalid missing-key",
+		},
+		{
+			name:       "unknown_directive",
+			contents:   "# chezmoi:template:delimiters=[[]]\n",
+			wantErrStr: "dot_gitconfig.tmpl: delimiters: unknown template directive",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := NewRootState("/home/user", 0, "/home/user/.chezmoi", tc.data)
+			rs.TemplateOptions = tc.templateOptions
+			got, err := rs.executeTemplate("dot_gitconfig.tmpl", "/home/user/.gitconfig", []byte(tc.contents))
+			if tc.wantErrStr != "" {
+				if err == nil || err.Error() != tc.wantErrStr {
+					t.Errorf("rs.executeTemplate(...) == _, %v, want _, %q", err, tc.wantErrStr)
+				}
+				return
+			}
+			if err != nil || string(got) != tc.want {
+				t.Errorf("rs.executeTemplate(...) == %q, %v, want %q, <nil>", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestTemplateDirectivesQuote(t *testing.T) {
+	for _, tc := range []struct {
+		contents string
+		s        string
+	}{
+		{contents: "", s: ".config/*"},
+		{contents: "", s: "{{ .x }}/*"},
+		{contents: "", s: `a}}"b`},
+		{contents: "# chezmoi:template:left-delimiter=[[ right-delimiter=]]\n", s: "[[ .x ]]/{{ .y }}"},
+	} {
+		td, _, _, err := parseTemplateDirectives([]byte(tc.contents))
+		if err != nil {
+			t.Fatalf("parseTemplateDirectives(%q) == _, _, _, %v, want _, _, _, <nil>", tc.contents, err)
+		}
+		rs := NewRootState("/home/user", 022, "/home/user/.chezmoi", nil)
+		got, err := rs.executeTemplate("test", "", []byte(tc.contents+td.quote(tc.s)))
+		if err != nil || string(got) != tc.s {
+			t.Errorf("executing %q == %q, %v, want %q, <nil>", td.quote(tc.s), got, err, tc.s)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package chezmoi
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/absfs/afero"
+	"github.com/pkg/errors"
+)
+
+// ErrInterrupted is returned by a TransactionActuator's methods after it has
+// been interrupted.
+var ErrInterrupted = errors.New("interrupted")
+
+// A TransactionActuator wraps an Actuator and records the state of every
+// target in a journal before it is changed, so that all changes can be rolled
+// back if any of them fail. The journal is synced to disk before each change
+// so that changes can also be rolled back after a crash.
+type TransactionActuator struct {
+	fs          afero.Fs
+	journalPath string
+	a           Actuator
+	interrupted int32
+}
+
+// A snapshot is the state of a single target before it was changed.
+type snapshot struct {
+	Name     string
+	Exists   bool
+	Mode     os.FileMode `json:",omitempty"`
+	Contents []byte      `json:",omitempty"`
+	Linkname string      `json:",omitempty"`
+}
+
+// A journalEntry records the state of all targets affected by a single
+// change, parents before children.
+type journalEntry struct {
+	Snapshots []snapshot
+}
+
+// NewTransactionActuator returns a new TransactionActuator that records the
+// state of targets in fs in the journal at journalPath before changing them
+// with a.
+func NewTransactionActuator(fs afero.Fs, journalPath string, a Actuator) *TransactionActuator {
+	return &TransactionActuator{
+		fs:          fs,
+		journalPath: journalPath,
+		a:           a,
+	}
+}
+
+// Chmod implements Actuator.Chmod.
+func (a *TransactionActuator) Chmod(name string, mode os.FileMode) error {
+	if err := a.record(false, name); err != nil {
+		return err
+	}
+	return a.a.Chmod(name, mode)
+}
+
+// Mkdir implements Actuator.Mkdir.
+func (a *TransactionActuator) Mkdir(name string, mode os.FileMode) error {
+	if err := a.record(false, name); err != nil {
+		return err
+	}
+	return a.a.Mkdir(name, mode)
+}
+
+// RemoveAll implements Actuator.RemoveAll.
+func (a *TransactionActuator) RemoveAll(name string) error {
+	if err := a.record(true, name); err != nil {
+		return err
+	}
+	return a.a.RemoveAll(name)
+}
+
+// Rename implements Actuator.Rename.
+func (a *TransactionActuator) Rename(oldpath, newpath string) error {
+	if err := a.record(true, oldpath, newpath); err != nil {
+		return err
+	}
+	return a.a.Rename(oldpath, newpath)
+}
+
+// WriteFile implements Actuator.WriteFile.
+func (a *TransactionActuator) WriteFile(name string, contents []byte, mode os.FileMode, currentContents []byte) error {
+	if err := a.record(false, name); err != nil {
+		return err
+	}
+	return a.a.WriteFile(name, contents, mode, currentContents)
+}
+
+// Interrupt causes all subsequent changes to fail with ErrInterrupted. It is
+// safe to call from another goroutine, for example a signal handler.
+func (a *TransactionActuator) Interrupt() {
+	atomic.StoreInt32(&a.interrupted, 1)
+}
+
+// Pending returns true if a's journal contains changes that have been neither
+// committed nor rolled back, for example because of a crash.
+func (a *TransactionActuator) Pending() (bool, error) {
+	_, err := a.fs.Stat(a.journalPath)
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Interrupted returns true if a has been interrupted.
+func (a *TransactionActuator) Interrupted() bool {
+	return atomic.LoadInt32(&a.interrupted) != 0
+}
+
+// Commit accepts all changes and removes the journal. If a has been
+// interrupted then Commit returns ErrInterrupted and keeps the journal so that
+// the changes can be rolled back.
+func (a *TransactionActuator) Commit() error {
+	if a.Interrupted() {
+		return ErrInterrupted
+	}
+	return a.removeJournal()
+}
+
+// Rollback undoes all changes recorded in the journal, most recent first, and
+// then removes the journal.
+func (a *TransactionActuator) Rollback() error {
+	entries, err := a.readJournal()
+	if err != nil {
+		return err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		for _, s := range entries[i].Snapshots {
+			if err := a.restore(s); err != nil {
+				return err
+			}
+		}
+	}
+	return a.removeJournal()
+}
+
+// removeJournal removes a's journal.
+func (a *TransactionActuator) removeJournal() error {
+	if err := a.fs.Remove(a.journalPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// record appends the current state of names, and all their descendants if
+// recursive is true, to the journal as a single entry.
+func (a *TransactionActuator) record(recursive bool, names ...string) error {
+	if a.Interrupted() {
+		return ErrInterrupted
+	}
+	var snapshots []snapshot
+	for _, name := range names {
+		nameSnapshots, err := a.snapshot(name, recursive)
+		if err != nil {
+			return err
+		}
+		snapshots = append(snapshots, nameSnapshots...)
+	}
+	data, err := json.Marshal(journalEntry{Snapshots: snapshots})
+	if err != nil {
+		return err
+	}
+	if err := a.fs.MkdirAll(filepath.Dir(a.journalPath), 0700); err != nil {
+		return err
+	}
+	f, err := a.fs.OpenFile(a.journalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// snapshot returns the current state of name, and all its descendants if
+// recursive is true.
+func (a *TransactionActuator) snapshot(name string, recursive bool) ([]snapshot, error) {
+	fi, err := lstat(a.fs, name)
+	switch {
+	case os.IsNotExist(err):
+		return []snapshot{{Name: name}}, nil
+	case err != nil:
+		return nil, err
+	case !fi.IsDir() || !recursive:
+		s, err := a.snapshotFileInfo(name, fi)
+		if err != nil {
+			return nil, err
+		}
+		return []snapshot{s}, nil
+	}
+	var snapshots []snapshot
+	if err := afero.Walk(a.fs, name, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		s, err := a.snapshotFileInfo(path, fi)
+		if err != nil {
+			return err
+		}
+		snapshots = append(snapshots, s)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// snapshotFileInfo returns the current state of name, which has
+// os.FileInfo fi. Only directories, regular files, and symlinks can be
+// restored, so any other type is an error.
+func (a *TransactionActuator) snapshotFileInfo(name string, fi os.FileInfo) (snapshot, error) {
+	s := snapshot{
+		Name:   name,
+		Exists: true,
+		Mode:   fi.Mode(),
+	}
+	switch {
+	case fi.IsDir():
+	case fi.Mode().IsRegular():
+		contents, err := afero.ReadFile(a.fs, name)
+		if err != nil {
+			return snapshot{}, err
+		}
+		s.Contents = contents
+	case fi.Mode()&os.ModeSymlink != 0:
+		linkname, err := a.readlink(name)
+		if err != nil {
+			return snapshot{}, err
+		}
+		s.Linkname = linkname
+	default:
+		return snapshot{}, errors.Errorf("%s: cannot record %s for rollback", name, fi.Mode())
+	}
+	return s, nil
+}
+
+// readlink returns the target of the symlink name.
+func (a *TransactionActuator) readlink(name string) (string, error) {
+	if _, ok := a.fs.(*afero.OsFs); ok {
+		return os.Readlink(name)
+	}
+	return "", errors.Errorf("%s: cannot read symlink", name)
+}
+
+// readJournal reads the entries in the journal. A truncated final entry,
+// written when the process was killed, is ignored.
+func (a *TransactionActuator) readJournal() ([]journalEntry, error) {
+	data, err := afero.ReadFile(a.fs, a.journalPath)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	// The final element is empty if the journal ends with a newline, or a
+	// truncated entry otherwise.
+	lines = lines[:len(lines)-1]
+	var entries []journalEntry
+	for i, line := range lines {
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", a.journalPath, i+1)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// restore restores the target described by s with a's underlying Actuator.
+func (a *TransactionActuator) restore(s snapshot) error {
+	fi, err := lstat(a.fs, s.Name)
+	switch {
+	case os.IsNotExist(err):
+		fi = nil
+	case err != nil:
+		return err
+	}
+	switch {
+	case !s.Exists:
+		if fi == nil {
+			return nil
+		}
+		return a.a.RemoveAll(s.Name)
+	case s.Mode.IsDir():
+		if fi != nil && fi.IsDir() {
+			if fi.Mode()&os.ModePerm == s.Mode&os.ModePerm {
+				return nil
+			}
+			return a.a.Chmod(s.Name, s.Mode&os.ModePerm)
+		}
+		if fi != nil {
+			if err := a.a.RemoveAll(s.Name); err != nil {
+				return err
+			}
+		}
+		return a.a.Mkdir(s.Name, s.Mode&os.ModePerm)
+	case s.Mode&os.ModeSymlink != 0:
+		symlinker, ok := a.a.(Symlinker)
+		if !ok {
+			return errors.Errorf("%s: cannot restore symlink", s.Name)
+		}
+		if fi != nil && fi.Mode()&os.ModeSymlink != 0 {
+			if linkname, err := a.readlink(s.Name); err == nil && linkname == s.Linkname {
+				return nil
+			}
+		}
+		if fi != nil {
+			if err := a.a.RemoveAll(s.Name); err != nil {
+				return err
+			}
+		}
+		return symlinker.Symlink(s.Linkname, s.Name)
+	default:
+		var currentContents []byte
+		if fi != nil && !fi.Mode().IsRegular() {
+			if err := a.a.RemoveAll(s.Name); err != nil {
+				return err
+			}
+		} else if fi != nil {
+			currentContents, err = afero.ReadFile(a.fs, s.Name)
+			if err != nil {
+				return err
+			}
+			if fi.Mode()&os.ModePerm == s.Mode&os.ModePerm && bytes.Equal(currentContents, s.Contents) {
+				return nil
+			}
+		}
+		return a.a.WriteFile(s.Name, s.Contents, s.Mode&os.ModePerm, currentContents)
+	}
+}
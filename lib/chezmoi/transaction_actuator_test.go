@@ -0,0 +1,158 @@
+package chezmoi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/absfs/afero"
+	"github.com/d4l3k/messagediff"
+	"github.com/twpayne/chezmoi/internal/absfstesting"
+)
+
+func TestTransactionActuatorRollback(t *testing.T) {
+	fsMap := map[string]string{
+		"/home/user/.bashrc":         "bashrc",
+		"/home/user/.config/a/b.txt": "b",
+		"/home/user/.config/c.txt":   "c",
+	}
+	fs, err := absfstesting.MakeMemMapFs(fsMap)
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	a := NewTransactionActuator(fs, "/home/user/.chezmoi.journal/default", NewFsActuator(fs, "/home/user"))
+	for _, f := range []func() error{
+		func() error { return a.WriteFile("/home/user/.bashrc", []byte("new bashrc"), 0644, []byte("bashrc")) },
+		func() error { return a.WriteFile("/home/user/.zshrc", []byte("zshrc"), 0644, nil) },
+		func() error { return a.Mkdir("/home/user/.vim", 0755) },
+		func() error { return a.WriteFile("/home/user/.vim/vimrc", []byte("vimrc"), 0644, nil) },
+		func() error { return a.Rename("/home/user/.bashrc", "/home/user/.bash_profile") },
+		func() error { return a.RemoveAll("/home/user/.config") },
+		func() error { return a.WriteFile("/home/user/.config", []byte("config"), 0644, nil) },
+	} {
+		if err := f(); err != nil {
+			t.Fatalf("got %v, want <nil>", err)
+		}
+	}
+	if pending, err := a.Pending(); err != nil || !pending {
+		t.Errorf("a.Pending() == %v, %v, want true, <nil>", pending, err)
+	}
+	if err := a.Rollback(); err != nil {
+		t.Fatalf("a.Rollback() == %v, want <nil>", err)
+	}
+	gotFsMap, err := absfstesting.MakeMapFs(fs)
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMapFs(%v) == %v, %v, want !<nil>, <nil>", fs, gotFsMap, err)
+	}
+	if diff, equal := messagediff.PrettyDiff(fsMap, gotFsMap); !equal {
+		t.Errorf("%s\n", diff)
+	}
+	for _, name := range []string{"/home/user/.vim", "/home/user/.chezmoi.journal/default"} {
+		if _, err := fs.Stat(name); err == nil {
+			t.Errorf("fs.Stat(%q) == _, <nil>, want _, !<nil>", name)
+		}
+	}
+}
+
+func TestTransactionActuatorRollbackSymlinks(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "chezmoi")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(_, _) == %v, %v, want !<nil>, <nil>", tempDir, err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(filepath.Join(tempDir, ".config", "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		filepath.Join(tempDir, ".bashrc"):            "dotfiles/bashrc",
+		filepath.Join(tempDir, ".config", "current"): "a",
+	}
+	for name, linkname := range links {
+		if err := os.Symlink(linkname, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := afero.NewOsFs()
+	a := NewTransactionActuator(fs, filepath.Join(tempDir, ".chezmoi.journal", "default"), NewFsActuator(fs, tempDir))
+	for _, f := range []func() error{
+		func() error { return a.WriteFile(filepath.Join(tempDir, ".bashrc"), []byte("bashrc"), 0644, nil) },
+		func() error { return a.RemoveAll(filepath.Join(tempDir, ".config")) },
+	} {
+		if err := f(); err != nil {
+			t.Fatalf("got %v, want <nil>", err)
+		}
+	}
+	if err := a.Rollback(); err != nil {
+		t.Fatalf("a.Rollback() == %v, want <nil>", err)
+	}
+	for name, wantLinkname := range links {
+		if gotLinkname, err := os.Readlink(name); err != nil || gotLinkname != wantLinkname {
+			t.Errorf("os.Readlink(%q) == %q, %v, want %q, <nil>", name, gotLinkname, err, wantLinkname)
+		}
+	}
+	if fi, err := os.Lstat(filepath.Join(tempDir, ".config", "a")); err != nil || !fi.IsDir() {
+		t.Errorf("os.Lstat(%q) == %v, %v, want a directory, <nil>", filepath.Join(tempDir, ".config", "a"), fi, err)
+	}
+}
+
+func TestTransactionActuatorRecover(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.bashrc": "bashrc",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	a := NewTransactionActuator(fs, "/home/user/.chezmoi.journal/default", NewFsActuator(fs, "/home/user"))
+	if err := a.WriteFile("/home/user/.bashrc", []byte("new bashrc"), 0644, []byte("bashrc")); err != nil {
+		t.Fatalf("a.WriteFile(...) == %v, want <nil>", err)
+	}
+	// Simulate a crash while writing the next journal entry.
+	f, err := fs.OpenFile("/home/user/.chezmoi.journal/default", os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(`{"Snapshots":[{"Name":"/ho`)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	a.Interrupt()
+	if err := a.WriteFile("/home/user/.zshrc", []byte("zshrc"), 0644, nil); err != ErrInterrupted {
+		t.Errorf("a.WriteFile(...) == %v, want %v", err, ErrInterrupted)
+	}
+	if err := NewTransactionActuator(fs, "/home/user/.chezmoi.journal/default", NewFsActuator(fs, "/home/user")).Rollback(); err != nil {
+		t.Fatalf("Rollback() == %v, want <nil>", err)
+	}
+	if contents, err := afero.ReadFile(fs, "/home/user/.bashrc"); err != nil || string(contents) != "bashrc" {
+		t.Errorf("afero.ReadFile(fs, %q) == %q, %v, want %q, <nil>", "/home/user/.bashrc", contents, err, "bashrc")
+	}
+}
+
+func TestTransactionActuatorInterruptBeforeCommit(t *testing.T) {
+	fs, err := absfstesting.MakeMemMapFs(map[string]string{
+		"/home/user/.bashrc": "bashrc",
+	})
+	if err != nil {
+		t.Fatalf("absfstesting.MakeMemMapFs(_) == %v, %v, want !<nil>, <nil>", fs, err)
+	}
+	a := NewTransactionActuator(fs, "/home/user/.chezmoi.journal/default", NewFsActuator(fs, "/home/user"))
+	if err := a.WriteFile("/home/user/.bashrc", []byte("new bashrc"), 0644, []byte("bashrc")); err != nil {
+		t.Fatalf("a.WriteFile(...) == %v, want <nil>", err)
+	}
+	// An interrupt after the last change must still prevent the commit.
+	a.Interrupt()
+	if err := a.Commit(); err != ErrInterrupted {
+		t.Errorf("a.Commit() == %v, want %v", err, ErrInterrupted)
+	}
+	if pending, err := a.Pending(); err != nil || !pending {
+		t.Errorf("a.Pending() == %v, %v, want true, <nil>", pending, err)
+	}
+	if err := a.Rollback(); err != nil {
+		t.Fatalf("a.Rollback() == %v, want <nil>", err)
+	}
+	if contents, err := afero.ReadFile(fs, "/home/user/.bashrc"); err != nil || string(contents) != "bashrc" {
+		t.Errorf("afero.ReadFile(fs, %q) == %q, %v, want %q, <nil>", "/home/user/.bashrc", contents, err, "bashrc")
+	}
+}